@@ -0,0 +1,156 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "empty",
+			script: "",
+			want:   nil,
+		},
+		{
+			name:   "single statement",
+			script: "DROP TABLE jobs;\n",
+			want:   []string{"DROP TABLE jobs"},
+		},
+		{
+			name:   "multiple statements",
+			script: "ALTER TABLE segments ADD COLUMN salt VARCHAR(255);\nUPDATE segments SET salt = slug;\n",
+			want:   []string{"ALTER TABLE segments ADD COLUMN salt VARCHAR(255)", "UPDATE segments SET salt = slug"},
+		},
+		{
+			name:   "statement over several lines",
+			script: "CREATE TABLE jobs (\n    id INT\n);\n",
+			want:   []string{"CREATE TABLE jobs (\n    id INT\n)"},
+		},
+		{
+			name:   "comments and blank lines are skipped",
+			script: "-- drop the table\n\n  -- indented comment\nDROP TABLE jobs;\n\n",
+			want:   []string{"DROP TABLE jobs"},
+		},
+		{
+			name:   "semicolon inside a line doesn't split",
+			script: "INSERT INTO t VALUES ('a;b');\n",
+			want:   []string{"INSERT INTO t VALUES ('a;b')"},
+		},
+		{
+			name:   "last statement without a semicolon",
+			script: "DROP TABLE a;\nDROP TABLE b",
+			want:   []string{"DROP TABLE a", "DROP TABLE b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStatements(tt.script)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []Migration
+		wantErr string
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"migrations/0002_b.up.sql":   {Data: []byte("up b")},
+				"migrations/0002_b.down.sql": {Data: []byte("down b")},
+				"migrations/0001_a.up.sql":   {Data: []byte("up a")},
+				"migrations/0001_a.down.sql": {Data: []byte("down a")},
+			},
+			want: []Migration{
+				{Version: 1, Name: "a", Up: "up a", Down: "down a"},
+				{Version: 2, Name: "b", Up: "up b", Down: "down b"},
+			},
+		},
+		{
+			name: "missing down file",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql": {Data: []byte("up a")},
+			},
+			wantErr: "must have both up and down files",
+		},
+		{
+			name: "unknown suffix",
+			files: fstest.MapFS{
+				"migrations/0001_a.sql": {Data: []byte("up a")},
+			},
+			wantErr: "expected .up.sql or .down.sql suffix",
+		},
+		{
+			name: "missing name",
+			files: fstest.MapFS{
+				"migrations/0001.up.sql": {Data: []byte("up a")},
+			},
+			wantErr: "expected <version>_<name>",
+		},
+		{
+			name: "invalid version",
+			files: fstest.MapFS{
+				"migrations/first_a.up.sql": {Data: []byte("up a")},
+			},
+			wantErr: "invalid version",
+		},
+		{
+			name: "conflicting names",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql":   {Data: []byte("up a")},
+				"migrations/0001_b.down.sql": {Data: []byte("down b")},
+			},
+			wantErr: "conflicting names",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMigrations() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadMigrations() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadMigrations() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations are embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s: versions must be consecutive from 1, want %d", m.Version, m.Name, i+1)
+		}
+		if len(splitStatements(m.Up)) == 0 || len(splitStatements(m.Down)) == 0 {
+			t.Errorf("migration %d_%s: up and down must each contain a statement", m.Version, m.Name)
+		}
+	}
+}
@@ -1,9 +1,4 @@
-drop table if exists segment_history;
-drop table if exists user_segments;
-drop table if exists segments;
-drop table if exists users;
-
-CREATE TABLE segments (
+CREATE TABLE IF NOT EXISTS segments (
                           id INT AUTO_INCREMENT PRIMARY KEY,
                           slug VARCHAR(255) NOT NULL,
                           auto_add BOOLEAN DEFAULT false,
@@ -11,13 +6,12 @@ CREATE TABLE segments (
                           created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
-
-CREATE TABLE users (
+CREATE TABLE IF NOT EXISTS users (
                        id INT AUTO_INCREMENT PRIMARY KEY,
                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
-CREATE TABLE user_segments (
+CREATE TABLE IF NOT EXISTS user_segments (
                                user_id INT,
                                segment_id INT,
                                expires_at DATETIME,
@@ -26,7 +20,7 @@ CREATE TABLE user_segments (
                                FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
 );
 
-CREATE TABLE segment_history (
+CREATE TABLE IF NOT EXISTS segment_history (
                                  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
                                  user_id INT NOT NULL,
                                  segment_id INT NOT NULL,
@@ -35,4 +29,3 @@ CREATE TABLE segment_history (
                                  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
                                  FOREIGN KEY (segment_id) REFERENCES segments(id) ON DELETE CASCADE
 );
-
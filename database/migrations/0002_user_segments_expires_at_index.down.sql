@@ -0,0 +1 @@
+DROP INDEX idx_user_segments_expires_at ON user_segments;
@@ -0,0 +1 @@
+CREATE INDEX idx_user_segments_expires_at ON user_segments (expires_at);
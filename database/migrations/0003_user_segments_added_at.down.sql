@@ -0,0 +1 @@
+ALTER TABLE user_segments DROP COLUMN added_at;
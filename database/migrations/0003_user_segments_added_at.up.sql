@@ -0,0 +1 @@
+ALTER TABLE user_segments ADD COLUMN added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
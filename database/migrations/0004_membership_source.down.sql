@@ -0,0 +1,3 @@
+DROP INDEX idx_segments_auto_add ON segments;
+ALTER TABLE segment_history DROP COLUMN reason;
+ALTER TABLE user_segments DROP COLUMN source;
@@ -0,0 +1,3 @@
+ALTER TABLE user_segments ADD COLUMN source VARCHAR(20) NOT NULL DEFAULT 'manual';
+ALTER TABLE segment_history ADD COLUMN reason VARCHAR(32) NOT NULL DEFAULT 'manual';
+CREATE INDEX idx_segments_auto_add ON segments (auto_add);
@@ -0,0 +1,3 @@
+ALTER TABLE segments ADD COLUMN salt VARCHAR(255) NOT NULL DEFAULT '';
+-- Existing segments are salted with their slug, like new segments created without an explicit salt
+UPDATE segments SET salt = slug WHERE salt = '';
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS jobs (
+                      id INT AUTO_INCREMENT PRIMARY KEY,
+                      kind VARCHAR(32) NOT NULL,
+                      segment_id INT NOT NULL,
+                      status VARCHAR(20) NOT NULL DEFAULT 'pending',
+                      total INT NOT NULL DEFAULT 0,
+                      processed INT NOT NULL DEFAULT 0,
+                      added INT NOT NULL DEFAULT 0,
+                      cursor_user_id INT NOT NULL DEFAULT 0,
+                      error TEXT NULL,
+                      created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                      updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+                      finished_at DATETIME NULL,
+                      INDEX idx_jobs_status (status)
+);
@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN default_ttl_seconds BIGINT NULL;
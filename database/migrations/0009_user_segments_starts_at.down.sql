@@ -0,0 +1,3 @@
+DROP INDEX idx_user_segments_pending_activation ON user_segments;
+ALTER TABLE user_segments DROP COLUMN activated_at;
+ALTER TABLE user_segments DROP COLUMN starts_at;
@@ -0,0 +1,3 @@
+ALTER TABLE user_segments ADD COLUMN starts_at DATETIME NULL;
+ALTER TABLE user_segments ADD COLUMN activated_at DATETIME NULL;
+CREATE INDEX idx_user_segments_pending_activation ON user_segments (activated_at, starts_at);
@@ -0,0 +1 @@
+DROP INDEX idx_segment_history_timestamp ON segment_history;
@@ -0,0 +1 @@
+CREATE INDEX idx_segment_history_timestamp ON segment_history (timestamp);
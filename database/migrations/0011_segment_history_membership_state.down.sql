@@ -0,0 +1,3 @@
+DROP INDEX idx_segment_history_user_timestamp ON segment_history;
+ALTER TABLE segment_history DROP COLUMN expires_at;
+ALTER TABLE segment_history DROP COLUMN starts_at;
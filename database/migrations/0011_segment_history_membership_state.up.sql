@@ -0,0 +1,3 @@
+ALTER TABLE segment_history ADD COLUMN starts_at DATETIME NULL;
+ALTER TABLE segment_history ADD COLUMN expires_at DATETIME NULL;
+CREATE INDEX idx_segment_history_user_timestamp ON segment_history (user_id, timestamp);
@@ -0,0 +1,4 @@
+-- Restoring the foreign key drops the history of segments that were deleted in the meantime.
+DELETE FROM segment_history WHERE segment_id NOT IN (SELECT id FROM segments);
+ALTER TABLE segment_history ADD CONSTRAINT segment_history_ibfk_2 FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE;
+ALTER TABLE segment_history DROP COLUMN segment_slug;
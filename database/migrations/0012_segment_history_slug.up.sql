@@ -0,0 +1,6 @@
+ALTER TABLE segment_history ADD COLUMN segment_slug VARCHAR(255) NULL;
+UPDATE segment_history JOIN segments ON segment_history.segment_id = segments.id SET segment_history.segment_slug = segments.slug;
+ALTER TABLE segment_history MODIFY segment_slug VARCHAR(255) NOT NULL;
+-- History outlives its segment, so deleting a segment must no longer cascade.
+-- segment_history_ibfk_2 is the name MySQL generated for the segment_id key in 0001_init.
+ALTER TABLE segment_history DROP FOREIGN KEY segment_history_ibfk_2;
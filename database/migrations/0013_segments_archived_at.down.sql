@@ -0,0 +1,2 @@
+DROP INDEX idx_segments_slug_archived_at ON segments;
+ALTER TABLE segments DROP COLUMN archived_at;
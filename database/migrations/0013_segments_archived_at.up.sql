@@ -0,0 +1,2 @@
+ALTER TABLE segments ADD COLUMN archived_at DATETIME NULL;
+CREATE INDEX idx_segments_slug_archived_at ON segments (slug, archived_at);
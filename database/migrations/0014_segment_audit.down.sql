@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS segment_audit;
+ALTER TABLE segments DROP COLUMN description;
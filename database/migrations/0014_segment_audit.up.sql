@@ -0,0 +1,13 @@
+ALTER TABLE segments ADD COLUMN description VARCHAR(1000) NOT NULL DEFAULT '';
+
+-- No foreign key to segments: the audit trail outlives purged segments, like segment_history
+CREATE TABLE IF NOT EXISTS segment_audit (
+                      id INT AUTO_INCREMENT PRIMARY KEY,
+                      segment_id INT NOT NULL,
+                      segment_slug VARCHAR(255) NOT NULL,
+                      field VARCHAR(32) NOT NULL,
+                      old_value TEXT NOT NULL,
+                      new_value TEXT NOT NULL,
+                      changed_at DATETIME NOT NULL,
+                      INDEX idx_segment_audit_segment_id (segment_id, id)
+);
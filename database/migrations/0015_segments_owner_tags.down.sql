@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS segment_tags;
+DROP INDEX idx_segments_created_at ON segments;
+DROP INDEX idx_segments_owner ON segments;
+ALTER TABLE segments DROP COLUMN owner;
@@ -0,0 +1,11 @@
+ALTER TABLE segments ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX idx_segments_owner ON segments (owner);
+CREATE INDEX idx_segments_created_at ON segments (created_at, id);
+
+CREATE TABLE IF NOT EXISTS segment_tags (
+                      segment_id INT NOT NULL,
+                      tag VARCHAR(50) NOT NULL,
+                      PRIMARY KEY (segment_id, tag),
+                      INDEX idx_segment_tags_tag (tag, segment_id),
+                      FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
+);
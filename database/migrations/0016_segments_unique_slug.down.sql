@@ -0,0 +1,3 @@
+-- Segments archived as duplicates stay archived.
+DROP INDEX idx_segments_active_slug ON segments;
+ALTER TABLE segments DROP COLUMN active_slug;
@@ -0,0 +1,23 @@
+-- Several active segments could share a slug. The oldest one is kept: its duplicates' members
+-- are folded into it and the duplicates are archived, so they can still be inspected.
+INSERT IGNORE INTO user_segments (user_id, segment_id, expires_at, added_at, source, starts_at, activated_at)
+SELECT user_segments.user_id, keeper.id, user_segments.expires_at, user_segments.added_at, user_segments.source, user_segments.starts_at, user_segments.activated_at
+FROM user_segments
+JOIN segments duplicate ON user_segments.segment_id = duplicate.id
+JOIN (SELECT slug, MIN(id) AS id FROM segments WHERE archived_at IS NULL GROUP BY slug) keeper ON duplicate.slug = keeper.slug
+WHERE duplicate.archived_at IS NULL AND duplicate.id <> keeper.id;
+
+INSERT INTO segment_audit (segment_id, segment_slug, field, old_value, new_value, changed_at)
+SELECT duplicate.id, duplicate.slug, 'state', 'active', 'archived', CURRENT_TIMESTAMP
+FROM segments duplicate
+JOIN (SELECT slug, MIN(id) AS id FROM segments WHERE archived_at IS NULL GROUP BY slug) keeper ON duplicate.slug = keeper.slug
+WHERE duplicate.archived_at IS NULL AND duplicate.id <> keeper.id;
+
+UPDATE segments
+JOIN (SELECT slug, MIN(id) AS id FROM segments WHERE archived_at IS NULL GROUP BY slug) keeper ON segments.slug = keeper.slug
+SET segments.archived_at = CURRENT_TIMESTAMP
+WHERE segments.archived_at IS NULL AND segments.id <> keeper.id;
+
+-- Only active segments need unique slugs: archived ones keep theirs so they can be restored
+ALTER TABLE segments ADD COLUMN active_slug VARCHAR(255) GENERATED ALWAYS AS (IF(archived_at IS NULL, slug, NULL)) STORED;
+CREATE UNIQUE INDEX idx_segments_active_slug ON segments (active_slug);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS segment_aliases (
+                      alias VARCHAR(255) NOT NULL PRIMARY KEY,
+                      segment_id INT NOT NULL,
+                      created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                      INDEX idx_segment_aliases_segment_id (segment_id),
+                      FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
+);
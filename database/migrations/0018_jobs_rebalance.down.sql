@@ -0,0 +1,4 @@
+ALTER TABLE jobs
+    DROP COLUMN to_pct,
+    DROP COLUMN from_pct,
+    DROP COLUMN removed;
@@ -0,0 +1,4 @@
+ALTER TABLE jobs
+    ADD COLUMN removed INT NOT NULL DEFAULT 0 AFTER added,
+    ADD COLUMN from_pct INT NOT NULL DEFAULT 0,
+    ADD COLUMN to_pct INT NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS reports (
+                      id VARCHAR(64) NOT NULL PRIMARY KEY,
+                      format VARCHAR(20) NOT NULL,
+                      status VARCHAR(20) NOT NULL DEFAULT 'pending',
+                      history_filter TEXT NOT NULL,
+                      row_count INT NOT NULL DEFAULT 0,
+                      error TEXT NULL,
+                      created_at DATETIME NOT NULL,
+                      finished_at DATETIME NULL,
+                      INDEX idx_reports_status (status),
+                      INDEX idx_reports_created_at (created_at)
+);
@@ -125,7 +125,7 @@ const docTemplate = `{
                 }
             }
         },
-        "/segments/history-report": {
+        "/users/history-report": {
             "get": {
                 "description": "Generate a CSV report of segment history for a specified year and month.",
                 "produces": [
@@ -1,26 +1,37 @@
 package services
 
 import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
 	"avitoGoProject/services"
-	"bytes"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"math"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type APIHandlers struct {
-	userService    *services.UserService
-	segmentService *services.SegmentService
+	userService        *services.UserService
+	segmentService     *services.SegmentService
+	jobService         *services.JobService
+	idempotencyService *services.IdempotencyService
+	reportService      *services.ReportService
 }
 
-func NewAPIHandlers(userService *services.UserService, segmentService *services.SegmentService) *APIHandlers {
+func NewAPIHandlers(userService *services.UserService, segmentService *services.SegmentService, jobService *services.JobService,
+	idempotencyService *services.IdempotencyService, reportService *services.ReportService) *APIHandlers {
 	return &APIHandlers{
-		userService:    userService,
-		segmentService: segmentService,
+		userService:        userService,
+		segmentService:     segmentService,
+		jobService:         jobService,
+		idempotencyService: idempotencyService,
+		reportService:      reportService,
 	}
 }
 
@@ -43,16 +54,23 @@ func (a *APIHandlers) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 }
 
 // UpdateUserSegmentsHandler @Summary Update user segments
-// @Description Update user segments by adding or removing specified segments.
+// @Description Update user segments by adding or removing specified segments. All changes are applied
+// @Description atomically unless "partial" is true, in which case each segment is applied on its own.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param user_id body int true "User ID"
 // @Param segments_to_add body array true "Segments to add"
 // @Param segments_to_remove body array true "Segments to remove"
-// @Param expires_at body string true "Expiration date"
+// @Param starts_at body string false "Date the added segments become active (RFC3339)"
+// @Param expires_at body string false "Expiration date (RFC3339)"
+// @Param ttl body string false "Expiration relative to the start, e.g. 72h"
+// @Param permanent body bool false "Never expire, overriding the segment's default TTL"
+// @Param expiry_policy body string false "keep, extend or replace the expiry of segments the user is already in"
+// @Param partial body bool false "Apply each segment independently"
 // @Success 200 {object} map[string]interface{} "Response message"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "User not found"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /users/update-segments [post]
 func (a *APIHandlers) UpdateUserSegmentsHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,7 +78,12 @@ func (a *APIHandlers) UpdateUserSegmentsHandler(w http.ResponseWriter, r *http.R
 		UserID           int      `json:"user_id"`
 		SegmentsToAdd    []string `json:"segments_to_add"`
 		SegmentsToRemove []string `json:"segments_to_remove"`
-		ExpiresAt        string   `json:"expires_at"` // Expects a string representation of a valid datetime
+		StartsAt         string   `json:"starts_at"`     // Optional, expects a string representation of a valid datetime
+		ExpiresAt        string   `json:"expires_at"`    // Optional, expects a string representation of a valid datetime
+		TTL              string   `json:"ttl"`           // Optional, a duration such as "72h"
+		Permanent        bool     `json:"permanent"`     // Never expire, even if the segment has a default TTL
+		ExpiryPolicy     string   `json:"expiry_policy"` // keep, extend or replace; applies to segments the user is already in
+		Partial          bool     `json:"partial"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&requestData)
@@ -69,85 +92,721 @@ func (a *APIHandlers) UpdateUserSegmentsHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	var startsAt time.Time
+	if requestData.StartsAt != "" {
+		startsAt, err = time.Parse(time.RFC3339, requestData.StartsAt)
+		if err != nil {
+			http.Error(w, "Invalid datetime format for starts_at", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Convert the ExpiresAt string to a time.Time value
-	expiresAt, err := time.Parse(time.RFC3339, requestData.ExpiresAt)
-	if err != nil {
-		http.Error(w, "Invalid datetime format for expires_at", http.StatusBadRequest)
+	var expiresAt time.Time
+	if requestData.ExpiresAt != "" {
+		expiresAt, err = time.Parse(time.RFC3339, requestData.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Invalid datetime format for expires_at", http.StatusBadRequest)
+			return
+		}
+	}
+	var ttl time.Duration
+	if requestData.TTL != "" {
+		ttl, err = time.ParseDuration(requestData.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid duration format for ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	responseMessage, err := a.userService.UpdateUserSegments(services.SegmentsUpdate{
+		UserID:           requestData.UserID,
+		SegmentsToAdd:    requestData.SegmentsToAdd,
+		SegmentsToRemove: requestData.SegmentsToRemove,
+		StartsAt:         startsAt,
+		ExpiresAt:        expiresAt,
+		TTL:              ttl,
+		Permanent:        requestData.Permanent,
+		ExpiryPolicy:     requestData.ExpiryPolicy,
+		Partial:          requestData.Partial,
+	})
+	var unknownSegments *services.UnknownSegmentsError
+	switch {
+	case errors.As(err, &unknownSegments), errors.Is(err, services.ErrInvalidUpdate):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf("User %d doesn't exist", requestData.UserID), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var responseMessage []string
+	jsonResponse(w, map[string]interface{}{"message": responseMessage})
+}
 
-	for _, segmentSlugToAdd := range requestData.SegmentsToAdd {
-		segmentID, err := a.segmentService.GetSegmentIDBySlug(segmentSlugToAdd)
-		if err != nil {
-			responseMessage = append(responseMessage, fmt.Sprintf(`"%s" doesn't exist`, segmentSlugToAdd))
-			continue
-		}
-		// Add the user to the segment and log the operation
-		err = a.userService.AddUserToSegments(requestData.UserID, []int{segmentID}, nil, expiresAt)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// CreateSegmentHandler @Summary Create a new segment
+// @Description Create a new segment with auto-add option and return success message.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Param slug body string true "Slug of the segment, upper snake case such as AVITO_VOICE_MESSAGES, at most 64 characters"
+// @Param auto_add body bool true "Auto Add flag"
+// @Param auto_pct body int true "Auto Percentage, 0-100"
+// @Param default_ttl body string false "Lifetime of memberships added without an explicit expiry, e.g. 720h"
+// @Param description body string false "Free-form description, at most 1000 characters"
+// @Param owner body string false "Team or person responsible for the segment"
+// @Param tags body []string false "Up to 10 lowercase tags"
+// @Success 200 {object} map[string]interface{} "Response message and, for auto_add segments, the ID of the population job"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 409 {string} string "A segment with the slug already exists"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/create [post]
+func (a *APIHandlers) CreateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Slug        string   `json:"slug"`
+		AutoAdd     bool     `json:"auto_add"`
+		AutoPct     int      `json:"auto_pct"`
+		Salt        string   `json:"salt"`        // Optional, defaults to the slug
+		DefaultTTL  string   `json:"default_ttl"` // Optional, a duration such as "720h"
+		Description string   `json:"description"` // Optional
+		Owner       string   `json:"owner"`       // Optional
+		Tags        []string `json:"tags"`        // Optional
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&requestData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var defaultTTL time.Duration
+	if requestData.DefaultTTL != "" {
+		defaultTTL, err = time.ParseDuration(requestData.DefaultTTL)
+		if err != nil || defaultTTL < time.Second {
+			http.Error(w, "Invalid duration format for default_ttl", http.StatusBadRequest)
 			return
 		}
-		err = a.userService.LogSegmentHistory(requestData.UserID, segmentID, "add", time.Now())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	segment := models.Segment{
+		Slug:        requestData.Slug,
+		Description: requestData.Description,
+		Owner:       requestData.Owner,
+		Tags:        requestData.Tags,
+		AutoAdd:     requestData.AutoAdd,
+		AutoPct:     requestData.AutoPct,
+		Salt:        requestData.Salt,
+		DefaultTTL:  defaultTTL,
+	}
+	_, jobID, err := a.segmentService.CreateSegment(segment)
+	switch {
+	case errors.Is(err, services.ErrInvalidSlug), errors.Is(err, services.ErrInvalidAutoPct), errors.Is(err, services.ErrInvalidDescription),
+		errors.Is(err, services.ErrInvalidOwner), errors.Is(err, services.ErrInvalidTags):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, services.ErrSegmentSlugTaken):
+		http.Error(w, fmt.Sprintf(`Segment "%s" already exists`, requestData.Slug), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Existing users are added to auto_add segments by a background job
+	if jobID == 0 {
+		jsonResponse(w, map[string]interface{}{"message": "Segment created"})
+		return
+	}
+	a.jobService.Notify()
+	jsonResponse(w, map[string]interface{}{"message": "Segment created", "job_id": jobID})
+}
+
+// GetJobHandler @Summary Get background job
+// @Description Report the status, progress and error of a background job, such as populating an auto_add segment.
+// @Tags jobs
+// @Produce json
+// @Param id path int true "Job ID"
+// @Success 200 {object} jobResponse "Job"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Job not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /jobs/{id} [get]
+func (a *APIHandlers) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := a.jobService.GetJob(jobID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Job %d doesn't exist", jobID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, newJobResponse(job))
+}
+
+// jobResponse describes a background job. Progress is the share of users processed, from 0 to 100.
+type jobResponse struct {
+	ID         int        `json:"id"`
+	Kind       string     `json:"kind"`
+	SegmentID  int        `json:"segment_id"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Added      int        `json:"added"`
+	Removed    int        `json:"removed"`
+	Progress   float64    `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func newJobResponse(job models.Job) jobResponse {
+	response := jobResponse{
+		ID:        job.ID,
+		Kind:      job.Kind,
+		SegmentID: job.SegmentID,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Added:     job.Added,
+		Removed:   job.Removed,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	switch {
+	case job.Status == models.JobStatusCompleted:
+		response.Progress = 100
+	case job.Total > 0:
+		// Users created after the job started can push processed past the initial total
+		response.Progress = math.Min(100, float64(job.Processed)*100/float64(job.Total))
+	}
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
+
+// RebalanceSegmentHandler @Summary Change a segment's rollout percentage
+// @Description Set a new auto_pct for a segment. A background job then adds or removes only the users between
+// @Description the old and new thresholds; its ID is returned as job_id.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Param slug body string true "Slug of the segment"
+// @Param auto_pct body int true "New auto percentage"
+// @Success 200 {object} services.RebalanceResult "New percentage and the re-balancing job"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/rebalance [post]
+func (a *APIHandlers) RebalanceSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Slug    string `json:"slug"`
+		AutoPct *int   `json:"auto_pct"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&requestData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestData.Slug == "" || requestData.AutoPct == nil {
+		http.Error(w, "Both 'slug' and 'auto_pct' are required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.segmentService.UpdateAutoPct(requestData.Slug, *requestData.AutoPct)
+	switch {
+	case errors.Is(err, services.ErrInvalidAutoPct):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, requestData.Slug), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.JobID != 0 {
+		a.jobService.Notify()
+	}
+	jsonResponse(w, result)
+}
+
+// ExplainBucketHandler @Summary Explain a user's rollout bucket
+// @Description Show which of the 10000 buckets a user is hashed into for a segment and whether it is inside the rollout.
+// @Tags segments
+// @Produce json
+// @Param slug query string true "Slug of the segment"
+// @Param user_id query int true "User ID"
+// @Success 200 {object} services.BucketExplanation "Bucket explanation"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/bucket [get]
+func (a *APIHandlers) ExplainBucketHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid 'user_id' parameter", http.StatusBadRequest)
+		return
+	}
+
+	explanation, err := a.segmentService.ExplainBucket(slug, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, explanation)
+}
+
+// DeleteSegmentHandler @Summary Delete a segment
+// @Description Delete a segment by slug or alias and return a success message with the segment's current slug.
+// @Description The segment is archived and can be brought back with /segments/restore until it is purged.
+// @Tags segments
+// @Produce json
+// @Param slug query string true "Slug or alias of the segment"
+// @Success 200 {object} map[string]string "Response message and the slug of the segment"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/delete [delete]
+func (a *APIHandlers) DeleteSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+		return
+	}
+
+	canonicalSlug, err := a.segmentService.DeleteSegment(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]string{"message": "Segment deleted", "slug": canonicalSlug})
+}
+
+// RestoreSegmentHandler @Summary Restore a deleted segment
+// @Description Bring back a segment deleted with /segments/delete together with its memberships.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Param slug body string true "Slug of the segment"
+// @Success 200 {object} services.RestoreResult "Restored segment"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "No deleted segment with the slug"
+// @Failure 409 {string} string "Another segment uses the slug"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/restore [post]
+func (a *APIHandlers) RestoreSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Slug string `json:"slug"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&requestData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestData.Slug == "" {
+		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.segmentService.RestoreSegment(requestData.Slug)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`No deleted segment "%s"`, requestData.Slug), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrSegmentSlugTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.JobID != 0 {
+		a.jobService.Notify()
+	}
+	jsonResponse(w, result)
+}
+
+// PurgeSegmentHandler @Summary Permanently delete a segment
+// @Description Admin operation that permanently deletes a segment previously deleted with /segments/delete,
+// @Description including its memberships. It can't be restored afterwards. The history is kept.
+// @Tags admin
+// @Produce json
+// @Param slug query string true "Slug of the segment"
+// @Success 200 {object} map[string]interface{} "Response message"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "No deleted segment with the slug"
+// @Failure 409 {string} string "The segment hasn't been deleted"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/segments/purge [delete]
+func (a *APIHandlers) PurgeSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+		return
+	}
+
+	purged, err := a.segmentService.PurgeSegment(slug)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`No deleted segment "%s"`, slug), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrSegmentNotArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{"message": "Segment purged", "purged": purged})
+}
+
+// ListSegmentsHandler @Summary List segments
+// @Description List segments one page at a time. Follow next_cursor to get the next page; it is omitted on the last one.
+// @Tags segments
+// @Produce json
+// @Param prefix query string false "Only segments whose slug starts with the prefix"
+// @Param state query string false "active (default), archived or all"
+// @Param owner query string false "Only segments with this owner"
+// @Param tag query []string false "Only segments with every listed tag; repeat the parameter or separate tags with commas"
+// @Param sort query string false "slug (default), -slug, created_at or -created_at; a leading '-' sorts descending"
+// @Param limit query int false "Page size, 1-500, defaults to 50"
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} map[string]interface{} "Segments and the cursor of the next page"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments [get]
+func (a *APIHandlers) ListSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := repository.SegmentFilter{
+		SlugPrefix: query.Get("prefix"),
+		State:      models.SegmentStateActive,
+		Owner:      query.Get("owner"),
+		Tags:       listQueryParam(query["tag"]),
+		SortBy:     repository.SegmentSortSlug,
+		Limit:      defaultSegmentPageSize,
+	}
+
+	switch state := query.Get("state"); state {
+	case "":
+	case models.SegmentStateActive, models.SegmentStateArchived:
+		filter.State = state
+	case "all":
+		filter.State = ""
+	default:
+		http.Error(w, "Invalid 'state' parameter: use active, archived or all", http.StatusBadRequest)
+		return
+	}
+
+	if sortBy := query.Get("sort"); sortBy != "" {
+		filter.Descending = strings.HasPrefix(sortBy, "-")
+		filter.SortBy = strings.TrimPrefix(sortBy, "-")
+		if filter.SortBy != repository.SegmentSortSlug && filter.SortBy != repository.SegmentSortCreatedAt {
+			http.Error(w, "Invalid 'sort' parameter: use slug, -slug, created_at or -created_at", http.StatusBadRequest)
 			return
 		}
-		responseMessage = append(responseMessage, fmt.Sprintf(`"%s" added successfully`, segmentSlugToAdd))
 	}
 
-	for _, segmentSlugToRemove := range requestData.SegmentsToRemove {
-		segmentID, err := a.segmentService.GetSegmentIDBySlug(segmentSlugToRemove)
-		if err != nil {
-			responseMessage = append(responseMessage, fmt.Sprintf(`"%s" doesn't exist`, segmentSlugToRemove))
-			continue
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxSegmentPageSize {
+			http.Error(w, fmt.Sprintf("Invalid 'limit' parameter: use 1-%d", maxSegmentPageSize), http.StatusBadRequest)
+			return
 		}
-		// Check if the user is linked to the segment before removal
-		isLinked, err := a.userService.IsUserLinkedToSegment(requestData.UserID, segmentID)
+		filter.Limit = limit
+	}
+
+	page, err := a.segmentService.ListSegments(filter, query.Get("cursor"))
+	if errors.Is(err, services.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	segments := make([]segmentResponse, 0, len(page.Segments))
+	for _, segment := range page.Segments {
+		segments = append(segments, newSegmentResponse(segment))
+	}
+	response := map[string]interface{}{"segments": segments}
+	if page.NextCursor != "" {
+		response["next_cursor"] = page.NextCursor
+	}
+	jsonResponse(w, response)
+}
+
+// Page sizes of ListSegmentsHandler.
+const (
+	defaultSegmentPageSize = 50
+	maxSegmentPageSize     = 500
+)
+
+// GetSegmentResourceHandler routes GET requests under /segments/{slug} to the handler of the sub-resource.
+func (a *APIHandlers) GetSegmentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	_, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	switch rest {
+	case "":
+		a.GetSegmentHandler(w, r)
+	case "audit":
+		a.GetSegmentChangesHandler(w, r)
+	case "members":
+		a.GetSegmentMembersHandler(w, r)
+	case "aliases":
+		a.GetSegmentAliasesHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// GetSegmentHandler @Summary Get a segment
+// @Description Get a segment with all of its properties and the number of its current and scheduled members.
+// @Description A deleted segment is returned with state "archived" until it is purged.
+// @Tags segments
+// @Produce json
+// @Param slug path string true "Slug of the segment"
+// @Success 200 {object} segmentDetailResponse "Segment"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/{slug} [get]
+func (a *APIHandlers) GetSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	segment, counts, err := a.segmentService.GetSegment(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, segmentDetailResponse{
+		segmentResponse: newSegmentResponse(segment),
+		Members: memberCountsResponse{
+			Active:    counts.Active,
+			Manual:    counts.Manual,
+			Auto:      counts.Auto,
+			Scheduled: counts.Scheduled,
+		},
+	})
+}
+
+// segmentDetailResponse is a segment together with its member counts.
+type segmentDetailResponse struct {
+	segmentResponse
+	Members memberCountsResponse `json:"members"`
+}
+
+// memberCountsResponse counts the memberships of a segment. Active is split by source into manual and auto.
+type memberCountsResponse struct {
+	Active    int `json:"active"`
+	Manual    int `json:"manual"`
+	Auto      int `json:"auto"`
+	Scheduled int `json:"scheduled"`
+}
+
+// GetSegmentMembersHandler @Summary List the members of a segment
+// @Description List the users in a segment ordered by user ID, one page at a time. Follow next_cursor to get the
+// @Description next page; it is omitted on the last one. With count=true only the number of matching members is returned.
+// @Tags segments
+// @Produce json
+// @Param slug path string true "Slug of the segment"
+// @Param status query string false "active (default), scheduled, expired or all"
+// @Param source query string false "manual or auto"
+// @Param limit query int false "Page size, 1-1000, defaults to 100"
+// @Param cursor query string false "next_cursor of the previous page"
+// @Param count query bool false "Only count the matching members"
+// @Success 200 {object} map[string]interface{} "Members and the cursor of the next page, or their count"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/{slug}/members [get]
+func (a *APIHandlers) GetSegmentMembersHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "members" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := repository.MemberFilter{
+		Status: models.MembershipStatusActive,
+		Limit:  defaultMemberPageSize,
+	}
+
+	switch status := query.Get("status"); status {
+	case "":
+	case models.MembershipStatusActive, models.MembershipStatusScheduled, models.MembershipStatusExpired:
+		filter.Status = status
+	case "all":
+		filter.Status = ""
+	default:
+		http.Error(w, "Invalid 'status' parameter: use active, scheduled, expired or all", http.StatusBadRequest)
+		return
+	}
+
+	switch source := query.Get("source"); source {
+	case "", models.SourceManual, models.SourceAuto:
+		filter.Source = source
+	default:
+		http.Error(w, "Invalid 'source' parameter: use manual or auto", http.StatusBadRequest)
+		return
+	}
+
+	countOnly := false
+	if countStr := query.Get("count"); countStr != "" {
+		var err error
+		countOnly, err = strconv.ParseBool(countStr)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid 'count' parameter", http.StatusBadRequest)
 			return
 		}
-		if !isLinked {
-			responseMessage = append(responseMessage, fmt.Sprintf(`"%s" is not linked to the user`, segmentSlugToRemove))
-			continue
+	}
+
+	if countOnly {
+		canonicalSlug, count, err := a.segmentService.CountSegmentMembers(slug, filter)
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+			return
 		}
-		// Remove the user from the segment and log the operation
-		err = a.userService.AddUserToSegments(requestData.UserID, nil, []int{segmentID}, expiresAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = a.userService.LogSegmentHistory(requestData.UserID, segmentID, "remove", time.Now())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		jsonResponse(w, map[string]interface{}{"slug": canonicalSlug, "count": count})
+		return
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxMemberPageSize {
+			http.Error(w, fmt.Sprintf("Invalid 'limit' parameter: use 1-%d", maxMemberPageSize), http.StatusBadRequest)
 			return
 		}
-		responseMessage = append(responseMessage, fmt.Sprintf(`"%s" removed successfully`, segmentSlugToRemove))
+		filter.Limit = limit
 	}
 
-	jsonResponse(w, map[string]interface{}{"message": responseMessage})
+	page, err := a.segmentService.ListSegmentMembers(slug, filter, query.Get("cursor"))
+	switch {
+	case errors.Is(err, services.ErrInvalidCursor):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	members := make([]memberResponse, 0, len(page.Members))
+	for _, membership := range page.Members {
+		members = append(members, newMemberResponse(membership, page.At))
+	}
+	response := map[string]interface{}{"slug": page.Slug, "members": members}
+	if page.NextCursor != "" {
+		response["next_cursor"] = page.NextCursor
+	}
+	jsonResponse(w, response)
 }
 
-// CreateSegmentHandler @Summary Create a new segment
-// @Description Create a new segment with auto-add option and return success message.
+// Page sizes of GetSegmentMembersHandler.
+const (
+	defaultMemberPageSize = 100
+	maxMemberPageSize     = 1000
+)
+
+// memberResponse describes one member of a segment. StartsAt is omitted for memberships that were
+// active immediately and ExpiresAt for permanent ones.
+type memberResponse struct {
+	UserID    int        `json:"user_id"`
+	Source    string     `json:"source"`
+	Status    string     `json:"status"`
+	AddedAt   time.Time  `json:"added_at"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newMemberResponse(membership models.Membership, now time.Time) memberResponse {
+	response := memberResponse{
+		UserID:  membership.UserID,
+		Source:  membership.Source,
+		Status:  membership.Status(now),
+		AddedAt: membership.AddedAt,
+	}
+	if !membership.StartsAt.IsZero() {
+		startsAt := membership.StartsAt
+		response.StartsAt = &startsAt
+	}
+	if !membership.ExpiresAt.IsZero() {
+		expiresAt := membership.ExpiresAt
+		response.ExpiresAt = &expiresAt
+	}
+	return response
+}
+
+// RenameSegmentHandler @Summary Rename a segment
+// @Description Change the slug of a segment and keep the old slug as an alias that every endpoint still accepts.
 // @Tags segments
 // @Accept json
 // @Produce json
-// @Param slug body string true "Slug of the segment"
-// @Param auto_add body bool true "Auto Add flag"
-// @Param auto_pct body int true "Auto Percentage"
-// @Success 200 {object} map[string]string "Response message"
+// @Param slug path string true "Current slug or alias of the segment"
+// @Param slug body string true "New slug, upper snake case such as AVITO_VOICE_MESSAGES, at most 64 characters"
+// @Success 200 {object} segmentResponse "Renamed segment"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 409 {string} string "The segment is deleted or another segment uses the slug"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /segments/create [post]
-func (a *APIHandlers) CreateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+// @Router /segments/{slug}/rename [post]
+func (a *APIHandlers) RenameSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "rename" {
+		http.NotFound(w, r)
+		return
+	}
+
 	var requestData struct {
-		Slug    string `json:"slug"`
-		AutoAdd bool   `json:"auto_add"`
-		AutoPct int    `json:"auto_pct"`
+		Slug string `json:"slug"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&requestData)
@@ -155,62 +814,302 @@ func (a *APIHandlers) CreateSegmentHandler(w http.ResponseWriter, r *http.Reques
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if requestData.Slug == "" {
+		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+		return
+	}
+
+	segment, err := a.segmentService.RenameSegment(slug, requestData.Slug)
+	switch {
+	case errors.Is(err, services.ErrInvalidSlug):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrSegmentArchived), errors.Is(err, services.ErrSegmentSlugTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, newSegmentResponse(segment))
+}
+
+// GetSegmentAliasesHandler @Summary List a segment's aliases
+// @Description List the former slugs of a segment that still resolve to it, oldest first.
+// @Tags segments
+// @Produce json
+// @Param slug path string true "Slug or alias of the segment"
+// @Success 200 {object} map[string]interface{} "Slug and aliases"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/{slug}/aliases [get]
+func (a *APIHandlers) GetSegmentAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "aliases" {
+		http.NotFound(w, r)
+		return
+	}
+
+	segment, aliases, err := a.segmentService.ListSegmentAliases(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]aliasResponse, 0, len(aliases))
+	for _, alias := range aliases {
+		response = append(response, aliasResponse{Alias: alias.Alias, CreatedAt: alias.CreatedAt})
+	}
+	jsonResponse(w, map[string]interface{}{"slug": segment.Slug, "aliases": response})
+}
+
+// aliasResponse describes a former slug of a segment.
+type aliasResponse struct {
+	Alias     string    `json:"alias"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeleteSegmentAliasHandler @Summary Remove a segment's alias
+// @Description Stop resolving a former slug to the segment, so that another segment can use it.
+// @Tags segments
+// @Produce json
+// @Param slug path string true "Slug of the segment"
+// @Param alias path string true "Alias to remove"
+// @Success 200 {object} map[string]string "Response message"
+// @Failure 404 {string} string "Segment or alias not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/{slug}/aliases/{alias} [delete]
+func (a *APIHandlers) DeleteSegmentAliasHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	alias, ok := strings.CutPrefix(rest, "aliases/")
+	if slug == "" || !ok || alias == "" || strings.Contains(alias, "/") {
+		http.NotFound(w, r)
+		return
+	}
 
-	segmentID, err := a.segmentService.CreateSegmentAndGetID(requestData.Slug, requestData.AutoAdd, requestData.AutoPct)
+	err := a.segmentService.DeleteSegmentAlias(slug, alias)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" has no alias "%s"`, slug, alias), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if requestData.AutoAdd {
-		// Get all user IDs and shuffle them
-		userIDs, err := a.userService.GetAllUserIDs()
+	jsonResponse(w, map[string]string{"message": "Alias removed"})
+}
+
+// UpdateSegmentHandler @Summary Update a segment
+// @Description Change any of description, owner, tags, auto_add, auto_pct, default_ttl and state of a segment. Omitted fields
+// @Description are left as they are and unknown fields are rejected. Changing auto_pct re-balances the segment and
+// @Description enabling auto_add enrolls the users in the rollout with a background job. Setting state to "archived"
+// @Description deletes the segment and setting it to "active" restores it. Every change is recorded in the audit
+// @Description trail returned by /segments/{slug}/audit.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Param slug path string true "Slug of the segment"
+// @Param description body string false "Free-form description, at most 1000 characters"
+// @Param owner body string false "Team or person responsible for the segment"
+// @Param tags body []string false "Up to 10 lowercase tags, replacing the current ones"
+// @Param auto_add body bool false "Auto Add flag"
+// @Param auto_pct body int false "Auto Percentage, 0-100"
+// @Param default_ttl body string false "Lifetime of memberships added without an explicit expiry, e.g. 720h, or 0 to remove it"
+// @Param state body string false "active or archived"
+// @Success 200 {object} segmentUpdateResponse "Updated segment and its changes"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 409 {string} string "The segment is deleted or another segment uses the slug"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /segments/{slug} [patch]
+func (a *APIHandlers) UpdateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var requestData struct {
+		Description *string   `json:"description"`
+		Owner       *string   `json:"owner"`
+		Tags        *[]string `json:"tags"`
+		AutoAdd     *bool     `json:"auto_add"`
+		AutoPct     *int      `json:"auto_pct"`
+		DefaultTTL  *string   `json:"default_ttl"`
+		State       *string   `json:"state"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	update := services.SegmentUpdate{
+		Description: requestData.Description,
+		Owner:       requestData.Owner,
+		Tags:        requestData.Tags,
+		AutoAdd:     requestData.AutoAdd,
+		AutoPct:     requestData.AutoPct,
+		State:       requestData.State,
+	}
+	if requestData.DefaultTTL != nil {
+		defaultTTL, err := time.ParseDuration(*requestData.DefaultTTL)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid duration format for default_ttl", http.StatusBadRequest)
 			return
 		}
-		rand.Shuffle(len(userIDs), func(i, j int) { userIDs[i], userIDs[j] = userIDs[j], userIDs[i] })
+		update.DefaultTTL = &defaultTTL
+	}
+	if update == (services.SegmentUpdate{}) {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
 
-		// Calculate the number of users to add based on percentage
-		numUsersToAdd := (len(userIDs) * requestData.AutoPct) / 100
+	result, err := a.segmentService.UpdateSegment(slug, update)
+	switch {
+	case errors.Is(err, services.ErrInvalidDescription), errors.Is(err, services.ErrInvalidOwner), errors.Is(err, services.ErrInvalidTags),
+		errors.Is(err, services.ErrInvalidAutoPct), errors.Is(err, services.ErrInvalidDefaultTTL), errors.Is(err, services.ErrInvalidSegmentState):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrSegmentArchived), errors.Is(err, services.ErrSegmentSlugTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Add the calculated number of users to the segment
-		expiresAt := time.Now().Add(time.Duration(requestData.AutoPct) * 24 * time.Hour) // Calculate the expiration time
-		for i := 0; i < numUsersToAdd; i++ {
-			err := a.userService.AddUserToSegment(userIDs[i], segmentID, expiresAt)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
+	if result.JobID != 0 || (result.Rebalance != nil && result.Rebalance.JobID != 0) {
+		a.jobService.Notify()
 	}
 
-	jsonResponse(w, map[string]string{"message": "Segment created"})
+	response := segmentUpdateResponse{
+		Segment:   newSegmentResponse(result.Segment),
+		Changes:   newSegmentChangeResponses(result.Changes),
+		Rebalance: result.Rebalance,
+		JobID:     result.JobID,
+	}
+	if result.Restore != nil {
+		response.Restored = result.Restore.Memberships
+	}
+	jsonResponse(w, response)
 }
 
-// DeleteSegmentHandler @Summary Delete a segment
-// @Description Delete a segment by slug and return success message.
+// segmentUpdateResponse describes the result of a PATCH. Rebalance is set when auto_pct changed and holds
+// the re-balancing job, Restored counts the memberships brought back when the segment was restored and
+// JobID is the job re-balancing the segment after auto_add was enabled or the segment restored.
+type segmentUpdateResponse struct {
+	Segment   segmentResponse           `json:"segment"`
+	Changes   []segmentChangeResponse   `json:"changes"`
+	Rebalance *services.RebalanceResult `json:"rebalance,omitempty"`
+	Restored  int                       `json:"restored,omitempty"`
+	JobID     int                       `json:"job_id,omitempty"`
+}
+
+// GetSegmentChangesHandler @Summary Get a segment's audit trail
+// @Description List every change made to the properties of a segment, oldest first.
 // @Tags segments
 // @Produce json
-// @Param slug query string true "Slug of the segment"
-// @Success 200 {object} map[string]string "Response message"
-// @Failure 400 {string} string "Bad Request"
+// @Param slug path string true "Slug of the segment"
+// @Success 200 {object} map[string]interface{} "Slug and changes"
+// @Failure 404 {string} string "Segment not found"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /segments/delete [delete]
-func (a *APIHandlers) DeleteSegmentHandler(w http.ResponseWriter, r *http.Request) {
-	slug := r.URL.Query().Get("slug")
-	if slug == "" {
-		http.Error(w, "Missing 'slug' parameter", http.StatusBadRequest)
+// @Router /segments/{slug}/audit [get]
+func (a *APIHandlers) GetSegmentChangesHandler(w http.ResponseWriter, r *http.Request) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/segments/"), "/")
+	if slug == "" || rest != "audit" {
+		http.NotFound(w, r)
 		return
 	}
 
-	err := a.segmentService.DeleteSegment(slug)
+	segment, changes, err := a.segmentService.GetSegmentChanges(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf(`Segment "%s" doesn't exist`, slug), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	jsonResponse(w, map[string]string{"message": "Segment deleted"})
+	jsonResponse(w, map[string]interface{}{"slug": segment.Slug, "changes": newSegmentChangeResponses(changes)})
+}
+
+// segmentResponse describes a segment. DefaultTTL is omitted for segments whose memberships are
+// permanent by default and ArchivedAt for segments that aren't deleted.
+type segmentResponse struct {
+	ID          int        `json:"id"`
+	Slug        string     `json:"slug"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+	Tags        []string   `json:"tags"`
+	AutoAdd     bool       `json:"auto_add"`
+	AutoPct     int        `json:"auto_pct"`
+	Salt        string     `json:"salt"`
+	DefaultTTL  string     `json:"default_ttl,omitempty"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+}
+
+func newSegmentResponse(segment models.Segment) segmentResponse {
+	response := segmentResponse{
+		ID:          segment.ID,
+		Slug:        segment.Slug,
+		Description: segment.Description,
+		Owner:       segment.Owner,
+		Tags:        append([]string{}, segment.Tags...),
+		AutoAdd:     segment.AutoAdd,
+		AutoPct:     segment.AutoPct,
+		Salt:        segment.Salt,
+		State:       segment.State(),
+		CreatedAt:   segment.CreatedAt,
+	}
+	if segment.DefaultTTL != 0 {
+		response.DefaultTTL = segment.DefaultTTL.String()
+	}
+	if !segment.ArchivedAt.IsZero() {
+		archivedAt := segment.ArchivedAt
+		response.ArchivedAt = &archivedAt
+	}
+	return response
+}
+
+// segmentChangeResponse describes one entry of a segment's audit trail.
+type segmentChangeResponse struct {
+	Slug      string    `json:"slug"`
+	Field     string    `json:"field"`
+	OldValue  string    `json:"old_value"`
+	NewValue  string    `json:"new_value"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+func newSegmentChangeResponses(entries []models.SegmentAuditEntry) []segmentChangeResponse {
+	changes := make([]segmentChangeResponse, 0, len(entries))
+	for _, entry := range entries {
+		changes = append(changes, segmentChangeResponse{
+			Slug:      entry.SegmentSlug,
+			Field:     entry.Field,
+			OldValue:  entry.OldValue,
+			NewValue:  entry.NewValue,
+			ChangedAt: entry.ChangedAt,
+		})
+	}
+	return changes
 }
 
 // GetUserSegmentsHandler @Summary Get user's segments
@@ -218,7 +1117,7 @@ func (a *APIHandlers) DeleteSegmentHandler(w http.ResponseWriter, r *http.Reques
 // @Tags segments
 // @Produce json
 // @Param user_id query int true "User ID"
-// @Success 200 {object} map[string][]string "Segments"
+// @Success 200 {object} map[string][]userSegmentResponse "Segments"
 // @Failure 400 {string} string "Bad Request"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /segments/user-segments [get]
@@ -230,13 +1129,87 @@ func (a *APIHandlers) GetUserSegmentsHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	segments, err := a.segmentService.GetUserSegments(userID)
+	memberships, err := a.segmentService.GetUserSegments(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	segments := make([]userSegmentResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		segments = append(segments, newUserSegmentResponse(membership))
+	}
+
+	jsonResponse(w, map[string][]userSegmentResponse{"segments": segments})
+}
+
+// GetUserSegmentsAtHandler @Summary Get user's segments at a point in time
+// @Description Reconstruct the segments a user was in at the given time from the segment history,
+// @Description including the expiry each membership had at that time.
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Param at query string false "Point in time (RFC3339), defaults to now"
+// @Success 200 {object} map[string]interface{} "Point in time and segments"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /users/{id}/segments [get]
+func (a *APIHandlers) GetUserSegmentsAtHandler(w http.ResponseWriter, r *http.Request) {
+	userIDStr, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if rest != "segments" {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var at time.Time // now, as seen by the segment service
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		at, err = time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			http.Error(w, "Invalid datetime format for at", http.StatusBadRequest)
+			return
+		}
+	}
+
+	memberships, at, err := a.segmentService.GetUserSegmentsAt(userID, at)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	jsonResponse(w, map[string][]string{"segments": segments})
+	segments := make([]userSegmentResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		segments = append(segments, newUserSegmentResponse(membership))
+	}
+
+	jsonResponse(w, map[string]interface{}{"at": at, "segments": segments})
+}
+
+// userSegmentResponse describes one of the user's segments. StartsAt is omitted for memberships that
+// were active immediately and ExpiresAt for permanent ones.
+type userSegmentResponse struct {
+	Slug      string     `json:"slug"`
+	AddedAt   time.Time  `json:"added_at"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newUserSegmentResponse(membership models.Membership) userSegmentResponse {
+	response := userSegmentResponse{Slug: membership.SegmentSlug, AddedAt: membership.AddedAt}
+	if !membership.StartsAt.IsZero() {
+		startsAt := membership.StartsAt
+		response.StartsAt = &startsAt
+	}
+	if !membership.ExpiresAt.IsZero() {
+		expiresAt := membership.ExpiresAt
+		response.ExpiresAt = &expiresAt
+	}
+	return response
 }
 
 func jsonResponse(w http.ResponseWriter, data interface{}) {
@@ -245,53 +1218,263 @@ func jsonResponse(w http.ResponseWriter, data interface{}) {
 	enc.Encode(data)
 }
 
+// jsonResponseWithStatus is jsonResponse with a status other than 200 OK.
+func jsonResponseWithStatus(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
 // GenerateSegmentHistoryReportHandler @Summary Generate segment history report
-// @Description Generate a CSV report of segment history for a specified year and month.
+// @Description Generate a CSV report of segment history between from and to, optionally filtered by users,
+// @Description segments and operations. year and month select one calendar month instead of from and to.
+// @Description The report is generated in the background and the response contains a link to download it
+// @Description once it is ready. The report format is taken from the format query parameter; the response
+// @Description itself is always JSON.
 // @Tags segments
-// @Produce plain
-// @Param year query int true "Year"
-// @Param month query int true "Month"
-// @Success 200 {string} plain "CSV report"
+// @Produce json
+// @Param from query string false "Start of the period, inclusive (RFC3339)"
+// @Param to query string false "End of the period, exclusive (RFC3339), defaults to now"
+// @Param year query int false "Year, shorthand for a whole month together with month"
+// @Param month query int false "Month, shorthand for a whole month together with year"
+// @Param user_id query []int false "Only these users, repeated or comma-separated"
+// @Param segment query []string false "Only these segment slugs, repeated or comma-separated"
+// @Param operation query []string false "Only these operations, repeated or comma-separated"
+// @Param format query string false "csv (default), json, ndjson or parquet"
+// @Success 202 {object} reportResponse "Pending report and its link"
 // @Failure 400 {string} string "Bad Request"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /segments/history-report [get]
+// @Router /users/history-report [get]
 func (a *APIHandlers) GenerateSegmentHistoryReportHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse year and month from request parameters
-	year, err := strconv.Atoi(r.FormValue("year"))
+	filter, err := parseHistoryFilter(r)
 	if err != nil {
-		http.Error(w, "Invalid year format", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	month, err := strconv.Atoi(r.FormValue("month"))
+
+	format, err := parseReportFormat(r)
 	if err != nil {
-		http.Error(w, "Invalid month format", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Fetch segment history for the specified period
-	segmentHistory, err := a.userService.GetSegmentHistoryByPeriod(year, month)
+	report, err := a.reportService.GenerateHistoryReport(filter, format)
+	if errors.Is(err, services.ErrInvalidHistoryFilter) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Generate CSV content
-	var csvContent bytes.Buffer
-	csvWriter := csv.NewWriter(&csvContent)
-	for _, entry := range segmentHistory {
-		csvWriter.Write([]string{
-			strconv.Itoa(entry.UserID),
-			entry.SegmentName,
-			entry.Operation,
-			entry.SegmentTime.Format(time.RFC3339),
-		})
+	jsonResponseWithStatus(w, http.StatusAccepted, newReportResponse(r, report))
+}
+
+// reportResponse describes a report, its status and where to download it. Rows is set once it is completed.
+type reportResponse struct {
+	ID         string     `json:"id"`
+	Format     string     `json:"format"`
+	Status     string     `json:"status"`
+	URL        string     `json:"url"`
+	Rows       *int       `json:"rows,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func newReportResponse(r *http.Request, report models.Report) reportResponse {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	response := reportResponse{
+		ID:        report.ID,
+		Format:    report.Format,
+		Status:    report.Status,
+		URL:       fmt.Sprintf("%s://%s/reports/%s", scheme, r.Host, report.ID),
+		Error:     report.Error,
+		CreatedAt: report.CreatedAt,
+	}
+	if report.Status == models.ReportStatusCompleted {
+		rows := report.Rows
+		response.Rows = &rows
+	}
+	if !report.FinishedAt.IsZero() {
+		finishedAt := report.FinishedAt
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
+
+// GetReportHandler @Summary Download report
+// @Description Download a report created by /users/history-report. While the report is being generated the
+// @Description response is 202 Accepted with its status. A report whose generation failed is 410 Gone with
+// @Description its status and error; it has to be requested again. Reports are deleted after the retention period.
+// @Tags reports
+// @Produce plain
+// @Param id path string true "Report ID"
+// @Success 200 {string} plain "Report in the format it was generated in"
+// @Success 202 {object} reportResponse "The report isn't ready yet"
+// @Failure 404 {string} string "Report not found"
+// @Failure 406 {string} string "The Accept header doesn't allow the report's format"
+// @Failure 410 {object} reportResponse "Generating the report failed"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /reports/{id} [get]
+func (a *APIHandlers) GetReportHandler(w http.ResponseWriter, r *http.Request) {
+	reportID := strings.TrimPrefix(r.URL.Path, "/reports/")
+	format, ok := services.ReportFormatByExtension(path.Ext(reportID))
+	if !ok {
+		http.Error(w, fmt.Sprintf("Report %s doesn't exist", reportID), http.StatusNotFound)
+		return
+	}
+
+	content, createdAt, err := a.reportService.OpenReport(reportID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Report %s doesn't exist", reportID), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, services.ErrReportPending) {
+		report, err := a.reportService.GetReport(reportID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		jsonResponseWithStatus(w, http.StatusAccepted, newReportResponse(r, report))
+		return
+	}
+	if errors.Is(err, services.ErrReportFailed) {
+		report, err := a.reportService.GetReport(reportID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonResponseWithStatus(w, http.StatusGone, newReportResponse(r, report))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	if !acceptsContentType(r.Header.Get("Accept"), format.ContentType) {
+		http.Error(w, fmt.Sprintf("Report %s is %s, which the Accept header doesn't allow", reportID, format.ContentType), http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=segment_history"+format.Extension)
+	http.ServeContent(w, r, reportID, createdAt, content)
+}
+
+// parseReportFormat reads the report format from the format query parameter. Reports are CSV by default.
+func parseReportFormat(r *http.Request) (services.ReportFormat, error) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		return services.ReportFormats[0], nil
+	}
+	format, ok := services.ReportFormatByName(name)
+	if !ok {
+		return services.ReportFormat{}, fmt.Errorf("Unknown report format %q, use csv, json, ndjson or parquet", name)
+	}
+	return format, nil
+}
+
+// acceptsContentType reports whether the Accept header allows contentType. The most specific
+// matching media range decides, so "text/csv;q=0, */*" excludes CSV. A missing header accepts anything.
+func acceptsContentType(accept string, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	bestSpecificity, quality := 0, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		specificity := 0
+		switch {
+		case mediaType == contentType:
+			specificity = 3
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")):
+			specificity = 2
+		case mediaType == "*/*":
+			specificity = 1
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+		itemQuality := 1.0
+		if q, ok := params["q"]; ok {
+			if itemQuality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		bestSpecificity, quality = specificity, itemQuality
+	}
+	return quality > 0
+}
+
+// parseHistoryFilter reads the period and filters of a history report from the query string.
+func parseHistoryFilter(r *http.Request) (repository.HistoryFilter, error) {
+	var filter repository.HistoryFilter
+	query := r.URL.Query()
+
+	if query.Get("year") != "" || query.Get("month") != "" {
+		if query.Get("from") != "" || query.Get("to") != "" {
+			return filter, errors.New("year and month can't be combined with from and to")
+		}
+		year, err := strconv.Atoi(query.Get("year"))
+		if err != nil {
+			return filter, errors.New("Invalid year format")
+		}
+		month, err := strconv.Atoi(query.Get("month"))
+		if err != nil || month < 1 || month > 12 {
+			return filter, errors.New("Invalid month format")
+		}
+		filter.From = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		filter.To = filter.From.AddDate(0, 1, 0)
+	} else {
+		if query.Get("from") == "" {
+			return filter, errors.New("Either from or year and month are required")
+		}
+		var err error
+		filter.From, err = time.Parse(time.RFC3339, query.Get("from"))
+		if err != nil {
+			return filter, errors.New("Invalid datetime format for from")
+		}
+		filter.To = time.Now()
+		if query.Get("to") != "" {
+			filter.To, err = time.Parse(time.RFC3339, query.Get("to"))
+			if err != nil {
+				return filter, errors.New("Invalid datetime format for to")
+			}
+		}
 	}
-	csvWriter.Flush()
 
-	// Set response headers
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", "attachment; filename=segment_history.csv")
+	for _, value := range listQueryParam(query["user_id"]) {
+		userID, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid user_id %q", value)
+		}
+		filter.UserIDs = append(filter.UserIDs, userID)
+	}
+	filter.SegmentSlugs = listQueryParam(query["segment"])
+	filter.Operations = listQueryParam(query["operation"])
+	return filter, nil
+}
 
-	// Write CSV content to the response
-	_, _ = w.Write(csvContent.Bytes())
+// listQueryParam flattens a query parameter that may be repeated and hold comma-separated values.
+func listQueryParam(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
 }
@@ -0,0 +1,743 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"avitoGoProject/services"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestHandlers returns handlers backed by an in-memory store whose user and segment
+// services see testNow as the current time.
+func newTestHandlers(t *testing.T) (*APIHandlers, *repository.MemoryStore) {
+	t.Helper()
+	store := repository.NewMemoryStore()
+	clock := func() time.Time { return testNow }
+	userService := services.NewUserService(store)
+	userService.SetClock(clock)
+	segmentService := services.NewSegmentService(store)
+	segmentService.SetClock(clock)
+	reports, err := repository.NewLocalReportStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := NewAPIHandlers(userService, segmentService, services.NewJobService(store, time.Hour, 100),
+		services.NewIdempotencyService(store, time.Hour, time.Minute), services.NewReportService(store, reports, time.Hour))
+	return handlers, store
+}
+
+func newRequest(method, target, body string) *http.Request {
+	return httptest.NewRequest(method, target, strings.NewReader(body))
+}
+
+func serveRequest(handler http.HandlerFunc, request *http.Request) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	handler(response, request)
+	return response
+}
+
+// call runs handler on a request and returns the recorded response.
+func call(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	return serveRequest(handler, newRequest(method, target, body))
+}
+
+func TestGetUserSegmentsHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	if _, err := store.CreateUser(); err != nil {
+		t.Fatal(err)
+	}
+	for _, slug := range []string{"AVITO_VOICE", "AVITO_DISCOUNT", "AVITO_EXPIRED"} {
+		if _, err := store.CreateSegment(models.Segment{Slug: slug}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiresAt := testNow.Add(time.Hour)
+	for segmentID, expiry := range map[int]time.Time{1: expiresAt, 2: {}, 3: testNow.Add(-time.Second)} {
+		if err := store.AddMembership(1, segmentID, time.Time{}, expiry, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	response := call(handlers.GetUserSegmentsHandler, http.MethodGet, "/segments/user-segments?user_id=1", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", response.Code, response.Body)
+	}
+	var body struct {
+		Segments []map[string]interface{} `json:"segments"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Segments) != 2 {
+		t.Fatalf("segments = %v, want the two that haven't expired", body.Segments)
+	}
+	for _, segment := range body.Segments {
+		if _, ok := segment["added_at"]; !ok {
+			t.Errorf("segment %v has no added_at", segment)
+		}
+		switch segment["slug"] {
+		case "AVITO_VOICE":
+			if segment["expires_at"] != expiresAt.Format(time.RFC3339) {
+				t.Errorf("AVITO_VOICE expires_at = %v, want %v", segment["expires_at"], expiresAt)
+			}
+		case "AVITO_DISCOUNT":
+			if _, ok := segment["expires_at"]; ok {
+				t.Errorf("permanent membership has expires_at %v", segment["expires_at"])
+			}
+		default:
+			t.Errorf("unexpected segment %v", segment)
+		}
+	}
+
+	if response := call(handlers.GetUserSegmentsHandler, http.MethodGet, "/segments/user-segments?user_id=one", ""); response.Code != http.StatusBadRequest {
+		t.Errorf("invalid user_id status = %d, want %d", response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExplainBucketHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE", Salt: "AVITO_VOICE", AutoAdd: true, AutoPct: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	response := call(handlers.ExplainBucketHandler, http.MethodGet, "/segments/bucket?slug=AVITO_VOICE&user_id=7", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", response.Code, response.Body)
+	}
+	var explanation services.BucketExplanation
+	if err := json.NewDecoder(response.Body).Decode(&explanation); err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Bucket != services.Bucket("AVITO_VOICE", 7) || explanation.InRollout != services.InRollout("AVITO_VOICE", 7, 30) {
+		t.Errorf("explanation = %+v", explanation)
+	}
+
+	for target, want := range map[string]int{
+		"/segments/bucket?user_id=7":                    http.StatusBadRequest,
+		"/segments/bucket?slug=AVITO_VOICE":             http.StatusBadRequest,
+		"/segments/bucket?slug=AVITO_MISSING&user_id=7": http.StatusNotFound,
+	} {
+		if response := call(handlers.ExplainBucketHandler, http.MethodGet, target, ""); response.Code != want {
+			t.Errorf("GET %s status = %d, want %d", target, response.Code, want)
+		}
+	}
+}
+
+func TestGetJobHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	for i := 0; i < 4; i++ {
+		if _, err := store.CreateUser(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+		t.Fatal(err)
+	}
+	jobID, err := store.CreateJob(models.Job{Kind: models.JobKindAutoAdd, SegmentID: 1, Status: models.JobStatusRunning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := store.GetJob(jobID)
+	job.Total, job.Processed, job.Added = 4, 1, 1
+	if err := store.UpdateJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	response := call(handlers.GetJobHandler, http.MethodGet, "/jobs/1", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", response.Code, response.Body)
+	}
+	var got jobResponse
+	if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != jobID || got.Status != models.JobStatusRunning || got.Progress != 25 || got.FinishedAt != nil {
+		t.Errorf("job = %+v, want running at 25%%", got)
+	}
+
+	if response := call(handlers.GetJobHandler, http.MethodGet, "/jobs/2", ""); response.Code != http.StatusNotFound {
+		t.Errorf("unknown job status = %d, want %d", response.Code, http.StatusNotFound)
+	}
+	if response := call(handlers.GetJobHandler, http.MethodGet, "/jobs/first", ""); response.Code != http.StatusBadRequest {
+		t.Errorf("invalid job ID status = %d, want %d", response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUpdateUserSegmentsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "added", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"]}`, wantStatus: http.StatusOK},
+		{name: "unknown segment", body: `{"user_id":1,"segments_to_add":["AVITO_MISSING"]}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown user", body: `{"user_id":2,"segments_to_add":["AVITO_VOICE"]}`, wantStatus: http.StatusNotFound},
+		{name: "added and removed", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"segments_to_remove":["AVITO_VOICE"]}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid json", body: `{"user_id":`, wantStatus: http.StatusBadRequest},
+		{name: "ttl", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"ttl":"72h"}`, wantStatus: http.StatusOK},
+		{name: "invalid ttl", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"ttl":"3 days"}`, wantStatus: http.StatusBadRequest},
+		{name: "permanent", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"permanent":true}`, wantStatus: http.StatusOK},
+		{name: "expires_at", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"expires_at":"2023-09-02T12:00:00Z"}`, wantStatus: http.StatusOK},
+		{name: "expires_at in the past", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"expires_at":"2023-08-01T12:00:00Z"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid expires_at", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"expires_at":"tomorrow"}`, wantStatus: http.StatusBadRequest},
+		{name: "expires_at and ttl", body: `{"user_id":1,"segments_to_add":["AVITO_VOICE"],"expires_at":"2023-09-02T12:00:00Z","ttl":"1h"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers, store := newTestHandlers(t)
+			if _, err := store.CreateUser(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+				t.Fatal(err)
+			}
+
+			response := call(handlers.UpdateUserSegmentsHandler, http.MethodPost, "/users/update-segments", tt.body)
+			if response.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %q", response.Code, tt.wantStatus, response.Body)
+			}
+			linked, _ := store.IsUserLinkedToSegment(1, 1)
+			if linked != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("user linked = %v after status %d", linked, response.Code)
+			}
+		})
+	}
+}
+
+func TestParseHistoryFilter(t *testing.T) {
+	september := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query   string
+		want    repository.HistoryFilter
+		wantErr bool
+	}{
+		{query: "year=2023&month=9", want: repository.HistoryFilter{From: september, To: september.AddDate(0, 1, 0)}},
+		{query: "year=2023&month=12", want: repository.HistoryFilter{From: time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{query: "from=2023-09-01T00:00:00Z&to=2023-09-02T00:00:00Z", want: repository.HistoryFilter{From: september, To: september.AddDate(0, 0, 1)}},
+		{
+			query: "from=2023-09-01T00:00:00Z&to=2023-09-02T00:00:00Z&user_id=1,2&user_id=3&segment=AVITO_VOICE&operation=add,+remove",
+			want: repository.HistoryFilter{
+				From:         september,
+				To:           september.AddDate(0, 0, 1),
+				UserIDs:      []int{1, 2, 3},
+				SegmentSlugs: []string{"AVITO_VOICE"},
+				Operations:   []string{"add", "remove"},
+			},
+		},
+		{query: "", wantErr: true},
+		{query: "year=2023", wantErr: true},
+		{query: "year=2023&month=13", wantErr: true},
+		{query: "year=2023&month=9&from=2023-09-01T00:00:00Z", wantErr: true},
+		{query: "from=yesterday", wantErr: true},
+		{query: "from=2023-09-01T00:00:00Z&to=tomorrow", wantErr: true},
+		{query: "from=2023-09-01T00:00:00Z&user_id=one", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseHistoryFilter(newRequest(http.MethodGet, "/users/history-report?"+tt.query, ""))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseHistoryFilter(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(filter, tt.want) {
+			t.Errorf("parseHistoryFilter(%q) = %+v, want %+v", tt.query, filter, tt.want)
+		}
+	}
+
+	// Without to the period runs up to now
+	filter, err := parseHistoryFilter(newRequest(http.MethodGet, "/users/history-report?from=2023-09-01T00:00:00Z", ""))
+	if err != nil || !filter.From.Equal(september) || filter.To.Before(september) {
+		t.Errorf("parseHistoryFilter() without to = %+v, %v", filter, err)
+	}
+}
+
+// downloadReport requests a history report and polls its link while reportService generates it in the background.
+// It returns the report ID and the download.
+func downloadReport(t *testing.T, handlers *APIHandlers, query string) (string, *httptest.ResponseRecorder) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handlers.reportService.Run(ctx, time.Hour)
+
+	response := call(handlers.GenerateSegmentHistoryReportHandler, http.MethodGet, "/users/history-report?"+query, "")
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("history report status = %d, body %q", response.Code, response.Body)
+	}
+	var report reportResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.URL != "http://example.com/reports/"+report.ID || report.Status != models.ReportStatusPending {
+		t.Fatalf("report = %+v, want a pending report with its link", report)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		response = call(handlers.GetReportHandler, http.MethodGet, "/reports/"+report.ID, "")
+		if response.Code != http.StatusAccepted {
+			return report.ID, response
+		}
+	}
+	t.Fatalf("report %s is still pending", report.ID)
+	return "", nil
+}
+
+func TestGetReportHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	if _, err := store.CreateUser(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+		t.Fatal(err)
+	}
+	entry := models.SegmentHistoryEntry{UserID: 1, SegmentID: 1, Operation: models.OperationAdd, Reason: models.ReasonManual, SegmentTime: testNow}
+	if err := store.LogSegmentHistory(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	_, response := downloadReport(t, handlers, "year=2023&month=9")
+	if response.Code != http.StatusOK {
+		t.Fatalf("download status = %d, body %q", response.Code, response.Body)
+	}
+	if contentType := response.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", contentType)
+	}
+	if body := response.Body.String(); !strings.Contains(body, "1,AVITO_VOICE,add,2023-09-01T12:00:00Z") {
+		t.Errorf("report = %q, want the add of user 1", body)
+	}
+
+	for _, id := range []string{"missing.csv", "missing.xml", ""} {
+		if response := call(handlers.GetReportHandler, http.MethodGet, "/reports/"+id, ""); response.Code != http.StatusNotFound {
+			t.Errorf("GET /reports/%s status = %d, want %d", id, response.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetReportHandlerStatus(t *testing.T) {
+	tests := []struct {
+		status     string
+		wantStatus int
+	}{
+		{status: models.ReportStatusPending, wantStatus: http.StatusAccepted},
+		{status: models.ReportStatusFailed, wantStatus: http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			handlers, store := newTestHandlers(t)
+			report := models.Report{ID: "report.csv", Format: "csv", Status: tt.status, Filter: []byte(`{}`), CreatedAt: testNow}
+			if tt.status == models.ReportStatusFailed {
+				report.Error, report.FinishedAt = "disk full", testNow
+			}
+			if err := store.CreateReport(report); err != nil {
+				t.Fatal(err)
+			}
+
+			response := call(handlers.GetReportHandler, http.MethodGet, "/reports/report.csv", "")
+			if response.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %q", response.Code, tt.wantStatus, response.Body)
+			}
+			var body reportResponse
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.ID != report.ID || body.Status != tt.status || body.Error != report.Error {
+				t.Errorf("response = %+v, want the %s report", body, tt.status)
+			}
+		})
+	}
+}
+
+func TestParseReportFormat(t *testing.T) {
+	tests := map[string]string{
+		"":               "csv",
+		"format=csv":     "csv",
+		"format=json":    "json",
+		"format=ndjson":  "ndjson",
+		"format=parquet": "parquet",
+		"format=xml":     "",
+	}
+	for query, want := range tests {
+		request := newRequest(http.MethodGet, "/users/history-report?"+query, "")
+		// The Accept header describes the JSON response, not the report
+		request.Header.Set("Accept", "application/x-ndjson")
+		format, err := parseReportFormat(request)
+		if want == "" {
+			if err == nil {
+				t.Errorf("parseReportFormat(%q) = %s, want an error", query, format.Name)
+			}
+			continue
+		}
+		if err != nil || format.Name != want {
+			t.Errorf("parseReportFormat(%q) = %s, %v, want %s", query, format.Name, err, want)
+		}
+	}
+}
+
+func TestAcceptsContentType(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: true},
+		{accept: "text/csv", want: true},
+		{accept: "*/*", want: true},
+		{accept: "text/*", want: true},
+		{accept: "application/json, text/csv;q=0.5", want: true},
+		{accept: "application/json", want: false},
+		{accept: "application/*", want: false},
+		{accept: "text/csv;q=0", want: false},
+		{accept: "text/csv;q=0, */*", want: false},
+		{accept: "text/*;q=0, text/csv", want: true},
+		{accept: "text/csv;q=high", want: false},
+	}
+	for _, tt := range tests {
+		if got := acceptsContentType(tt.accept, "text/csv"); got != tt.want {
+			t.Errorf("acceptsContentType(%q, text/csv) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGetReportHandlerNotAcceptable(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+	reportID, response := downloadReport(t, handlers, "year=2023&month=9&format=ndjson")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("download = %d %q, want an NDJSON report", response.Code, response.Header().Get("Content-Type"))
+	}
+
+	request := newRequest(http.MethodGet, "/reports/"+reportID, "")
+	request.Header.Set("Accept", "text/csv")
+	if response := serveRequest(handlers.GetReportHandler, request); response.Code != http.StatusNotAcceptable {
+		t.Errorf("download with Accept: text/csv status = %d, want %d", response.Code, http.StatusNotAcceptable)
+	}
+}
+
+func TestGetUserSegmentsAtHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	if _, err := store.CreateUser(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+		t.Fatal(err)
+	}
+	add := models.SegmentHistoryEntry{UserID: 1, SegmentID: 1, Operation: models.OperationAdd, Reason: models.ReasonManual, SegmentTime: testNow.Add(-time.Hour)}
+	if err := store.LogSegmentHistory(add); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantAt     time.Time
+		wantSlugs  []string
+	}{
+		{target: "/users/1/segments", wantStatus: http.StatusOK, wantAt: testNow, wantSlugs: []string{"AVITO_VOICE"}},
+		{target: "/users/1/segments?at=2023-09-01T10:00:00Z", wantStatus: http.StatusOK, wantAt: testNow.Add(-2 * time.Hour), wantSlugs: []string{}},
+		{target: "/users/1/segments?at=yesterday", wantStatus: http.StatusBadRequest},
+		{target: "/users/one/segments", wantStatus: http.StatusBadRequest},
+		{target: "/users/1/history", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		response := call(handlers.GetUserSegmentsAtHandler, http.MethodGet, tt.target, "")
+		if response.Code != tt.wantStatus {
+			t.Errorf("GET %s status = %d, want %d", tt.target, response.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var body struct {
+			At       time.Time `json:"at"`
+			Segments []struct {
+				Slug string `json:"slug"`
+			} `json:"segments"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		slugs := []string{}
+		for _, segment := range body.Segments {
+			slugs = append(slugs, segment.Slug)
+		}
+		if !body.At.Equal(tt.wantAt) || !reflect.DeepEqual(slugs, tt.wantSlugs) {
+			t.Errorf("GET %s = %v at %v, want %v at %v", tt.target, slugs, body.At, tt.wantSlugs, tt.wantAt)
+		}
+	}
+}
+
+func TestRestoreAndPurgeSegmentHandlers(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{"restore an active segment", handlers.RestoreSegmentHandler, http.MethodPost, "/segments/restore", `{"slug":"AVITO_VOICE"}`, http.StatusNotFound},
+		{"purge an active segment", handlers.PurgeSegmentHandler, http.MethodDelete, "/admin/segments/purge?slug=AVITO_VOICE", "", http.StatusConflict},
+		{"delete", handlers.DeleteSegmentHandler, http.MethodDelete, "/segments/delete?slug=AVITO_VOICE", "", http.StatusOK},
+		{"restore", handlers.RestoreSegmentHandler, http.MethodPost, "/segments/restore", `{"slug":"AVITO_VOICE"}`, http.StatusOK},
+		{"delete again", handlers.DeleteSegmentHandler, http.MethodDelete, "/segments/delete?slug=AVITO_VOICE", "", http.StatusOK},
+		{"reuse the slug", handlers.CreateSegmentHandler, http.MethodPost, "/segments/create", `{"slug":"AVITO_VOICE"}`, http.StatusOK},
+		{"restore over a taken slug", handlers.RestoreSegmentHandler, http.MethodPost, "/segments/restore", `{"slug":"AVITO_VOICE"}`, http.StatusConflict},
+		{"restore without a slug", handlers.RestoreSegmentHandler, http.MethodPost, "/segments/restore", `{}`, http.StatusBadRequest},
+		{"purge the deleted segment", handlers.PurgeSegmentHandler, http.MethodDelete, "/admin/segments/purge?slug=AVITO_VOICE", "", http.StatusOK},
+		{"purge with only the new segment left", handlers.PurgeSegmentHandler, http.MethodDelete, "/admin/segments/purge?slug=AVITO_VOICE", "", http.StatusConflict},
+		{"purge an unknown segment", handlers.PurgeSegmentHandler, http.MethodDelete, "/admin/segments/purge?slug=AVITO_MISSING", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if response := call(step.handler, step.method, step.target, step.body); response.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d, body %q", step.name, response.Code, step.wantStatus, response.Body)
+		}
+	}
+}
+
+func TestListSegmentsHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	for _, segment := range []models.Segment{
+		{Slug: "AVITO_B", Owner: "ads", Tags: []string{"beta", "mobile"}},
+		{Slug: "AVITO_A", Owner: "ads", Tags: []string{"mobile"}},
+		{Slug: "OTHER_C", Owner: "search"},
+	} {
+		if _, err := store.CreateSegment(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archivedID, err := store.CreateSegment(models.Segment{Slug: "AVITO_D", Owner: "search"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ArchiveSegment(archivedID, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) ([]string, string) {
+		t.Helper()
+		response := call(handlers.ListSegmentsHandler, http.MethodGet, "/segments?"+query, "")
+		if response.Code != http.StatusOK {
+			t.Fatalf("GET /segments?%s status = %d, body %q", query, response.Code, response.Body)
+		}
+		var body struct {
+			Segments []struct {
+				Slug string `json:"slug"`
+			} `json:"segments"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		slugs := []string{}
+		for _, segment := range body.Segments {
+			slugs = append(slugs, segment.Slug)
+		}
+		return slugs, body.NextCursor
+	}
+
+	// Follow next_cursor until the last page, which has none
+	var pages [][]string
+	for cursor := ""; ; {
+		slugs, next := list("limit=2&cursor=" + cursor)
+		pages = append(pages, slugs)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := [][]string{{"AVITO_A", "AVITO_B"}, {"OTHER_C"}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	for query, want := range map[string][]string{
+		"prefix=AVITO_":        {"AVITO_A", "AVITO_B"},
+		"state=archived":       {"AVITO_D"},
+		"state=all&sort=-slug": {"OTHER_C", "AVITO_D", "AVITO_B", "AVITO_A"},
+		"owner=search":         {"OTHER_C"},
+		"tag=mobile,beta":      {"AVITO_B"},
+		"tag=mobile&tag=beta":  {"AVITO_B"},
+		"prefix=NONE":          {},
+	} {
+		if got, _ := list(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET /segments?%s = %v, want %v", query, got, want)
+		}
+	}
+
+	for _, query := range []string{"state=deleted", "sort=owner", "limit=0", "limit=501", "cursor=garbage"} {
+		if response := call(handlers.ListSegmentsHandler, http.MethodGet, "/segments?"+query, ""); response.Code != http.StatusBadRequest {
+			t.Errorf("GET /segments?%s status = %d, want %d", query, response.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetSegmentHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	segmentID, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE", Description: "Voice messages", Tags: []string{"mobile"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateUser(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for userID, source := range map[int]string{1: models.SourceManual, 2: models.SourceAuto, 3: models.SourceManual} {
+		startsAt := time.Time{}
+		if userID == 3 {
+			startsAt = testNow.Add(time.Hour)
+		}
+		if err := store.AddMembership(userID, segmentID, startsAt, time.Time{}, source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	response := call(handlers.GetSegmentResourceHandler, http.MethodGet, "/segments/AVITO_VOICE", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", response.Code, response.Body)
+	}
+	var body segmentDetailResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Slug != "AVITO_VOICE" || body.Description != "Voice messages" || !reflect.DeepEqual(body.Tags, []string{"mobile"}) {
+		t.Errorf("segment = %+v, want AVITO_VOICE with its description and tags", body.segmentResponse)
+	}
+	if want := (memberCountsResponse{Active: 2, Manual: 1, Auto: 1, Scheduled: 1}); body.Members != want {
+		t.Errorf("members = %+v, want %+v", body.Members, want)
+	}
+
+	for _, target := range []string{"/segments/AVITO_MISSING", "/segments/AVITO_VOICE/unknown"} {
+		if response := call(handlers.GetSegmentResourceHandler, http.MethodGet, target, ""); response.Code != http.StatusNotFound {
+			t.Errorf("GET %s status = %d, want %d", target, response.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetSegmentMembersHandler(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	segmentID, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := store.CreateUser(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Users 1 and 2 are active, 3 has expired and 4 starts in an hour
+	for _, m := range []struct {
+		userID              int
+		startsAt, expiresAt time.Time
+		source              string
+	}{
+		{userID: 1, source: models.SourceManual},
+		{userID: 2, source: models.SourceAuto},
+		{userID: 3, expiresAt: testNow.Add(-time.Minute), source: models.SourceManual},
+		{userID: 4, startsAt: testNow.Add(time.Hour), source: models.SourceManual},
+	} {
+		if err := store.AddMembership(m.userID, segmentID, m.startsAt, m.expiresAt, m.source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) (int, map[string]json.RawMessage) {
+		t.Helper()
+		response := call(handlers.GetSegmentResourceHandler, http.MethodGet, "/segments/AVITO_VOICE/members?"+query, "")
+		var body map[string]json.RawMessage
+		if response.Code == http.StatusOK {
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.Code, body
+	}
+
+	status, body := get("limit=1")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	var first []memberResponse
+	if err := json.Unmarshal(body["members"], &first); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0].UserID != 1 || first[0].Status != models.MembershipStatusActive || first[0].ExpiresAt != nil {
+		t.Errorf("first page = %+v, want the permanent membership of user 1", first)
+	}
+	var cursor string
+	if err := json.Unmarshal(body["next_cursor"], &cursor); err != nil || cursor == "" {
+		t.Fatalf("next_cursor = %s, %v, want a cursor", body["next_cursor"], err)
+	}
+	status, body = get("limit=1&cursor=" + cursor)
+	var second []memberResponse
+	if err := json.Unmarshal(body["members"], &second); err != nil || status != http.StatusOK {
+		t.Fatal(status, err)
+	}
+	if len(second) != 1 || second[0].UserID != 2 || second[0].Source != models.SourceAuto {
+		t.Errorf("second page = %+v, want the auto membership of user 2", second)
+	}
+	if _, ok := body["next_cursor"]; ok {
+		t.Errorf("next_cursor on the last page = %s", body["next_cursor"])
+	}
+
+	// Count mode ignores limit and cursor
+	for query, want := range map[string]string{
+		"count=true":                     "2",
+		"count=true&status=all":          "4",
+		"count=true&status=expired":      "1",
+		"count=true&status=scheduled":    "1",
+		"count=1&source=auto&limit=5000": "1",
+	} {
+		status, body := get(query)
+		if status != http.StatusOK || string(body["count"]) != want || string(body["slug"]) != `"AVITO_VOICE"` {
+			t.Errorf("%s = %d %s, want count %s", query, status, body, want)
+		}
+	}
+
+	for _, query := range []string{"status=deleted", "source=import", "count=maybe", "limit=1001", "cursor=%25%25"} {
+		if status, _ := get(query); status != http.StatusBadRequest {
+			t.Errorf("%s status = %d, want %d", query, status, http.StatusBadRequest)
+		}
+	}
+	response := call(handlers.GetSegmentResourceHandler, http.MethodGet, "/segments/AVITO_MISSING/members?count=true", "")
+	if response.Code != http.StatusNotFound {
+		t.Errorf("members of an unknown segment status = %d, want %d", response.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateSegmentHandler(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+
+	// Requests run in order, so the later ones see the segment created by the first
+	steps := []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"slug":"AVITO_VOICE_MESSAGES"}`, http.StatusOK},
+		{`{"slug":"AVITO_VOICE_MESSAGES","auto_add":true,"auto_pct":10}`, http.StatusConflict},
+		{`{"slug":"avito_voice"}`, http.StatusBadRequest},
+		{`{"slug":"AVITO__VOICE"}`, http.StatusBadRequest},
+		{`{"slug":"` + strings.Repeat("A", services.MaxSegmentSlugLength+1) + `"}`, http.StatusBadRequest},
+		{`{"slug":"AVITO_DISCOUNT","auto_pct":101}`, http.StatusBadRequest},
+		{`{"slug":"AVITO_DISCOUNT","auto_pct":-5}`, http.StatusBadRequest},
+		{`{"slug":"AVITO_DISCOUNT","auto_pct":100}`, http.StatusOK},
+	}
+	for _, step := range steps {
+		response := call(handlers.CreateSegmentHandler, http.MethodPost, "/segments/create", step.body)
+		if response.Code != step.wantStatus {
+			t.Errorf("POST %s status = %d, want %d, body %q", step.body, response.Code, step.wantStatus, response.Body)
+		}
+	}
+}
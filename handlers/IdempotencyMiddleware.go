@@ -0,0 +1,133 @@
+package services
+
+import (
+	"avitoGoProject/services"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// maxIdempotentBodySize limits how much of a request body is read to fingerprint it.
+const maxIdempotentBodySize = 1 << 20
+
+// responseRecorder captures a response while passing it through to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// Idempotent makes a mutating handler safe to retry. Requests carrying an
+// Idempotency-Key header are executed once; repeating the key with the same
+// method, URL and body replays the stored response, and reusing it for a
+// different request is rejected. The key stays reserved while the handler runs,
+// however long it takes. Server errors and conflicts that may clear up on their
+// own are not stored, so such a request, or one that panicked, can be retried
+// with the same key.
+func (a *APIHandlers) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		replay, err := a.idempotencyService.Begin(key, requestHash)
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, services.ErrIdempotencyKeyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if replay != nil {
+			if replay.ContentType != "" {
+				w.Header().Set("Content-Type", replay.ContentType)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(replay.Body)))
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(replay.StatusCode)
+			_, _ = w.Write(replay.Body)
+			return
+		}
+
+		stopKeepAlive := a.idempotencyService.KeepAlive(key, requestHash)
+
+		// A panicking handler must not leave the key reserved
+		defer func() {
+			if p := recover(); p != nil {
+				stopKeepAlive()
+				if err := a.idempotencyService.Release(key); err != nil {
+					log.Printf("idempotency key %q: %v", key, err)
+				}
+				panic(p)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+		stopKeepAlive()
+
+		if !storableStatus(recorder.statusCode) {
+			err = a.idempotencyService.Release(key)
+		} else {
+			err = a.idempotencyService.Complete(key, recorder.statusCode, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// storableStatus reports whether a response with the status is stored for replay. Server errors and
+// conflicts that may clear up on their own are not, so that a retry with the same key runs again.
+func storableStatus(statusCode int) bool {
+	switch statusCode {
+	case 0, http.StatusRequestTimeout, http.StatusConflict, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return statusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"avitoGoProject/repository"
+	"avitoGoProject/services"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler responds with the status and counts how often it ran.
+func countingHandler(calls *int32, statusCode int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write([]byte(`{"call":` + strconv.Itoa(int(n)) + `}`))
+	}
+}
+
+func idempotentRequest(handler http.HandlerFunc, key, body string) (int, string, string) {
+	request := newRequest(http.MethodPost, "/segments/create", body)
+	request.Header.Set("Idempotency-Key", key)
+	response := serveRequest(handler, request)
+	return response.Code, response.Body.String(), response.Header().Get("Idempotent-Replayed")
+}
+
+func TestIdempotentReplaysStoredResponses(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+	var calls int32
+	handler := handlers.Idempotent(countingHandler(&calls, http.StatusOK))
+
+	status, body, replayed := idempotentRequest(handler, "key", `{"slug":"AVITO_VOICE"}`)
+	if status != http.StatusOK || body != `{"call":1}` || replayed != "" {
+		t.Fatalf("first request = %d %s, replayed %q", status, body, replayed)
+	}
+	status, body, replayed = idempotentRequest(handler, "key", `{"slug":"AVITO_VOICE"}`)
+	if status != http.StatusOK || body != `{"call":1}` || replayed != "true" {
+		t.Errorf("retry = %d %s, replayed %q, want the first response replayed", status, body, replayed)
+	}
+	if status, _, _ := idempotentRequest(handler, "key", `{"slug":"AVITO_DISCOUNT"}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another body status = %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if status, body, _ := idempotentRequest(handler, "other", `{"slug":"AVITO_VOICE"}`); status != http.StatusOK || body != `{"call":2}` {
+		t.Errorf("request with another key = %d %s, want it processed", status, body)
+	}
+}
+
+func TestIdempotentRunsRetryableResponsesAgain(t *testing.T) {
+	for _, statusCode := range []int{http.StatusConflict, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		t.Run(strconv.Itoa(statusCode), func(t *testing.T) {
+			handlers, _ := newTestHandlers(t)
+			var calls int32
+			handler := handlers.Idempotent(countingHandler(&calls, statusCode))
+
+			idempotentRequest(handler, "key", "{}")
+			status, body, replayed := idempotentRequest(handler, "key", "{}")
+			if status != statusCode || body != `{"call":2}` || replayed != "" {
+				t.Errorf("retry = %d %s, replayed %q, want the handler run again", status, body, replayed)
+			}
+		})
+	}
+
+	// Client errors that won't change on a retry are stored like successes
+	handlers, _ := newTestHandlers(t)
+	var calls int32
+	handler := handlers.Idempotent(countingHandler(&calls, http.StatusBadRequest))
+	idempotentRequest(handler, "key", "{}")
+	if _, body, replayed := idempotentRequest(handler, "key", "{}"); body != `{"call":1}` || replayed != "true" {
+		t.Errorf("retry of a 400 = %s, replayed %q, want it replayed", body, replayed)
+	}
+}
+
+func TestIdempotentReleasesKeyAfterPanic(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+	panicking := handlers.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic wasn't passed on")
+			}
+		}()
+		idempotentRequest(panicking, "key", "{}")
+	}()
+
+	var calls int32
+	if status, _, _ := idempotentRequest(handlers.Idempotent(countingHandler(&calls, http.StatusOK)), "key", "{}"); status != http.StatusOK {
+		t.Errorf("retry after a panic status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestIdempotentKeepsKeyWhileHandlerRuns(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+	const lease = 30 * time.Millisecond
+	handlers.idempotencyService = services.NewIdempotencyService(repository.NewMemoryStore(), time.Hour, lease)
+
+	var calls int32
+	release := make(chan struct{})
+	slow := handlers.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		idempotentRequest(slow, "key", "{}")
+	}()
+
+	// A retry long after the lease would have run out still finds the key reserved
+	time.Sleep(4 * lease)
+	if status, _, _ := idempotentRequest(slow, "key", "{}"); status != http.StatusConflict {
+		t.Errorf("retry while the first request runs status = %d, want %d", status, http.StatusConflict)
+	}
+	close(release)
+	<-done
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want once", calls)
+	}
+}
@@ -1,44 +1,216 @@
 package main
 
 import (
+	"avitoGoProject/database"
 	handlers "avitoGoProject/handlers"
+	"avitoGoProject/repository"
 	"avitoGoProject/services"
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	// Initialize database connection
-	db, err := sql.Open("mysql", "root:12345@tcp(localhost:3306)/avito_project_db")
+	storage := flag.String("storage", "mysql", "Storage backend: mysql or memory")
+	dsn := flag.String("dsn", "root:12345@tcp(localhost:3306)/avito_project_db?parseTime=true", "MySQL data source name")
+	serverAddr := flag.String("addr", "localhost:8080", "HTTP listen address")
+	expiryInterval := flag.Duration("expiry-interval", time.Minute, "How often expired memberships are removed")
+	expiryBatch := flag.Int("expiry-batch", 500, "Maximum number of expired memberships removed per transaction")
+	activationInterval := flag.Duration("activation-interval", time.Minute, "How often scheduled memberships are activated")
+	activationBatch := flag.Int("activation-batch", 500, "Maximum number of scheduled memberships activated per transaction")
+	jobPollInterval := flag.Duration("job-poll-interval", 5*time.Second, "How often unfinished background jobs are checked for")
+	jobBatch := flag.Int("job-batch", 1000, "Number of users processed per background job batch")
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "How long responses are kept for replay under their Idempotency-Key")
+	idempotencyLease := flag.Duration("idempotency-lease", time.Minute, "How long an Idempotency-Key stays reserved by a request that never finished")
+	reportDir := flag.String("report-dir", "reports", "Directory where generated reports are stored")
+	reportRetention := flag.Duration("report-retention", 24*time.Hour, "How long generated reports are kept for download")
+	migrateOnStart := flag.Bool("migrate", false, "Apply pending schema migrations before starting (mysql only)")
+	flag.Parse()
+
+	// Workers loop until a batch comes back short and tickers panic on a zero interval
+	for name, value := range map[string]int{
+		"expiry-batch":     *expiryBatch,
+		"activation-batch": *activationBatch,
+		"job-batch":        *jobBatch,
+	} {
+		if value <= 0 {
+			log.Fatalf("-%s must be positive, got %d", name, value)
+		}
+	}
+	for name, value := range map[string]time.Duration{
+		"expiry-interval":     *expiryInterval,
+		"activation-interval": *activationInterval,
+		"job-poll-interval":   *jobPollInterval,
+		"idempotency-window":  *idempotencyWindow,
+		"idempotency-lease":   *idempotencyLease,
+		"report-retention":    *reportRetention,
+	} {
+		if value <= 0 {
+			log.Fatalf("-%s must be positive, got %v", name, value)
+		}
+	}
+
+	// "migrate up|down|status" manages the schema and exits
+	if flag.Arg(0) == "migrate" {
+		db, err := openMySQL(*dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if err := runMigrateCommand(db, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Initialize storage backend
+	var store repository.Store
+	switch *storage {
+	case "mysql":
+		db, err := openMySQL(*dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if *migrateOnStart {
+			if err := runMigrateCommand(db, "up"); err != nil {
+				log.Fatal(err)
+			}
+		}
+		store = repository.NewMySQLStore(db)
+	case "memory":
+		store = repository.NewMemoryStore()
+	default:
+		log.Fatalf("Unknown storage backend %q", *storage)
+	}
+
+	// Initialize services
+	userService := services.NewUserService(store)
+	segmentService := services.NewSegmentService(store)
+	jobService := services.NewJobService(store, *jobPollInterval, *jobBatch)
+	idempotencyService := services.NewIdempotencyService(store, *idempotencyWindow, *idempotencyLease)
+	reports, err := repository.NewLocalReportStore(*reportDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	reportService := services.NewReportService(store, reports, *reportRetention)
 
-	// Initialize services
-	userService := services.NewUserService(db)
-	segmentService := services.NewSegmentService(db)
+	apiHandlers := handlers.NewAPIHandlers(userService, segmentService, jobService, idempotencyService, reportService)
+
+	router := newRouter(apiHandlers)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start background workers
+	var workers sync.WaitGroup
+	sweeper := services.NewExpirySweeper(store, *expiryInterval, *expiryBatch)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		sweeper.Run(ctx)
+	}()
+	scheduler := services.NewActivationScheduler(store, *activationInterval, *activationBatch)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		scheduler.Run(ctx)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		jobService.Run(ctx)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		idempotencyService.Run(ctx, time.Hour)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		reportService.Run(ctx, time.Hour)
+	}()
+
+	// Start the HTTP server
+	server := &http.Server{Addr: *serverAddr, Handler: router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server shutdown: %v", err)
+		}
+	}()
 
-	apiHandlers := handlers.NewAPIHandlers(userService, segmentService)
+	fmt.Printf("Server is listening on %s...\n", *serverAddr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 
-	// Set up HTTP routes
+	stop()
+	workers.Wait()
+	fmt.Println("Server stopped")
+}
+
+// newRouter registers the HTTP routes of the API.
+func newRouter(apiHandlers *handlers.APIHandlers) *http.ServeMux {
 	router := http.NewServeMux()
-	router.HandleFunc("/users/create", allowOnly(apiHandlers.CreateUserHandler, http.MethodPost))
-	router.HandleFunc("/users/update-segments", allowOnly(apiHandlers.UpdateUserSegmentsHandler, http.MethodPost))
+	router.HandleFunc("/users/create", allowOnly(apiHandlers.Idempotent(apiHandlers.CreateUserHandler), http.MethodPost))
+	router.HandleFunc("/users/update-segments", allowOnly(apiHandlers.Idempotent(apiHandlers.UpdateUserSegmentsHandler), http.MethodPost))
+	router.HandleFunc("/users/", allowOnly(apiHandlers.GetUserSegmentsAtHandler, http.MethodGet))
 	router.HandleFunc("/users/history-report", allowOnly(apiHandlers.GenerateSegmentHistoryReportHandler, http.MethodGet))
-	router.HandleFunc("/segments/create", allowOnly(apiHandlers.CreateSegmentHandler, http.MethodPost))
-	router.HandleFunc("/segments/delete", allowOnly(apiHandlers.DeleteSegmentHandler, http.MethodDelete))
+	router.HandleFunc("/segments/create", allowOnly(apiHandlers.Idempotent(apiHandlers.CreateSegmentHandler), http.MethodPost))
+	router.HandleFunc("/segments/rebalance", allowOnly(apiHandlers.Idempotent(apiHandlers.RebalanceSegmentHandler), http.MethodPost))
+	router.HandleFunc("/segments/bucket", allowOnly(apiHandlers.ExplainBucketHandler, http.MethodGet))
+	router.HandleFunc("/segments/delete", allowOnly(apiHandlers.Idempotent(apiHandlers.DeleteSegmentHandler), http.MethodDelete))
+	router.HandleFunc("/segments/restore", allowOnly(apiHandlers.Idempotent(apiHandlers.RestoreSegmentHandler), http.MethodPost))
+	router.HandleFunc("/admin/segments/purge", allowOnly(apiHandlers.Idempotent(apiHandlers.PurgeSegmentHandler), http.MethodDelete))
+	router.HandleFunc("/segments", allowOnly(apiHandlers.ListSegmentsHandler, http.MethodGet))
+	router.HandleFunc("/segments/", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet:    apiHandlers.GetSegmentResourceHandler,
+		http.MethodPatch:  apiHandlers.Idempotent(apiHandlers.UpdateSegmentHandler),
+		http.MethodPost:   apiHandlers.Idempotent(apiHandlers.RenameSegmentHandler),
+		http.MethodDelete: apiHandlers.Idempotent(apiHandlers.DeleteSegmentAliasHandler),
+	}))
 	router.HandleFunc("/segments/user-segments", allowOnly(apiHandlers.GetUserSegmentsHandler, http.MethodGet))
+	router.HandleFunc("/jobs/", allowOnly(apiHandlers.GetJobHandler, http.MethodGet))
+	router.HandleFunc("/reports/", allowOnly(apiHandlers.GetReportHandler, http.MethodGet))
 	router.Handle("/swagger/", httpSwagger.WrapHandler)
+	return router
+}
 
-	// Start the HTTP server
-	serverAddr := "localhost:8080"
-	fmt.Printf("Server is listening on %s...\n", serverAddr)
-	log.Fatal(http.ListenAndServe(serverAddr, router))
+// openMySQL opens the database at dsn.
+func openMySQL(dsn string) (*sql.DB, error) {
+	dsn, err := withParseTime(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("mysql", dsn)
+}
+
+// withParseTime turns parseTime on in dsn. The stores and the migrator scan DATETIME and
+// TIMESTAMP columns into time.Time, so it is needed even if the DSN doesn't ask for it.
+func withParseTime(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ParseTime = true
+	return cfg.FormatDSN(), nil
 }
 
 func allowOnly(next http.HandlerFunc, method string) http.HandlerFunc {
@@ -50,3 +222,68 @@ func allowOnly(next http.HandlerFunc, method string) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// allowMethods dispatches a route to the handler registered for the request method.
+func allowMethods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		next, ok := handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, "Method not allowed. Only "+strings.Join(methods, ", ")+" methods are allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func runMigrateCommand(db *sql.DB, command string) error {
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		for _, migration := range applied {
+			fmt.Printf("Applied migration %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+	case "down":
+		migration, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Println("No migrations to roll back")
+		} else {
+			fmt.Printf("Rolled back migration %d_%s\n", migration.Version, migration.Name)
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	handlers "avitoGoProject/handlers"
+	"avitoGoProject/repository"
+	"avitoGoProject/services"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRouter(t *testing.T) *http.ServeMux {
+	t.Helper()
+	store := repository.NewMemoryStore()
+	reports, err := repository.NewLocalReportStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandlers := handlers.NewAPIHandlers(
+		services.NewUserService(store),
+		services.NewSegmentService(store),
+		services.NewJobService(store, time.Minute, 100),
+		services.NewIdempotencyService(store, time.Hour, time.Minute),
+		services.NewReportService(store, reports, time.Hour),
+	)
+	return newRouter(apiHandlers)
+}
+
+func serve(router http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestRouter(t *testing.T) {
+	router := newTestRouter(t)
+
+	response := serve(router, http.MethodPost, "/users/create", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /users/create status = %d, body %q", response.Code, response.Body)
+	}
+	var created map[string]int
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil || created["user_id"] != 1 {
+		t.Errorf("POST /users/create = %v, %v, want user 1", created, err)
+	}
+
+	response = serve(router, http.MethodPost, "/segments/create", `{"slug":"AVITO_VOICE_MESSAGES"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /segments/create status = %d, body %q", response.Code, response.Body)
+	}
+	response = serve(router, http.MethodPost, "/users/update-segments", `{"user_id":1,"segments_to_add":["AVITO_VOICE_MESSAGES"]}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /users/update-segments status = %d, body %q", response.Code, response.Body)
+	}
+
+	response = serve(router, http.MethodGet, "/segments/user-segments?user_id=1", "")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "AVITO_VOICE_MESSAGES") {
+		t.Errorf("GET /segments/user-segments = %d %q, want the added segment", response.Code, response.Body)
+	}
+
+	for _, route := range []struct{ method, target string }{
+		{http.MethodGet, "/users/create"},
+		{http.MethodPut, "/users/update-segments"},
+		{http.MethodPost, "/segments/user-segments"},
+	} {
+		if response := serve(router, route.method, route.target, ""); response.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s status = %d, want %d", route.method, route.target, response.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestSegmentResourceMethods(t *testing.T) {
+	router := newTestRouter(t)
+	if response := serve(router, http.MethodPost, "/segments/create", `{"slug":"AVITO_VOICE_MESSAGES"}`); response.Code != http.StatusOK {
+		t.Fatalf("POST /segments/create status = %d, body %q", response.Code, response.Body)
+	}
+
+	response := serve(router, http.MethodPatch, "/segments/AVITO_VOICE_MESSAGES", `{"auto_pct":10}`)
+	if response.Code != http.StatusOK {
+		t.Errorf("PATCH /segments/AVITO_VOICE_MESSAGES status = %d, body %q", response.Code, response.Body)
+	}
+
+	response = serve(router, http.MethodPut, "/segments/AVITO_VOICE_MESSAGES", `{"auto_pct":10}`)
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT /segments/AVITO_VOICE_MESSAGES status = %d, want %d", response.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := response.Header().Get("Allow"); allow != "DELETE, GET, PATCH, POST" {
+		t.Errorf("Allow = %q, want DELETE, GET, PATCH, POST", allow)
+	}
+}
+
+func TestSegmentAliasRoutes(t *testing.T) {
+	router := newTestRouter(t)
+	if response := serve(router, http.MethodPost, "/segments/create", `{"slug":"AVITO_VOICE"}`); response.Code != http.StatusOK {
+		t.Fatalf("POST /segments/create status = %d, body %q", response.Code, response.Body)
+	}
+
+	steps := []struct {
+		method, target, body string
+		wantStatus           int
+		wantBody             string
+	}{
+		{http.MethodPost, "/segments/AVITO_VOICE/rename", `{"slug":"AVITO_VOICE_MESSAGES"}`, http.StatusOK, `"slug":"AVITO_VOICE_MESSAGES"`},
+		{http.MethodGet, "/segments/AVITO_VOICE", "", http.StatusOK, `"slug":"AVITO_VOICE_MESSAGES"`},
+		{http.MethodGet, "/segments/AVITO_VOICE_MESSAGES/aliases", "", http.StatusOK, `"alias":"AVITO_VOICE"`},
+		{http.MethodPost, "/segments/create", `{"slug":"AVITO_VOICE"}`, http.StatusConflict, ""},
+		{http.MethodDelete, "/segments/delete?slug=AVITO_VOICE", "", http.StatusOK, `"slug":"AVITO_VOICE_MESSAGES"`},
+		{http.MethodDelete, "/segments/delete?slug=AVITO_VOICE", "", http.StatusNotFound, ""},
+		{http.MethodDelete, "/segments/delete?slug=AVITO_VOICE_MESSAGES", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/segments/restore", `{"slug":"AVITO_VOICE_MESSAGES"}`, http.StatusOK, ""},
+		{http.MethodDelete, "/segments/AVITO_VOICE_MESSAGES/aliases/AVITO_VOICE", "", http.StatusOK, ""},
+		{http.MethodDelete, "/segments/AVITO_VOICE_MESSAGES/aliases/AVITO_VOICE", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/segments/AVITO_VOICE", "", http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		response := serve(router, step.method, step.target, step.body)
+		if response.Code != step.wantStatus || !strings.Contains(response.Body.String(), step.wantBody) {
+			t.Fatalf("%s %s = %d %q, want %d with %s", step.method, step.target, response.Code, response.Body, step.wantStatus, step.wantBody)
+		}
+	}
+}
+
+func TestWithParseTime(t *testing.T) {
+	for _, dsn := range []string{
+		"root:12345@tcp(localhost:3306)/avito_project_db",
+		"root:12345@tcp(localhost:3306)/avito_project_db?parseTime=false",
+		"root:12345@tcp(localhost:3306)/avito_project_db?parseTime=true&loc=UTC",
+	} {
+		got, err := withParseTime(dsn)
+		if err != nil {
+			t.Fatalf("withParseTime(%q) error = %v", dsn, err)
+		}
+		cfg, err := mysql.ParseDSN(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.ParseTime || cfg.DBName != "avito_project_db" {
+			t.Errorf("withParseTime(%q) = %q, want parseTime on the same database", dsn, got)
+		}
+	}
+
+	if _, err := withParseTime("not a dsn"); err == nil {
+		t.Error("withParseTime() of an invalid DSN succeeded")
+	}
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// IdempotencyRecord is the stored response of a request made with an Idempotency-Key header.
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string // Hash of the method, URL and body the key was first used with
+	StatusCode  int    // 0 while the first request is still being processed
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+)
+
+// Job is a persisted background task that populates or re-balances a segment in batches.
+type Job struct {
+	ID           int
+	Kind         string
+	SegmentID    int
+	Status       string
+	Total        int // Users to scan, counted when the job starts
+	Processed    int // Users scanned so far
+	Added        int // Memberships created so far
+	Removed      int // Memberships removed so far
+	FromPct      int // Rebalance jobs: the auto_pct when the job was queued, for reference
+	ToPct        int // Rebalance jobs: the requested auto_pct, for reference; the job follows the segment's current one
+	CursorUserID int // Last user ID processed; the job resumes after it
+	Error        string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	FinishedAt   time.Time // zero until the job completes, fails or is cancelled
+}
+
+// Job kinds.
+const (
+	JobKindAutoAdd   = "auto_add"
+	JobKindRebalance = "rebalance"
+)
+
+// Job statuses.
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled" // The segment no longer needs the job, for example after auto_add was disabled
+)
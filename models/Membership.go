@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+)
+
+// Membership represents a link between a user and a segment.
+type Membership struct {
+	UserID      int
+	SegmentID   int
+	SegmentSlug string
+	Source      string
+	AddedAt     time.Time
+	StartsAt    time.Time // zero for memberships that are active as soon as they are added
+	ExpiresAt   time.Time // zero for memberships that never expire
+}
+
+// Expiry policies applied when a user is added to a segment they are already in.
+const (
+	ExpiryPolicyKeep    = "keep"    // keep the stored expires_at
+	ExpiryPolicyExtend  = "extend"  // use the later of the stored and the requested expires_at
+	ExpiryPolicyReplace = "replace" // overwrite the stored expires_at with the requested one
+)
+
+// Membership sources stored in user_segments.source.
+const (
+	SourceManual = "manual" // added through /users/update-segments
+	SourceAuto   = "auto"   // added by a segment's auto_add rule
+)
+
+// Membership statuses at a point in time.
+const (
+	MembershipStatusActive    = "active"    // started and not expired
+	MembershipStatusScheduled = "scheduled" // starts_at is still ahead
+	MembershipStatusExpired   = "expired"   // expired but not removed by the expiry sweeper yet
+)
+
+// Status reports whether the membership is active, scheduled or expired at now.
+func (m Membership) Status(now time.Time) string {
+	switch {
+	case !m.ExpiresAt.IsZero() && !m.ExpiresAt.After(now):
+		return MembershipStatusExpired
+	case m.StartsAt.After(now):
+		return MembershipStatusScheduled
+	default:
+		return MembershipStatusActive
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// Report describes a history report. Reports are generated in the background
+// and kept as a file in the report store once they are completed.
+type Report struct {
+	ID         string // Name of the file in the report store
+	Format     string // Name of the report format
+	Status     string
+	Filter     []byte // History filter the report was requested with, as JSON
+	Rows       int
+	Error      string
+	CreatedAt  time.Time
+	FinishedAt time.Time // zero until the report is completed or failed
+}
+
+// Report statuses.
+const (
+	ReportStatusPending   = "pending"
+	ReportStatusCompleted = "completed"
+	ReportStatusFailed    = "failed"
+)
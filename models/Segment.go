@@ -6,9 +6,38 @@ import (
 
 // Segment represents a segment that users can belong to.
 type Segment struct {
-	ID        int
-	Slug      string
-	AutoAdd   bool
-	AutoPct   int
-	CreatedAt time.Time
+	ID          int
+	Slug        string
+	Description string
+	Owner       string   // Team or person responsible for the segment
+	Tags        []string // Sorted, without duplicates
+	AutoAdd     bool
+	AutoPct     int
+	Salt        string        // Hashed with the user ID to place users into rollout buckets
+	DefaultTTL  time.Duration // Lifetime of memberships added without an explicit expiry, 0 for permanent
+	CreatedAt   time.Time
+	ArchivedAt  time.Time // zero unless the segment was deleted and can still be restored
+}
+
+// Segment states.
+const (
+	SegmentStateActive   = "active"
+	SegmentStateArchived = "archived"
+)
+
+// State reports whether the segment is active or archived.
+func (s Segment) State() string {
+	if s.ArchivedAt.IsZero() {
+		return SegmentStateActive
+	}
+	return SegmentStateArchived
+}
+
+// SegmentMemberCounts counts the memberships of a segment at a point in time.
+// Active is split by source into Manual and Auto.
+type SegmentMemberCounts struct {
+	Active    int
+	Manual    int
+	Auto      int
+	Scheduled int // memberships whose starts_at is still ahead
 }
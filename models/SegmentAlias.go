@@ -0,0 +1,12 @@
+package models
+
+import (
+	"time"
+)
+
+// SegmentAlias is a former slug of a segment that still resolves to it.
+type SegmentAlias struct {
+	Alias     string
+	SegmentID int
+	CreatedAt time.Time
+}
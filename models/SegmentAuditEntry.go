@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// SegmentAuditEntry records one change to a segment's properties. Values are
+// stored as text in the format accepted by the API, e.g. "720h0m0s" for a TTL.
+type SegmentAuditEntry struct {
+	ID          int
+	SegmentID   int
+	SegmentSlug string // slug the segment had when it was changed
+	Field       string
+	OldValue    string
+	NewValue    string
+	ChangedAt   time.Time
+}
+
+// Fields recorded in segment_audit.
+const (
+	SegmentFieldSlug        = "slug"
+	SegmentFieldAlias       = "alias" // removals only; the new value is empty
+	SegmentFieldDescription = "description"
+	SegmentFieldOwner       = "owner"
+	SegmentFieldTags        = "tags"
+	SegmentFieldAutoAdd     = "auto_add"
+	SegmentFieldAutoPct     = "auto_pct"
+	SegmentFieldDefaultTTL  = "default_ttl"
+	SegmentFieldState       = "state"
+)
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+)
+
+// SegmentHistoryEntry represents a single operation recorded in segment_history.
+// SegmentName is the slug the segment had at the time, so entries of deleted
+// segments keep their name. Adds and renewals also record the resulting start
+// and expiry of the membership.
+type SegmentHistoryEntry struct {
+	UserID      int
+	SegmentID   int
+	SegmentName string
+	Operation   string
+	Reason      string
+	SegmentTime time.Time
+	StartsAt    time.Time // zero unless the membership was scheduled
+	ExpiresAt   time.Time // zero for memberships that never expire
+}
+
+// Operations recorded in segment_history.
+const (
+	OperationAdd      = "add"
+	OperationRemove   = "remove"
+	OperationExpire   = "expire"
+	OperationRenew    = "renew"
+	OperationActivate = "activate"
+)
+
+// Reasons recorded in segment_history next to the operation.
+const (
+	ReasonManual   = "manual"   // requested through the API
+	ReasonAutoAdd  = "auto_add" // applied by a segment's auto_add rule
+	ReasonExpiry   = "expiry"   // removed by the expiry sweeper
+	ReasonSchedule = "schedule" // a scheduled membership reached its starts_at
+
+	ReasonSegmentDeleted  = "segment_deleted"  // removed because the segment was deleted
+	ReasonSegmentRestored = "segment_restored" // added back because the deleted segment was restored
+
+	ReasonAutoRebalance = "auto_rebalance" // applied after a segment's auto_pct changed
+)
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalReportStore is a ReportStore that keeps reports as files in a directory.
+type LocalReportStore struct {
+	dir string
+}
+
+func NewLocalReportStore(dir string) (*LocalReportStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalReportStore{dir: dir}, nil
+}
+
+// path maps a report name onto a file in the directory, rejecting names that would escape it.
+func (l *LocalReportStore) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+func (l *LocalReportStore) Save(name string, write func(w io.Writer) error) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	// Write to a hidden temporary file first so that a partial report is never served
+	file, err := os.CreateTemp(l.dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (l *LocalReportStore) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, time.Time{}, err
+	}
+	return file, info.ModTime(), nil
+}
+
+func (l *LocalReportStore) DeleteBefore(t time.Time) (int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if !info.ModTime().Before(t) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, err
+		}
+		// Leftover temporary files of interrupted reports are removed too, but aren't reports
+		if !strings.HasPrefix(entry.Name(), ".") {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
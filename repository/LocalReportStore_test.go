@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalReportStoreSave(t *testing.T) {
+	errWrite := errors.New("write failed")
+	tests := []struct {
+		name     string
+		report   string
+		write    func(w io.Writer) error
+		wantErr  error
+		wantBody string
+	}{
+		{
+			name:     "saved",
+			report:   "report.csv",
+			write:    func(w io.Writer) error { _, err := io.WriteString(w, "user_id\n1\n"); return err },
+			wantBody: "user_id\n1\n",
+		},
+		{
+			name:    "failed write is discarded",
+			report:  "report.csv",
+			write:   func(w io.Writer) error { io.WriteString(w, "user_id\n"); return errWrite },
+			wantErr: errWrite,
+		},
+		{name: "empty name", report: "", write: func(io.Writer) error { return nil }, wantErr: ErrNotFound},
+		{name: "hidden name", report: ".report.csv", write: func(io.Writer) error { return nil }, wantErr: ErrNotFound},
+		{name: "path traversal", report: "../report.csv", write: func(io.Writer) error { return nil }, wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			reports, err := NewLocalReportStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = reports.Save(tt.report, tt.write)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Save() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				// Neither the report nor its temporary file is left behind
+				entries, _ := os.ReadDir(dir)
+				if len(entries) != 0 {
+					t.Errorf("directory has %d files after a failed Save", len(entries))
+				}
+				if _, _, err := reports.Open(tt.report); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Open() error = %v, want ErrNotFound", err)
+				}
+				return
+			}
+
+			file, _, err := reports.Open(tt.report)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer file.Close()
+			body, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("report = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestLocalReportStoreDeleteBefore(t *testing.T) {
+	dir := t.TempDir()
+	reports, err := NewLocalReportStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	files := map[string]time.Time{
+		"old.csv":           now.Add(-2 * time.Hour),
+		"new.csv":           now,
+		".tmp-old.csv-1234": now.Add(-2 * time.Hour),
+	}
+	for name, modTime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("report"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := reports.DeleteBefore(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("DeleteBefore() = %d, want 1 report", deleted)
+	}
+	for name, wantExists := range map[string]bool{"old.csv": false, "new.csv": true, ".tmp-old.csv-1234": false} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("%s exists = %v, want %v", name, exists, wantExists)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"time"
+)
+
+func (m *MemoryStore) GetIdempotencyRecord(key string) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := m.do(func(st *memoryState) error {
+		var ok bool
+		record, ok = st.idempotency[key]
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return record, err
+}
+
+func (m *MemoryStore) CreateIdempotencyRecord(record models.IdempotencyRecord) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.idempotency[record.Key]; ok {
+			return ErrDuplicate
+		}
+		st.idempotency[record.Key] = record
+		return nil
+	})
+}
+
+func (m *MemoryStore) UpdateIdempotencyRecord(record models.IdempotencyRecord) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.idempotency[record.Key]
+		if !ok {
+			return nil
+		}
+		stored.StatusCode = record.StatusCode
+		stored.ContentType = record.ContentType
+		stored.Body = record.Body
+		st.idempotency[record.Key] = stored
+		return nil
+	})
+}
+
+func (m *MemoryStore) RenewIdempotencyRecord(key string, requestHash string, renewedAt time.Time) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.idempotency[key]
+		if !ok || stored.StatusCode != 0 || stored.RequestHash != requestHash {
+			return nil
+		}
+		stored.CreatedAt = renewedAt
+		st.idempotency[key] = stored
+		return nil
+	})
+}
+
+func (m *MemoryStore) DeleteIdempotencyRecord(key string) error {
+	return m.do(func(st *memoryState) error {
+		delete(st.idempotency, key)
+		return nil
+	})
+}
+
+func (m *MemoryStore) DeleteIdempotencyRecordsBefore(t time.Time) (int, error) {
+	deleted := 0
+	err := m.do(func(st *memoryState) error {
+		for key, record := range st.idempotency {
+			if record.CreatedAt.Before(t) {
+				delete(st.idempotency, key)
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) CreateJob(job models.Job) (int, error) {
+	err := m.do(func(st *memoryState) error {
+		st.nextJobID++
+		job.ID = st.nextJobID
+		job.CreatedAt = time.Now()
+		job.UpdatedAt = job.CreatedAt
+		st.jobs[job.ID] = job
+		return nil
+	})
+	return job.ID, err
+}
+
+func (m *MemoryStore) GetJob(jobID int) (models.Job, error) {
+	var job models.Job
+	err := m.do(func(st *memoryState) error {
+		var ok bool
+		job, ok = st.jobs[jobID]
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return job, err
+}
+
+// LockJob is GetJob: a transaction on the in-memory store already holds the store-wide lock.
+func (m *MemoryStore) LockJob(jobID int) (models.Job, error) {
+	return m.GetJob(jobID)
+}
+
+func (m *MemoryStore) UpdateJob(job models.Job) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.jobs[job.ID]
+		if !ok {
+			return nil
+		}
+		job.Kind = stored.Kind
+		job.SegmentID = stored.SegmentID
+		job.FromPct = stored.FromPct
+		job.ToPct = stored.ToPct
+		job.CreatedAt = stored.CreatedAt
+		job.UpdatedAt = time.Now()
+		st.jobs[job.ID] = job
+		return nil
+	})
+}
+
+func (m *MemoryStore) ListUnfinishedJobs() ([]models.Job, error) {
+	var jobs []models.Job
+	err := m.do(func(st *memoryState) error {
+		for _, job := range st.jobs {
+			if job.Status == models.JobStatusPending || job.Status == models.JobStatusRunning {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+func (m *MemoryStore) CancelSegmentJobs(segmentID int, kind string, finishedAt time.Time) (int, error) {
+	cancelled := 0
+	err := m.do(func(st *memoryState) error {
+		for id, job := range st.jobs {
+			if job.SegmentID != segmentID || job.Kind != kind {
+				continue
+			}
+			if job.Status != models.JobStatusPending && job.Status != models.JobStatusRunning {
+				continue
+			}
+			job.Status = models.JobStatusCancelled
+			job.FinishedAt = finishedAt
+			job.UpdatedAt = time.Now()
+			st.jobs[id] = job
+			cancelled++
+		}
+		return nil
+	})
+	return cancelled, err
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) CreateReport(report models.Report) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.reports[report.ID]; ok {
+			return ErrDuplicate
+		}
+		st.reports[report.ID] = report
+		return nil
+	})
+}
+
+func (m *MemoryStore) GetReport(reportID string) (models.Report, error) {
+	var report models.Report
+	err := m.do(func(st *memoryState) error {
+		var ok bool
+		report, ok = st.reports[reportID]
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return report, err
+}
+
+func (m *MemoryStore) UpdateReport(report models.Report) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.reports[report.ID]
+		if !ok {
+			return nil
+		}
+		stored.Status = report.Status
+		stored.Rows = report.Rows
+		stored.Error = report.Error
+		stored.FinishedAt = report.FinishedAt
+		st.reports[report.ID] = stored
+		return nil
+	})
+}
+
+func (m *MemoryStore) ListPendingReports() ([]models.Report, error) {
+	var reports []models.Report
+	err := m.do(func(st *memoryState) error {
+		for _, report := range st.reports {
+			if report.Status == models.ReportStatusPending {
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].CreatedAt.Equal(reports[j].CreatedAt) {
+			return reports[i].CreatedAt.Before(reports[j].CreatedAt)
+		}
+		return reports[i].ID < reports[j].ID
+	})
+	return reports, nil
+}
+
+func (m *MemoryStore) DeleteReportsBefore(t time.Time) (int, error) {
+	deleted := 0
+	err := m.do(func(st *memoryState) error {
+		for id, report := range st.reports {
+			if report.CreatedAt.Before(t) {
+				delete(st.reports, id)
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
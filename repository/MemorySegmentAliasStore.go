@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) AddSegmentAlias(alias models.SegmentAlias) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.aliases[alias.Alias]; ok {
+			return ErrDuplicate
+		}
+		alias.CreatedAt = time.Now()
+		st.aliases[alias.Alias] = alias
+		return nil
+	})
+}
+
+func (m *MemoryStore) GetSegmentAlias(alias string) (models.SegmentAlias, error) {
+	var result models.SegmentAlias
+	err := m.do(func(st *memoryState) error {
+		var ok bool
+		result, ok = st.aliases[alias]
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (m *MemoryStore) ListSegmentAliases(segmentID int) ([]models.SegmentAlias, error) {
+	var aliases []models.SegmentAlias
+	err := m.do(func(st *memoryState) error {
+		for _, alias := range st.aliases {
+			if alias.SegmentID == segmentID {
+				aliases = append(aliases, alias)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		if !aliases[i].CreatedAt.Equal(aliases[j].CreatedAt) {
+			return aliases[i].CreatedAt.Before(aliases[j].CreatedAt)
+		}
+		return aliases[i].Alias < aliases[j].Alias
+	})
+	return aliases, nil
+}
+
+func (m *MemoryStore) DeleteSegmentAlias(segmentID int, alias string) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.aliases[alias]
+		if !ok || stored.SegmentID != segmentID {
+			return ErrNotFound
+		}
+		delete(st.aliases, alias)
+		return nil
+	})
+}
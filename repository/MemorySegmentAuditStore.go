@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+)
+
+func (m *MemoryStore) LogSegmentChange(entry models.SegmentAuditEntry) error {
+	return m.do(func(st *memoryState) error {
+		st.nextAuditID++
+		entry.ID = st.nextAuditID
+		st.segmentAudit = append(st.segmentAudit, entry)
+		return nil
+	})
+}
+
+func (m *MemoryStore) ListSegmentChanges(segmentID int) ([]models.SegmentAuditEntry, error) {
+	var entries []models.SegmentAuditEntry
+	err := m.do(func(st *memoryState) error {
+		for _, entry := range st.segmentAudit {
+			if entry.SegmentID == segmentID {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,875 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type membershipKey struct {
+	userID    int
+	segmentID int
+}
+
+type memoryMembership struct {
+	source      string
+	addedAt     time.Time
+	startsAt    time.Time
+	expiresAt   time.Time
+	activatedAt time.Time
+}
+
+type memoryHistoryRow struct {
+	userID      int
+	segmentID   int
+	segmentSlug string
+	operation   string
+	reason      string
+	timestamp   time.Time
+	startsAt    time.Time
+	expiresAt   time.Time
+}
+
+// memoryState holds every table of the in-memory backend.
+type memoryState struct {
+	users         map[int]models.User
+	nextUserID    int
+	segments      map[int]models.Segment
+	nextSegmentID int
+	memberships   map[membershipKey]memoryMembership
+	history       []memoryHistoryRow
+	segmentAudit  []models.SegmentAuditEntry
+	nextAuditID   int
+	aliases       map[string]models.SegmentAlias
+	jobs          map[int]models.Job
+	nextJobID     int
+	idempotency   map[string]models.IdempotencyRecord
+	reports       map[string]models.Report
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		users:       make(map[int]models.User),
+		segments:    make(map[int]models.Segment),
+		memberships: make(map[membershipKey]memoryMembership),
+		aliases:     make(map[string]models.SegmentAlias),
+		jobs:        make(map[int]models.Job),
+		idempotency: make(map[string]models.IdempotencyRecord),
+		reports:     make(map[string]models.Report),
+	}
+}
+
+func (st *memoryState) clone() *memoryState {
+	c := &memoryState{
+		users:         make(map[int]models.User, len(st.users)),
+		nextUserID:    st.nextUserID,
+		segments:      make(map[int]models.Segment, len(st.segments)),
+		nextSegmentID: st.nextSegmentID,
+		memberships:   make(map[membershipKey]memoryMembership, len(st.memberships)),
+		history:       append([]memoryHistoryRow(nil), st.history...),
+		segmentAudit:  append([]models.SegmentAuditEntry(nil), st.segmentAudit...),
+		nextAuditID:   st.nextAuditID,
+		aliases:       make(map[string]models.SegmentAlias, len(st.aliases)),
+		jobs:          make(map[int]models.Job, len(st.jobs)),
+		nextJobID:     st.nextJobID,
+		idempotency:   make(map[string]models.IdempotencyRecord, len(st.idempotency)),
+		reports:       make(map[string]models.Report, len(st.reports)),
+	}
+	for id, user := range st.users {
+		c.users[id] = user
+	}
+	for id, segment := range st.segments {
+		c.segments[id] = segment
+	}
+	for key, membership := range st.memberships {
+		c.memberships[key] = membership
+	}
+	for alias, segmentAlias := range st.aliases {
+		c.aliases[alias] = segmentAlias
+	}
+	for id, job := range st.jobs {
+		c.jobs[id] = job
+	}
+	for key, record := range st.idempotency {
+		c.idempotency[key] = record
+	}
+	for id, report := range st.reports {
+		c.reports[id] = report
+	}
+	return c
+}
+
+// segmentIDBySlug finds a segment that isn't archived.
+func (st *memoryState) segmentIDBySlug(slug string) (int, bool) {
+	for id, segment := range st.segments {
+		if segment.Slug == slug && segment.ArchivedAt.IsZero() {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// matchesSlug reports whether slug is the slug or one of the aliases of a segment.
+func (st *memoryState) matchesSlug(segment models.Segment, slug string) bool {
+	if segment.Slug == slug {
+		return true
+	}
+	alias, ok := st.aliases[slug]
+	return ok && alias.SegmentID == segment.ID
+}
+
+// resolveSegmentID finds a segment that isn't archived by its slug or one of its aliases.
+func (st *memoryState) resolveSegmentID(slug string) (int, bool) {
+	if id, ok := st.segmentIDBySlug(slug); ok {
+		return id, true
+	}
+	alias, ok := st.aliases[slug]
+	if !ok || !st.segments[alias.SegmentID].ArchivedAt.IsZero() {
+		return 0, false
+	}
+	return alias.SegmentID, true
+}
+
+// MemoryStore is a Store that keeps everything in process memory.
+// It is meant for tests and local demos that run without a database.
+type MemoryStore struct {
+	mu    *sync.Mutex
+	state *memoryState
+	inTx  bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mu: &sync.Mutex{}, state: newMemoryState()}
+}
+
+// do runs fn against the current state, taking the lock unless the store
+// is already bound to a transaction that holds it.
+func (m *MemoryStore) do(fn func(st *memoryState) error) error {
+	if m.inTx {
+		return fn(m.state)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m.state)
+}
+
+func (m *MemoryStore) WithinTx(fn func(tx Store) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &MemoryStore{mu: m.mu, state: m.state.clone(), inTx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.state = tx.state
+	return nil
+}
+
+func (m *MemoryStore) CreateUser() (int, error) {
+	var userID int
+	err := m.do(func(st *memoryState) error {
+		st.nextUserID++
+		userID = st.nextUserID
+		st.users[userID] = models.User{ID: userID, CreatedAt: time.Now()}
+		return nil
+	})
+	return userID, err
+}
+
+func (m *MemoryStore) CountUsers() (int, error) {
+	var count int
+	err := m.do(func(st *memoryState) error {
+		count = len(st.users)
+		return nil
+	})
+	return count, err
+}
+
+func (m *MemoryStore) ListUserIDsAfter(afterID int, limit int) ([]int, error) {
+	var userIDs []int
+	err := m.do(func(st *memoryState) error {
+		for id := range st.users {
+			if id > afterID {
+				userIDs = append(userIDs, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(userIDs)
+	if len(userIDs) > limit {
+		userIDs = userIDs[:limit]
+	}
+	return userIDs, nil
+}
+
+func (m *MemoryStore) CreateSegment(segment models.Segment) (int, error) {
+	err := m.do(func(st *memoryState) error {
+		// Mirror the unique index on the slugs of active segments in the MySQL schema.
+		if _, ok := st.segmentIDBySlug(segment.Slug); ok {
+			return ErrDuplicate
+		}
+		st.nextSegmentID++
+		segment.ID = st.nextSegmentID
+		segment.Tags = append([]string(nil), segment.Tags...)
+		segment.CreatedAt = time.Now()
+		st.segments[segment.ID] = segment
+		return nil
+	})
+	return segment.ID, err
+}
+
+func (m *MemoryStore) DeleteSegment(segmentID int) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.segments[segmentID]; !ok {
+			return nil
+		}
+		delete(st.segments, segmentID)
+
+		// Mirror ON DELETE CASCADE of user_segments and segment_aliases in the MySQL schema.
+		for key := range st.memberships {
+			if key.segmentID == segmentID {
+				delete(st.memberships, key)
+			}
+		}
+		for alias, segmentAlias := range st.aliases {
+			if segmentAlias.SegmentID == segmentID {
+				delete(st.aliases, alias)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MemoryStore) RenameSegment(segmentID int, slug string) error {
+	return m.do(func(st *memoryState) error {
+		segment, ok := st.segments[segmentID]
+		if !ok {
+			return nil
+		}
+		if id, ok := st.segmentIDBySlug(slug); ok && id != segmentID && segment.ArchivedAt.IsZero() {
+			return ErrDuplicate
+		}
+		segment.Slug = slug
+		st.segments[segmentID] = segment
+		return nil
+	})
+}
+
+func (m *MemoryStore) GetSegmentIDBySlug(slug string) (int, error) {
+	var segmentID int
+	err := m.do(func(st *memoryState) error {
+		id, ok := st.resolveSegmentID(slug)
+		if !ok {
+			return ErrNotFound
+		}
+		segmentID = id
+		return nil
+	})
+	return segmentID, err
+}
+
+func (m *MemoryStore) GetSegmentBySlug(slug string) (models.Segment, error) {
+	var segment models.Segment
+	err := m.do(func(st *memoryState) error {
+		id, ok := st.resolveSegmentID(slug)
+		if !ok {
+			return ErrNotFound
+		}
+		segment = st.segments[id]
+		return nil
+	})
+	return segment, err
+}
+
+func (m *MemoryStore) GetArchivedSegmentBySlug(slug string) (models.Segment, error) {
+	var result models.Segment
+	err := m.do(func(st *memoryState) error {
+		found := false
+		for _, segment := range st.segments {
+			if !st.matchesSlug(segment, slug) || segment.ArchivedAt.IsZero() {
+				continue
+			}
+			if !found || segment.ArchivedAt.After(result.ArchivedAt) ||
+				(segment.ArchivedAt.Equal(result.ArchivedAt) && segment.ID > result.ID) {
+				result = segment
+				found = true
+			}
+		}
+		if !found {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (m *MemoryStore) ArchiveSegment(segmentID int, archivedAt time.Time) error {
+	return m.do(func(st *memoryState) error {
+		segment, ok := st.segments[segmentID]
+		if !ok {
+			return nil
+		}
+		segment.ArchivedAt = archivedAt
+		st.segments[segmentID] = segment
+		return nil
+	})
+}
+
+func (m *MemoryStore) RestoreSegment(segmentID int) error {
+	return m.do(func(st *memoryState) error {
+		segment, ok := st.segments[segmentID]
+		if !ok {
+			return nil
+		}
+		if _, ok := st.segmentIDBySlug(segment.Slug); ok {
+			return ErrDuplicate
+		}
+		segment.ArchivedAt = time.Time{}
+		st.segments[segmentID] = segment
+		return nil
+	})
+}
+
+func (m *MemoryStore) UpdateSegmentAutoPct(segmentID int, autoPct int) error {
+	return m.do(func(st *memoryState) error {
+		segment, ok := st.segments[segmentID]
+		if !ok {
+			return nil
+		}
+		segment.AutoPct = autoPct
+		st.segments[segmentID] = segment
+		return nil
+	})
+}
+
+func (m *MemoryStore) UpdateSegment(segment models.Segment) error {
+	return m.do(func(st *memoryState) error {
+		stored, ok := st.segments[segment.ID]
+		if !ok {
+			return nil
+		}
+		stored.Description = segment.Description
+		stored.Owner = segment.Owner
+		stored.Tags = append([]string(nil), segment.Tags...)
+		stored.AutoAdd = segment.AutoAdd
+		stored.AutoPct = segment.AutoPct
+		stored.DefaultTTL = segment.DefaultTTL
+		st.segments[segment.ID] = stored
+		return nil
+	})
+}
+
+func (m *MemoryStore) ListSegments(filter SegmentFilter) ([]models.Segment, error) {
+	var segments []models.Segment
+	err := m.do(func(st *memoryState) error {
+		for _, segment := range st.segments {
+			if !strings.HasPrefix(segment.Slug, filter.SlugPrefix) {
+				continue
+			}
+			if filter.State != "" && segment.State() != filter.State {
+				continue
+			}
+			if filter.Owner != "" && segment.Owner != filter.Owner {
+				continue
+			}
+			hasTags := true
+			for _, tag := range filter.Tags {
+				if !containsString(segment.Tags, tag) {
+					hasTags = false
+					break
+				}
+			}
+			if !hasTags {
+				continue
+			}
+			segments = append(segments, segment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// less orders segments ascending by the sort key and then by ID
+	less := func(a, b models.Segment) bool {
+		if filter.SortBy == SegmentSortCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		if filter.SortBy != SegmentSortCreatedAt && a.Slug != b.Slug {
+			return a.Slug < b.Slug
+		}
+		return a.ID < b.ID
+	}
+	if filter.Descending {
+		ascending := less
+		less = func(a, b models.Segment) bool { return ascending(b, a) }
+	}
+	sort.Slice(segments, func(i, j int) bool { return less(segments[i], segments[j]) })
+
+	if filter.After != nil {
+		start := sort.Search(len(segments), func(i int) bool { return less(*filter.After, segments[i]) })
+		segments = segments[start:]
+	}
+	if len(segments) > filter.Limit {
+		segments = segments[:filter.Limit]
+	}
+	return segments, nil
+}
+
+func (m *MemoryStore) GetSegmentByID(segmentID int) (models.Segment, error) {
+	var segment models.Segment
+	err := m.do(func(st *memoryState) error {
+		var ok bool
+		segment, ok = st.segments[segmentID]
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return segment, err
+}
+
+func (m *MemoryStore) ListAutoAddSegments() ([]models.Segment, error) {
+	var segments []models.Segment
+	err := m.do(func(st *memoryState) error {
+		for _, segment := range st.segments {
+			if segment.AutoAdd && segment.AutoPct > 0 && segment.ArchivedAt.IsZero() {
+				segments = append(segments, segment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
+	return segments, nil
+}
+
+func (m *MemoryStore) AddMembership(userID int, segmentID int, startsAt time.Time, expiresAt time.Time, source string) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.users[userID]; !ok {
+			return ErrNotFound
+		}
+		if _, ok := st.segments[segmentID]; !ok {
+			return ErrNotFound
+		}
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		if _, ok := st.memberships[key]; ok {
+			return ErrDuplicate
+		}
+		st.memberships[key] = memoryMembership{source: source, addedAt: time.Now(), startsAt: startsAt, expiresAt: expiresAt}
+		return nil
+	})
+}
+
+func (m *MemoryStore) AddMemberships(segmentID int, userIDs []int, expiresAt time.Time, source string) ([]int, error) {
+	var added []int
+	err := m.do(func(st *memoryState) error {
+		if _, ok := st.segments[segmentID]; !ok {
+			return ErrNotFound
+		}
+		for _, userID := range userIDs {
+			if _, ok := st.users[userID]; !ok {
+				return ErrNotFound
+			}
+		}
+
+		now := time.Now()
+		for _, userID := range userIDs {
+			key := membershipKey{userID: userID, segmentID: segmentID}
+			if _, ok := st.memberships[key]; ok {
+				continue
+			}
+			st.memberships[key] = memoryMembership{source: source, addedAt: now, expiresAt: expiresAt}
+			added = append(added, userID)
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (m *MemoryStore) RemoveMemberships(segmentID int, userIDs []int, source string) ([]int, error) {
+	var removed []int
+	err := m.do(func(st *memoryState) error {
+		for _, userID := range userIDs {
+			key := membershipKey{userID: userID, segmentID: segmentID}
+			if membership, ok := st.memberships[key]; ok && membership.source == source {
+				delete(st.memberships, key)
+				removed = append(removed, userID)
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (m *MemoryStore) GetMembership(userID int, segmentID int) (models.Membership, error) {
+	var result models.Membership
+	err := m.do(func(st *memoryState) error {
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		membership, ok := st.memberships[key]
+		if !ok {
+			return ErrNotFound
+		}
+		result = st.toMembership(key, membership)
+		return nil
+	})
+	return result, err
+}
+
+func (m *MemoryStore) UpdateMembershipExpiry(userID int, segmentID int, expiresAt time.Time) error {
+	return m.do(func(st *memoryState) error {
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		membership, ok := st.memberships[key]
+		if !ok {
+			return nil
+		}
+		membership.expiresAt = expiresAt
+		st.memberships[key] = membership
+		return nil
+	})
+}
+
+func (m *MemoryStore) UpdateMembershipStart(userID int, segmentID int, startsAt time.Time) error {
+	return m.do(func(st *memoryState) error {
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		membership, ok := st.memberships[key]
+		if !ok {
+			return nil
+		}
+		membership.startsAt = startsAt
+		st.memberships[key] = membership
+		return nil
+	})
+}
+
+func (m *MemoryStore) RemoveMembership(userID int, segmentID int) error {
+	return m.do(func(st *memoryState) error {
+		delete(st.memberships, membershipKey{userID: userID, segmentID: segmentID})
+		return nil
+	})
+}
+
+func (m *MemoryStore) RemoveExpiredMembership(userID int, segmentID int, now time.Time) (bool, error) {
+	var removed bool
+	err := m.do(func(st *memoryState) error {
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		membership, ok := st.memberships[key]
+		if !ok || membership.expiresAt.IsZero() || membership.expiresAt.After(now) {
+			return nil
+		}
+		delete(st.memberships, key)
+		removed = true
+		return nil
+	})
+	return removed, err
+}
+
+func (m *MemoryStore) IsUserLinkedToSegment(userID int, segmentID int) (bool, error) {
+	var linked bool
+	err := m.do(func(st *memoryState) error {
+		_, linked = st.memberships[membershipKey{userID: userID, segmentID: segmentID}]
+		return nil
+	})
+	return linked, err
+}
+
+func (st *memoryState) toMembership(key membershipKey, membership memoryMembership) models.Membership {
+	return models.Membership{
+		UserID:      key.userID,
+		SegmentID:   key.segmentID,
+		SegmentSlug: st.segments[key.segmentID].Slug,
+		Source:      membership.source,
+		AddedAt:     membership.addedAt,
+		StartsAt:    membership.startsAt,
+		ExpiresAt:   membership.expiresAt,
+	}
+}
+
+func (m *MemoryStore) GetUserMemberships(userID int, now time.Time) ([]models.Membership, error) {
+	var memberships []models.Membership
+	err := m.do(func(st *memoryState) error {
+		for key, membership := range st.memberships {
+			if key.userID != userID || !st.segments[key.segmentID].ArchivedAt.IsZero() {
+				continue
+			}
+			if membership.startsAt.After(now) {
+				continue
+			}
+			if !membership.expiresAt.IsZero() && !membership.expiresAt.After(now) {
+				continue
+			}
+			memberships = append(memberships, st.toMembership(key, membership))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].SegmentID < memberships[j].SegmentID })
+	return memberships, nil
+}
+
+func (m *MemoryStore) CountSegmentMembers(segmentID int, now time.Time) (models.SegmentMemberCounts, error) {
+	var counts models.SegmentMemberCounts
+	err := m.do(func(st *memoryState) error {
+		for key, membership := range st.memberships {
+			if key.segmentID != segmentID {
+				continue
+			}
+			if !membership.expiresAt.IsZero() && !membership.expiresAt.After(now) {
+				continue
+			}
+			if membership.startsAt.After(now) {
+				counts.Scheduled++
+				continue
+			}
+			counts.Active++
+			switch membership.source {
+			case models.SourceManual:
+				counts.Manual++
+			case models.SourceAuto:
+				counts.Auto++
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// matchingMembers returns the memberships matching filter, ignoring its cursor and limit, ordered by user ID.
+func (st *memoryState) matchingMembers(filter MemberFilter) []models.Membership {
+	var memberships []models.Membership
+	for key, stored := range st.memberships {
+		if key.segmentID != filter.SegmentID {
+			continue
+		}
+		membership := st.toMembership(key, stored)
+		if filter.Status != "" && membership.Status(filter.Now) != filter.Status {
+			continue
+		}
+		if filter.Source != "" && membership.Source != filter.Source {
+			continue
+		}
+		memberships = append(memberships, membership)
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].UserID < memberships[j].UserID })
+	return memberships
+}
+
+func (m *MemoryStore) ListMembers(filter MemberFilter) ([]models.Membership, error) {
+	var memberships []models.Membership
+	err := m.do(func(st *memoryState) error {
+		memberships = st.matchingMembers(filter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(memberships), func(i int) bool { return memberships[i].UserID > filter.AfterUserID })
+	memberships = memberships[start:]
+	if len(memberships) > filter.Limit {
+		memberships = memberships[:filter.Limit]
+	}
+	return memberships, nil
+}
+
+func (m *MemoryStore) CountMembers(filter MemberFilter) (int, error) {
+	count := 0
+	err := m.do(func(st *memoryState) error {
+		count = len(st.matchingMembers(filter))
+		return nil
+	})
+	return count, err
+}
+
+func (m *MemoryStore) ListExpiredMemberships(now time.Time, limit int) ([]models.Membership, error) {
+	var memberships []models.Membership
+	err := m.do(func(st *memoryState) error {
+		for key, membership := range st.memberships {
+			if membership.expiresAt.IsZero() || membership.expiresAt.After(now) {
+				continue
+			}
+			if !st.segments[key.segmentID].ArchivedAt.IsZero() {
+				continue
+			}
+			memberships = append(memberships, st.toMembership(key, membership))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		a, b := memberships[i], memberships[j]
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.SegmentID < b.SegmentID
+	})
+	if len(memberships) > limit {
+		memberships = memberships[:limit]
+	}
+	return memberships, nil
+}
+
+func (m *MemoryStore) ListPendingActivations(now time.Time, limit int) ([]models.Membership, error) {
+	var memberships []models.Membership
+	err := m.do(func(st *memoryState) error {
+		for key, membership := range st.memberships {
+			if membership.startsAt.IsZero() || membership.startsAt.After(now) || !membership.activatedAt.IsZero() {
+				continue
+			}
+			if !st.segments[key.segmentID].ArchivedAt.IsZero() {
+				continue
+			}
+			memberships = append(memberships, st.toMembership(key, membership))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		a, b := memberships[i], memberships[j]
+		if !a.StartsAt.Equal(b.StartsAt) {
+			return a.StartsAt.Before(b.StartsAt)
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.SegmentID < b.SegmentID
+	})
+	if len(memberships) > limit {
+		memberships = memberships[:limit]
+	}
+	return memberships, nil
+}
+
+func (m *MemoryStore) ActivateMembership(userID int, segmentID int, activatedAt time.Time) error {
+	return m.do(func(st *memoryState) error {
+		key := membershipKey{userID: userID, segmentID: segmentID}
+		membership, ok := st.memberships[key]
+		if !ok {
+			return nil
+		}
+		membership.activatedAt = activatedAt
+		st.memberships[key] = membership
+		return nil
+	})
+}
+
+func (m *MemoryStore) LogSegmentHistory(entry models.SegmentHistoryEntry) error {
+	return m.do(func(st *memoryState) error {
+		if _, ok := st.users[entry.UserID]; !ok {
+			return ErrNotFound
+		}
+		segment, ok := st.segments[entry.SegmentID]
+		if !ok {
+			return ErrNotFound
+		}
+		st.history = append(st.history, memoryHistoryRow{
+			userID:      entry.UserID,
+			segmentID:   entry.SegmentID,
+			segmentSlug: segment.Slug,
+			operation:   entry.Operation,
+			reason:      entry.Reason,
+			timestamp:   entry.SegmentTime,
+			startsAt:    entry.StartsAt,
+			expiresAt:   entry.ExpiresAt,
+		})
+		return nil
+	})
+}
+
+func (m *MemoryStore) LogSegmentHistoryBatch(entry models.SegmentHistoryEntry, userIDs []int) error {
+	return m.WithinTx(func(tx Store) error {
+		for _, userID := range userIDs {
+			entry.UserID = userID
+			if err := tx.LogSegmentHistory(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MemoryStore) StreamSegmentHistory(filter HistoryFilter, fn func(entry models.SegmentHistoryEntry) error) error {
+	var segmentHistory []models.SegmentHistoryEntry
+	err := m.do(func(st *memoryState) error {
+		for _, row := range st.history {
+			if row.timestamp.Before(filter.From) || !row.timestamp.Before(filter.To) {
+				continue
+			}
+			if len(filter.UserIDs) > 0 && !containsInt(filter.UserIDs, row.userID) {
+				continue
+			}
+			if len(filter.SegmentSlugs) > 0 && !containsString(filter.SegmentSlugs, row.segmentSlug) {
+				continue
+			}
+			if len(filter.Operations) > 0 && !containsString(filter.Operations, row.operation) {
+				continue
+			}
+			segmentHistory = append(segmentHistory, models.SegmentHistoryEntry{
+				UserID:      row.userID,
+				SegmentID:   row.segmentID,
+				SegmentName: row.segmentSlug,
+				Operation:   row.operation,
+				Reason:      row.reason,
+				SegmentTime: row.timestamp,
+				StartsAt:    row.startsAt,
+				ExpiresAt:   row.expiresAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// fn is called without holding the lock, so a slow consumer doesn't block the store
+	for _, entry := range segmentHistory {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
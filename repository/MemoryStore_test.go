@@ -0,0 +1,9 @@
+package repository
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (s *MySQLStore) GetIdempotencyRecord(key string) (models.IdempotencyRecord, error) {
+	query := `
+		SELECT idempotency_key, request_hash, status_code, content_type, body, created_at
+		FROM idempotency_keys
+		WHERE idempotency_key = ?
+	`
+	var record models.IdempotencyRecord
+	err := s.q.QueryRow(query, key).Scan(&record.Key, &record.RequestHash, &record.StatusCode, &record.ContentType, &record.Body, &record.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.IdempotencyRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+func (s *MySQLStore) CreateIdempotencyRecord(record models.IdempotencyRecord) error {
+	query := "INSERT INTO idempotency_keys (idempotency_key, request_hash, status_code, content_type, body, created_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := s.q.Exec(query, record.Key, record.RequestHash, record.StatusCode, record.ContentType, record.Body, record.CreatedAt)
+	return translateError(err)
+}
+
+func (s *MySQLStore) UpdateIdempotencyRecord(record models.IdempotencyRecord) error {
+	query := "UPDATE idempotency_keys SET status_code = ?, content_type = ?, body = ? WHERE idempotency_key = ?"
+	_, err := s.q.Exec(query, record.StatusCode, record.ContentType, record.Body, record.Key)
+	return err
+}
+
+func (s *MySQLStore) RenewIdempotencyRecord(key string, requestHash string, renewedAt time.Time) error {
+	query := "UPDATE idempotency_keys SET created_at = ? WHERE idempotency_key = ? AND request_hash = ? AND status_code = 0"
+	_, err := s.q.Exec(query, renewedAt, key, requestHash)
+	return err
+}
+
+func (s *MySQLStore) DeleteIdempotencyRecord(key string) error {
+	_, err := s.q.Exec("DELETE FROM idempotency_keys WHERE idempotency_key = ?", key)
+	return err
+}
+
+func (s *MySQLStore) DeleteIdempotencyRecordsBefore(t time.Time) (int, error) {
+	result, err := s.q.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", t)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
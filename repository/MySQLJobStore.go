@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const jobColumns = "id, kind, segment_id, status, total, processed, added, removed, from_pct, to_pct, cursor_user_id, error, created_at, updated_at, finished_at"
+
+func scanJob(row rowScanner) (models.Job, error) {
+	var job models.Job
+	var jobError sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Kind, &job.SegmentID, &job.Status, &job.Total, &job.Processed, &job.Added,
+		&job.Removed, &job.FromPct, &job.ToPct, &job.CursorUserID, &jobError, &job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	job.Error = jobError.String
+	job.FinishedAt = finishedAt.Time
+	return job, err
+}
+
+func (s *MySQLStore) CreateJob(job models.Job) (int, error) {
+	query := "INSERT INTO jobs (kind, segment_id, status, total, from_pct, to_pct) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := s.q.Exec(query, job.Kind, job.SegmentID, job.Status, job.Total, job.FromPct, job.ToPct)
+	if err != nil {
+		return 0, err
+	}
+
+	jobID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(jobID), nil
+}
+
+func (s *MySQLStore) getJob(query string, jobID int) (models.Job, error) {
+	job, err := scanJob(s.q.QueryRow(query, jobID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Job{}, ErrNotFound
+	}
+	return job, err
+}
+
+func (s *MySQLStore) GetJob(jobID int) (models.Job, error) {
+	return s.getJob("SELECT "+jobColumns+" FROM jobs WHERE id = ?", jobID)
+}
+
+func (s *MySQLStore) LockJob(jobID int) (models.Job, error) {
+	return s.getJob("SELECT "+jobColumns+" FROM jobs WHERE id = ? FOR UPDATE", jobID)
+}
+
+func (s *MySQLStore) UpdateJob(job models.Job) error {
+	query := `
+		UPDATE jobs
+		SET status = ?, total = ?, processed = ?, added = ?, removed = ?, cursor_user_id = ?, error = ?, finished_at = ?
+		WHERE id = ?
+	`
+	var jobError interface{}
+	if job.Error != "" {
+		jobError = job.Error
+	}
+	_, err := s.q.Exec(query, job.Status, job.Total, job.Processed, job.Added, job.Removed, job.CursorUserID, jobError, nullTime(job.FinishedAt), job.ID)
+	return err
+}
+
+func (s *MySQLStore) ListUnfinishedJobs() ([]models.Job, error) {
+	query := "SELECT " + jobColumns + " FROM jobs WHERE status IN (?, ?) ORDER BY id"
+	rows, err := s.q.Query(query, models.JobStatusPending, models.JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func (s *MySQLStore) CancelSegmentJobs(segmentID int, kind string, finishedAt time.Time) (int, error) {
+	query := "UPDATE jobs SET status = ?, finished_at = ? WHERE segment_id = ? AND kind = ? AND status IN (?, ?)"
+	result, err := s.q.Exec(query, models.JobStatusCancelled, finishedAt, segmentID, kind,
+		models.JobStatusPending, models.JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelled, err := result.RowsAffected()
+	return int(cancelled), err
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const reportColumns = "id, format, status, history_filter, row_count, error, created_at, finished_at"
+
+func scanReport(row rowScanner) (models.Report, error) {
+	var report models.Report
+	var reportError sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&report.ID, &report.Format, &report.Status, &report.Filter, &report.Rows, &reportError,
+		&report.CreatedAt, &finishedAt)
+	report.Error = reportError.String
+	report.FinishedAt = finishedAt.Time
+	return report, err
+}
+
+func (s *MySQLStore) CreateReport(report models.Report) error {
+	query := "INSERT INTO reports (id, format, status, history_filter, created_at) VALUES (?, ?, ?, ?, ?)"
+	_, err := s.q.Exec(query, report.ID, report.Format, report.Status, report.Filter, report.CreatedAt)
+	return translateError(err)
+}
+
+func (s *MySQLStore) GetReport(reportID string) (models.Report, error) {
+	report, err := scanReport(s.q.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", reportID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Report{}, ErrNotFound
+	}
+	return report, err
+}
+
+func (s *MySQLStore) UpdateReport(report models.Report) error {
+	var reportError interface{}
+	if report.Error != "" {
+		reportError = report.Error
+	}
+	query := "UPDATE reports SET status = ?, row_count = ?, error = ?, finished_at = ? WHERE id = ?"
+	_, err := s.q.Exec(query, report.Status, report.Rows, reportError, nullTime(report.FinishedAt), report.ID)
+	return err
+}
+
+func (s *MySQLStore) ListPendingReports() ([]models.Report, error) {
+	query := "SELECT " + reportColumns + " FROM reports WHERE status = ? ORDER BY created_at, id"
+	rows, err := s.q.Query(query, models.ReportStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+func (s *MySQLStore) DeleteReportsBefore(t time.Time) (int, error) {
+	result, err := s.q.Exec("DELETE FROM reports WHERE created_at < ?", t)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"database/sql"
+	"errors"
+)
+
+func (s *MySQLStore) AddSegmentAlias(alias models.SegmentAlias) error {
+	_, err := s.q.Exec("INSERT INTO segment_aliases (alias, segment_id) VALUES (?, ?)", alias.Alias, alias.SegmentID)
+	return translateError(err)
+}
+
+func (s *MySQLStore) GetSegmentAlias(alias string) (models.SegmentAlias, error) {
+	var result models.SegmentAlias
+	err := s.q.QueryRow("SELECT alias, segment_id, created_at FROM segment_aliases WHERE alias = ?", alias).
+		Scan(&result.Alias, &result.SegmentID, &result.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SegmentAlias{}, ErrNotFound
+	}
+	return result, err
+}
+
+func (s *MySQLStore) ListSegmentAliases(segmentID int) ([]models.SegmentAlias, error) {
+	rows, err := s.q.Query("SELECT alias, segment_id, created_at FROM segment_aliases WHERE segment_id = ? ORDER BY created_at, alias", segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []models.SegmentAlias
+	for rows.Next() {
+		var alias models.SegmentAlias
+		if err := rows.Scan(&alias.Alias, &alias.SegmentID, &alias.CreatedAt); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+
+	return aliases, rows.Err()
+}
+
+func (s *MySQLStore) DeleteSegmentAlias(segmentID int, alias string) error {
+	result, err := s.q.Exec("DELETE FROM segment_aliases WHERE segment_id = ? AND alias = ?", segmentID, alias)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+)
+
+func (s *MySQLStore) LogSegmentChange(entry models.SegmentAuditEntry) error {
+	query := `
+		INSERT INTO segment_audit (segment_id, segment_slug, field, old_value, new_value, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := s.q.Exec(query, entry.SegmentID, entry.SegmentSlug, entry.Field, entry.OldValue, entry.NewValue, entry.ChangedAt)
+	return err
+}
+
+func (s *MySQLStore) ListSegmentChanges(segmentID int) ([]models.SegmentAuditEntry, error) {
+	query := `
+		SELECT id, segment_id, segment_slug, field, old_value, new_value, changed_at
+		FROM segment_audit
+		WHERE segment_id = ?
+		ORDER BY id
+	`
+	rows, err := s.q.Query(query, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.SegmentAuditEntry
+	for rows.Next() {
+		var entry models.SegmentAuditEntry
+		err := rows.Scan(&entry.ID, &entry.SegmentID, &entry.SegmentSlug, &entry.Field, &entry.OldValue, &entry.NewValue, &entry.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
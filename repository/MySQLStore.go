@@ -0,0 +1,794 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"database/sql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"strings"
+	"time"
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const (
+	mysqlErrDuplicateEntry  = 1062
+	mysqlErrNoReferencedRow = 1452
+)
+
+// translateError maps MySQL constraint violations onto the repository errors.
+func translateError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlErrDuplicateEntry:
+			return ErrDuplicate
+		case mysqlErrNoReferencedRow:
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// MySQLStore is a Store backed by a MySQL database.
+type MySQLStore struct {
+	db *sql.DB // nil when the store is bound to a transaction
+	q  queryer
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db, q: db}
+}
+
+func (s *MySQLStore) WithinTx(fn func(tx Store) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&MySQLStore{q: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MySQLStore) CreateUser() (int, error) {
+	result, err := s.q.Exec("INSERT INTO users (created_at) VALUES (CURRENT_TIMESTAMP)")
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(userID), nil
+}
+
+// segmentColumns reads a segment from the segments table, with its tags as a comma-separated list.
+const segmentColumns = "id, slug, description, owner, " +
+	"(SELECT GROUP_CONCAT(tag ORDER BY tag SEPARATOR ',') FROM segment_tags WHERE segment_tags.segment_id = segments.id), " +
+	"auto_add, auto_pct, salt, default_ttl_seconds, created_at, archived_at"
+
+func (s *MySQLStore) CountUsers() (int, error) {
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (s *MySQLStore) ListUserIDsAfter(afterID int, limit int) ([]int, error) {
+	rows, err := s.q.Query("SELECT id FROM users WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+// placeholders returns "?, ?, ..." with n placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSegment(row rowScanner) (models.Segment, error) {
+	var segment models.Segment
+	var tags sql.NullString
+	var defaultTTL sql.NullInt64
+	var archivedAt sql.NullTime
+	err := row.Scan(&segment.ID, &segment.Slug, &segment.Description, &segment.Owner, &tags, &segment.AutoAdd, &segment.AutoPct,
+		&segment.Salt, &defaultTTL, &segment.CreatedAt, &archivedAt)
+	if tags.String != "" {
+		segment.Tags = strings.Split(tags.String, ",")
+	}
+	segment.DefaultTTL = time.Duration(defaultTTL.Int64) * time.Second
+	segment.ArchivedAt = archivedAt.Time
+	return segment, err
+}
+
+// nullDuration stores a zero duration as NULL and any other one in whole seconds.
+func nullDuration(d time.Duration) interface{} {
+	if d == 0 {
+		return nil
+	}
+	return int64(d / time.Second)
+}
+
+func (s *MySQLStore) CreateSegment(segment models.Segment) (int, error) {
+	query := "INSERT INTO segments (slug, description, owner, auto_add, auto_pct, salt, default_ttl_seconds, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)"
+	result, err := s.q.Exec(query, segment.Slug, segment.Description, segment.Owner, segment.AutoAdd, segment.AutoPct, segment.Salt,
+		nullDuration(segment.DefaultTTL))
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	segmentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.insertSegmentTags(int(segmentID), segment.Tags); err != nil {
+		return 0, err
+	}
+	return int(segmentID), nil
+}
+
+func (s *MySQLStore) insertSegmentTags(segmentID int, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make([]string, len(tags))
+	args := make([]interface{}, 0, 2*len(tags))
+	for i, tag := range tags {
+		values[i] = "(?, ?)"
+		args = append(args, segmentID, tag)
+	}
+	_, err := s.q.Exec("INSERT INTO segment_tags (segment_id, tag) VALUES "+strings.Join(values, ", "), args...)
+	return err
+}
+
+func (s *MySQLStore) DeleteSegment(segmentID int) error {
+	_, err := s.q.Exec("DELETE FROM segments WHERE id = ?", segmentID)
+	return err
+}
+
+func (s *MySQLStore) ArchiveSegment(segmentID int, archivedAt time.Time) error {
+	_, err := s.q.Exec("UPDATE segments SET archived_at = ? WHERE id = ?", archivedAt, segmentID)
+	return err
+}
+
+func (s *MySQLStore) RestoreSegment(segmentID int) error {
+	_, err := s.q.Exec("UPDATE segments SET archived_at = NULL WHERE id = ?", segmentID)
+	return translateError(err)
+}
+
+// slugOrAlias matches a segment by its slug or one of its aliases. It takes the slug as two arguments.
+const slugOrAlias = "(slug = ? OR id = (SELECT segment_id FROM segment_aliases WHERE alias = ?))"
+
+func (s *MySQLStore) RenameSegment(segmentID int, slug string) error {
+	_, err := s.q.Exec("UPDATE segments SET slug = ? WHERE id = ?", slug, segmentID)
+	return translateError(err)
+}
+
+func (s *MySQLStore) GetSegmentIDBySlug(slug string) (int, error) {
+	var segmentID int
+	err := s.q.QueryRow("SELECT id FROM segments WHERE "+slugOrAlias+" AND archived_at IS NULL", slug, slug).Scan(&segmentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return segmentID, nil
+}
+
+func (s *MySQLStore) GetSegmentBySlug(slug string) (models.Segment, error) {
+	segment, err := scanSegment(s.q.QueryRow("SELECT "+segmentColumns+" FROM segments WHERE "+slugOrAlias+" AND archived_at IS NULL", slug, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Segment{}, ErrNotFound
+	}
+	return segment, err
+}
+
+func (s *MySQLStore) GetArchivedSegmentBySlug(slug string) (models.Segment, error) {
+	query := "SELECT " + segmentColumns + " FROM segments WHERE " + slugOrAlias + " AND archived_at IS NOT NULL ORDER BY archived_at DESC, id DESC LIMIT 1"
+	segment, err := scanSegment(s.q.QueryRow(query, slug, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Segment{}, ErrNotFound
+	}
+	return segment, err
+}
+
+func (s *MySQLStore) GetSegmentByID(segmentID int) (models.Segment, error) {
+	segment, err := scanSegment(s.q.QueryRow("SELECT "+segmentColumns+" FROM segments WHERE id = ?", segmentID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Segment{}, ErrNotFound
+	}
+	return segment, err
+}
+
+func (s *MySQLStore) UpdateSegmentAutoPct(segmentID int, autoPct int) error {
+	_, err := s.q.Exec("UPDATE segments SET auto_pct = ? WHERE id = ?", autoPct, segmentID)
+	return err
+}
+
+func (s *MySQLStore) UpdateSegment(segment models.Segment) error {
+	query := "UPDATE segments SET description = ?, owner = ?, auto_add = ?, auto_pct = ?, default_ttl_seconds = ? WHERE id = ?"
+	_, err := s.q.Exec(query, segment.Description, segment.Owner, segment.AutoAdd, segment.AutoPct, nullDuration(segment.DefaultTTL), segment.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.q.Exec("DELETE FROM segment_tags WHERE segment_id = ?", segment.ID); err != nil {
+		return err
+	}
+	return s.insertSegmentTags(segment.ID, segment.Tags)
+}
+
+func (s *MySQLStore) ListSegments(filter SegmentFilter) ([]models.Segment, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.SlugPrefix != "" {
+		conditions = append(conditions, `slug LIKE ? ESCAPE '\\'`)
+		args = append(args, likePrefixReplacer.Replace(filter.SlugPrefix)+"%")
+	}
+	switch filter.State {
+	case models.SegmentStateActive:
+		conditions = append(conditions, "archived_at IS NULL")
+	case models.SegmentStateArchived:
+		conditions = append(conditions, "archived_at IS NOT NULL")
+	}
+	if filter.Owner != "" {
+		conditions = append(conditions, "owner = ?")
+		args = append(args, filter.Owner)
+	}
+	if len(filter.Tags) > 0 {
+		conditions = append(conditions, "id IN (SELECT segment_id FROM segment_tags WHERE tag IN ("+placeholders(len(filter.Tags))+
+			") GROUP BY segment_id HAVING COUNT(*) = ?)")
+		for _, tag := range filter.Tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(filter.Tags))
+	}
+
+	sortColumn, direction, comparison := "slug", "ASC", ">"
+	if filter.SortBy == SegmentSortCreatedAt {
+		sortColumn = "created_at"
+	}
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if filter.After != nil {
+		conditions = append(conditions, "("+sortColumn+", id) "+comparison+" (?, ?)")
+		if filter.SortBy == SegmentSortCreatedAt {
+			args = append(args, filter.After.CreatedAt, filter.After.ID)
+		} else {
+			args = append(args, filter.After.Slug, filter.After.ID)
+		}
+	}
+
+	query := "SELECT " + segmentColumns + " FROM segments"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + sortColumn + " " + direction + ", id " + direction + " LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []models.Segment
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+// likePrefixReplacer escapes the wildcards of a LIKE pattern.
+var likePrefixReplacer = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *MySQLStore) ListAutoAddSegments() ([]models.Segment, error) {
+	query := `
+		SELECT ` + segmentColumns + `
+		FROM segments
+		WHERE auto_add = TRUE AND auto_pct > 0 AND archived_at IS NULL
+		ORDER BY id
+	`
+	rows, err := s.q.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []models.Segment
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+func (s *MySQLStore) AddMembership(userID int, segmentID int, startsAt time.Time, expiresAt time.Time, source string) error {
+	query := "INSERT INTO user_segments (user_id, segment_id, starts_at, expires_at, source) VALUES (?, ?, ?, ?, ?)"
+	_, err := s.q.Exec(query, userID, segmentID, nullTime(startsAt), nullTime(expiresAt), source)
+	return translateError(err)
+}
+
+// membershipBatchSize is the most users AddMemberships and RemoveMemberships handle in one statement.
+// The INSERT takes four placeholders per user, so -job-batch can't push it past MySQL's limit of 65535.
+const membershipBatchSize = 1000
+
+func (s *MySQLStore) AddMemberships(segmentID int, userIDs []int, expiresAt time.Time, source string) ([]int, error) {
+	var added []int
+	for start := 0; start < len(userIDs); start += membershipBatchSize {
+		chunk := userIDs[start:min(start+membershipBatchSize, len(userIDs))]
+		chunkAdded, err := s.addMemberships(segmentID, chunk, expiresAt, source)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, chunkAdded...)
+	}
+	return added, nil
+}
+
+func (s *MySQLStore) addMemberships(segmentID int, userIDs []int, expiresAt time.Time, source string) ([]int, error) {
+	args := make([]interface{}, 0, len(userIDs)+1)
+	args = append(args, segmentID)
+	for _, userID := range userIDs {
+		args = append(args, userID)
+	}
+	query := "SELECT user_id FROM user_segments WHERE segment_id = ? AND user_id IN (" + placeholders(len(userIDs)) + ") FOR UPDATE"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[userID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var added []int
+	var values []string
+	args = args[:0]
+	for _, userID := range userIDs {
+		if existing[userID] {
+			continue
+		}
+		added = append(added, userID)
+		values = append(values, "(?, ?, ?, ?)")
+		args = append(args, userID, segmentID, nullTime(expiresAt), source)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	query = "INSERT INTO user_segments (user_id, segment_id, expires_at, source) VALUES " + strings.Join(values, ", ")
+	if _, err := s.q.Exec(query, args...); err != nil {
+		return nil, translateError(err)
+	}
+	return added, nil
+}
+
+func (s *MySQLStore) RemoveMemberships(segmentID int, userIDs []int, source string) ([]int, error) {
+	var removed []int
+	for start := 0; start < len(userIDs); start += membershipBatchSize {
+		chunk := userIDs[start:min(start+membershipBatchSize, len(userIDs))]
+		chunkRemoved, err := s.removeMemberships(segmentID, chunk, source)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, chunkRemoved...)
+	}
+	return removed, nil
+}
+
+func (s *MySQLStore) removeMemberships(segmentID int, userIDs []int, source string) ([]int, error) {
+	args := make([]interface{}, 0, len(userIDs)+2)
+	args = append(args, segmentID, source)
+	for _, userID := range userIDs {
+		args = append(args, userID)
+	}
+	query := "SELECT user_id FROM user_segments WHERE segment_id = ? AND source = ? AND user_id IN (" + placeholders(len(userIDs)) + ") FOR UPDATE"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var removed []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		removed = append(removed, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	args = args[:1]
+	for _, userID := range removed {
+		args = append(args, userID)
+	}
+	query = "DELETE FROM user_segments WHERE segment_id = ? AND user_id IN (" + placeholders(len(removed)) + ")"
+	if _, err := s.q.Exec(query, args...); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *MySQLStore) GetMembership(userID int, segmentID int) (models.Membership, error) {
+	query := `
+		SELECT user_segments.user_id, segments.id, segments.slug, user_segments.source, user_segments.added_at, user_segments.starts_at, user_segments.expires_at
+		FROM segments
+		JOIN user_segments ON segments.id = user_segments.segment_id
+		WHERE user_segments.user_id = ? AND user_segments.segment_id = ?
+	`
+	membership, err := scanMembership(s.q.QueryRow(query, userID, segmentID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Membership{}, ErrNotFound
+	}
+	return membership, err
+}
+
+func (s *MySQLStore) UpdateMembershipExpiry(userID int, segmentID int, expiresAt time.Time) error {
+	query := "UPDATE user_segments SET expires_at = ? WHERE user_id = ? AND segment_id = ?"
+	_, err := s.q.Exec(query, nullTime(expiresAt), userID, segmentID)
+	return err
+}
+
+func (s *MySQLStore) UpdateMembershipStart(userID int, segmentID int, startsAt time.Time) error {
+	query := "UPDATE user_segments SET starts_at = ? WHERE user_id = ? AND segment_id = ?"
+	_, err := s.q.Exec(query, nullTime(startsAt), userID, segmentID)
+	return err
+}
+
+func (s *MySQLStore) RemoveMembership(userID int, segmentID int) error {
+	_, err := s.q.Exec("DELETE FROM user_segments WHERE user_id = ? AND segment_id = ?", userID, segmentID)
+	return err
+}
+
+func (s *MySQLStore) RemoveExpiredMembership(userID int, segmentID int, now time.Time) (bool, error) {
+	query := "DELETE FROM user_segments WHERE user_id = ? AND segment_id = ? AND expires_at IS NOT NULL AND expires_at <= ?"
+	result, err := s.q.Exec(query, userID, segmentID, now)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *MySQLStore) IsUserLinkedToSegment(userID int, segmentID int) (bool, error) {
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM user_segments WHERE user_id = ? AND segment_id = ?", userID, segmentID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// scanMembership reads the columns user_id, segment_id, slug, source, added_at, starts_at, expires_at.
+func scanMembership(row rowScanner) (models.Membership, error) {
+	var membership models.Membership
+	var startsAt, expiresAt sql.NullTime
+	err := row.Scan(&membership.UserID, &membership.SegmentID, &membership.SegmentSlug, &membership.Source, &membership.AddedAt, &startsAt, &expiresAt)
+	membership.StartsAt = startsAt.Time
+	membership.ExpiresAt = expiresAt.Time
+	return membership, err
+}
+
+func (s *MySQLStore) GetUserMemberships(userID int, now time.Time) ([]models.Membership, error) {
+	query := `
+		SELECT user_segments.user_id, segments.id, segments.slug, user_segments.source, user_segments.added_at, user_segments.starts_at, user_segments.expires_at
+		FROM segments
+		JOIN user_segments ON segments.id = user_segments.segment_id
+		WHERE user_segments.user_id = ?
+			AND segments.archived_at IS NULL
+			AND (user_segments.starts_at IS NULL OR user_segments.starts_at <= ?)
+			AND (user_segments.expires_at IS NULL OR user_segments.expires_at > ?)
+		ORDER BY segments.id
+	`
+	rows, err := s.q.Query(query, userID, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []models.Membership
+	for rows.Next() {
+		membership, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func (s *MySQLStore) CountSegmentMembers(segmentID int, now time.Time) (models.SegmentMemberCounts, error) {
+	query := `
+		SELECT
+			COALESCE(SUM(starts_at IS NULL OR starts_at <= ?), 0),
+			COALESCE(SUM((starts_at IS NULL OR starts_at <= ?) AND source = ?), 0),
+			COALESCE(SUM((starts_at IS NULL OR starts_at <= ?) AND source = ?), 0),
+			COALESCE(SUM(starts_at > ?), 0)
+		FROM user_segments
+		WHERE segment_id = ? AND (expires_at IS NULL OR expires_at > ?)
+	`
+	var counts models.SegmentMemberCounts
+	err := s.q.QueryRow(query, now, now, models.SourceManual, now, models.SourceAuto, now, segmentID, now).
+		Scan(&counts.Active, &counts.Manual, &counts.Auto, &counts.Scheduled)
+	return counts, err
+}
+
+// memberConditions turns filter into a WHERE clause over user_segments and its arguments.
+func memberConditions(filter MemberFilter) (string, []interface{}) {
+	conditions := []string{"user_segments.segment_id = ?"}
+	args := []interface{}{filter.SegmentID}
+	switch filter.Status {
+	case models.MembershipStatusActive:
+		conditions = append(conditions, "(user_segments.starts_at IS NULL OR user_segments.starts_at <= ?)",
+			"(user_segments.expires_at IS NULL OR user_segments.expires_at > ?)")
+		args = append(args, filter.Now, filter.Now)
+	case models.MembershipStatusScheduled:
+		conditions = append(conditions, "user_segments.starts_at > ?",
+			"(user_segments.expires_at IS NULL OR user_segments.expires_at > ?)")
+		args = append(args, filter.Now, filter.Now)
+	case models.MembershipStatusExpired:
+		conditions = append(conditions, "user_segments.expires_at <= ?")
+		args = append(args, filter.Now)
+	}
+	if filter.Source != "" {
+		conditions = append(conditions, "user_segments.source = ?")
+		args = append(args, filter.Source)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s *MySQLStore) ListMembers(filter MemberFilter) ([]models.Membership, error) {
+	where, args := memberConditions(filter)
+	query := `
+		SELECT user_segments.user_id, segments.id, segments.slug, user_segments.source, user_segments.added_at, user_segments.starts_at, user_segments.expires_at
+		FROM segments
+		JOIN user_segments ON segments.id = user_segments.segment_id
+		WHERE ` + where + ` AND user_segments.user_id > ?
+		ORDER BY user_segments.user_id
+		LIMIT ?
+	`
+	rows, err := s.q.Query(query, append(args, filter.AfterUserID, filter.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []models.Membership
+	for rows.Next() {
+		membership, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func (s *MySQLStore) CountMembers(filter MemberFilter) (int, error) {
+	where, args := memberConditions(filter)
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM user_segments WHERE "+where, args...).Scan(&count)
+	return count, err
+}
+
+func (s *MySQLStore) ListExpiredMemberships(now time.Time, limit int) ([]models.Membership, error) {
+	query := `
+		SELECT user_segments.user_id, user_segments.segment_id, user_segments.expires_at
+		FROM user_segments
+		JOIN segments ON segments.id = user_segments.segment_id
+		WHERE user_segments.expires_at IS NOT NULL AND user_segments.expires_at <= ? AND segments.archived_at IS NULL
+		ORDER BY user_segments.expires_at, user_segments.user_id, user_segments.segment_id
+		LIMIT ?
+	`
+	rows, err := s.q.Query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []models.Membership
+	for rows.Next() {
+		var membership models.Membership
+		if err := rows.Scan(&membership.UserID, &membership.SegmentID, &membership.ExpiresAt); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func (s *MySQLStore) ListPendingActivations(now time.Time, limit int) ([]models.Membership, error) {
+	query := `
+		SELECT user_segments.user_id, segments.id, segments.slug, user_segments.source, user_segments.added_at, user_segments.starts_at, user_segments.expires_at
+		FROM segments
+		JOIN user_segments ON segments.id = user_segments.segment_id
+		WHERE user_segments.activated_at IS NULL AND user_segments.starts_at <= ? AND segments.archived_at IS NULL
+		ORDER BY user_segments.starts_at, user_segments.user_id, user_segments.segment_id
+		LIMIT ?
+	`
+	rows, err := s.q.Query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []models.Membership
+	for rows.Next() {
+		membership, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func (s *MySQLStore) ActivateMembership(userID int, segmentID int, activatedAt time.Time) error {
+	query := "UPDATE user_segments SET activated_at = ? WHERE user_id = ? AND segment_id = ?"
+	_, err := s.q.Exec(query, activatedAt, userID, segmentID)
+	return err
+}
+
+func (s *MySQLStore) LogSegmentHistory(entry models.SegmentHistoryEntry) error {
+	return s.LogSegmentHistoryBatch(entry, []int{entry.UserID})
+}
+
+// historyInsertBatchSize is the most segment_history rows written by one INSERT statement.
+const historyInsertBatchSize = 1000
+
+func (s *MySQLStore) LogSegmentHistoryBatch(entry models.SegmentHistoryEntry, userIDs []int) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	// segment_history has no foreign key on segments, so the segment is checked here
+	var slug string
+	err := s.q.QueryRow("SELECT slug FROM segments WHERE id = ?", entry.SegmentID).Scan(&slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Rows are inserted in chunks to stay below MySQL's limit of 65535 placeholders per statement
+	for start := 0; start < len(userIDs); start += historyInsertBatchSize {
+		chunk := userIDs[start:min(start+historyInsertBatchSize, len(userIDs))]
+		values := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*8)
+		for _, userID := range chunk {
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, userID, entry.SegmentID, slug, entry.Operation, entry.Reason, entry.SegmentTime, nullTime(entry.StartsAt), nullTime(entry.ExpiresAt))
+		}
+
+		query := "INSERT INTO segment_history (user_id, segment_id, segment_slug, operation, reason, timestamp, starts_at, expires_at) VALUES " + strings.Join(values, ", ")
+		if _, err := s.q.Exec(query, args...); err != nil {
+			return translateError(err)
+		}
+	}
+	return nil
+}
+
+func (s *MySQLStore) StreamSegmentHistory(filter HistoryFilter, fn func(entry models.SegmentHistoryEntry) error) error {
+	// Comparing timestamp directly, rather than YEAR()/MONTH() of it, lets MySQL use idx_segment_history_timestamp
+	conditions := []string{"segment_history.timestamp >= ?", "segment_history.timestamp < ?"}
+	args := []interface{}{filter.From, filter.To}
+	if len(filter.UserIDs) > 0 {
+		conditions = append(conditions, "segment_history.user_id IN ("+placeholders(len(filter.UserIDs))+")")
+		for _, userID := range filter.UserIDs {
+			args = append(args, userID)
+		}
+	}
+	if len(filter.SegmentSlugs) > 0 {
+		conditions = append(conditions, "segment_history.segment_slug IN ("+placeholders(len(filter.SegmentSlugs))+")")
+		for _, slug := range filter.SegmentSlugs {
+			args = append(args, slug)
+		}
+	}
+	if len(filter.Operations) > 0 {
+		conditions = append(conditions, "segment_history.operation IN ("+placeholders(len(filter.Operations))+")")
+		for _, operation := range filter.Operations {
+			args = append(args, operation)
+		}
+	}
+
+	query := `
+		SELECT segment_history.user_id, segment_history.segment_id, segment_history.segment_slug, segment_history.operation,
+			segment_history.reason, segment_history.timestamp, segment_history.starts_at, segment_history.expires_at
+		FROM segment_history
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY segment_history.id
+	`
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry models.SegmentHistoryEntry
+		var startsAt, expiresAt sql.NullTime
+		if err := rows.Scan(&entry.UserID, &entry.SegmentID, &entry.SegmentName, &entry.Operation, &entry.Reason, &entry.SegmentTime, &startsAt, &expiresAt); err != nil {
+			return err
+		}
+		entry.StartsAt = startsAt.Time
+		entry.ExpiresAt = expiresAt.Time
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
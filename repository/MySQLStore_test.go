@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"avitoGoProject/database"
+	"context"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"os"
+	"testing"
+)
+
+// TestMySQLStore runs the store tests against the database named by MYSQL_TEST_DSN.
+// The schema is migrated up and every table is emptied before each test, so the DSN
+// must point at a database that holds nothing worth keeping.
+func TestMySQLStore(t *testing.T) {
+	dsn := os.Getenv("MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_TEST_DSN is not set")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ParseTime = true
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("migrating the test database: %v", err)
+	}
+
+	runStoreTests(t, func(t *testing.T) Store {
+		truncateTables(t, db)
+		return NewMySQLStore(db)
+	})
+}
+
+// truncateTables empties every table but schema_migrations. TRUNCATE also resets
+// AUTO_INCREMENT, so IDs start at 1 in every test like they do in a MemoryStore.
+func truncateTables(t *testing.T, db *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+	// FOREIGN_KEY_CHECKS belongs to the session, so every statement runs on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' AND table_name <> 'schema_migrations'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 1")
+	for _, table := range tables {
+		if _, err := conn.ExecContext(ctx, "TRUNCATE TABLE `"+table+"`"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
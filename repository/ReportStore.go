@@ -0,0 +1,18 @@
+package repository
+
+import (
+	"io"
+	"time"
+)
+
+// ReportStore keeps generated report files. Report names are opaque,
+// URL-safe identifiers chosen by the caller.
+type ReportStore interface {
+	// Save creates the report name from everything write writes. The report
+	// only becomes visible once write returns nil; otherwise it is discarded.
+	Save(name string, write func(w io.Writer) error) error
+	// Open returns the content and creation time of a report, or ErrNotFound.
+	Open(name string) (io.ReadSeekCloser, time.Time, error)
+	// DeleteBefore removes reports created before t and returns how many were removed.
+	DeleteBefore(t time.Time) (int, error)
+}
@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a row with the same key already exists.
+	ErrDuplicate = errors.New("already exists")
+)
+
+// UserRepository stores users.
+type UserRepository interface {
+	CreateUser() (int, error)
+	CountUsers() (int, error)
+	// ListUserIDsAfter returns up to limit user IDs greater than afterID in ascending order.
+	ListUserIDsAfter(afterID int, limit int) ([]int, error)
+}
+
+// SegmentRepository stores segments. Archived segments are only returned by
+// GetSegmentByID and GetArchivedSegmentBySlug; every other read skips them.
+// Slugs are unique among segments that aren't archived. Lookups by slug also
+// match the aliases a segment keeps after being renamed.
+type SegmentRepository interface {
+	// CreateSegment returns ErrDuplicate if a segment that isn't archived has the same slug.
+	CreateSegment(segment models.Segment) (int, error)
+	// DeleteSegment permanently removes a segment and its memberships. Its history is kept.
+	DeleteSegment(segmentID int) error
+	// ArchiveSegment hides a segment and its memberships until it is restored.
+	ArchiveSegment(segmentID int, archivedAt time.Time) error
+	// RestoreSegment returns ErrDuplicate if another segment that isn't archived has the same slug.
+	RestoreSegment(segmentID int) error
+	// RenameSegment changes a segment's slug. It returns ErrDuplicate if another segment that isn't archived has the slug.
+	RenameSegment(segmentID int, slug string) error
+	GetSegmentIDBySlug(slug string) (int, error)
+	GetSegmentBySlug(slug string) (models.Segment, error)
+	// GetArchivedSegmentBySlug returns the most recently archived segment with the slug.
+	GetArchivedSegmentBySlug(slug string) (models.Segment, error)
+	GetSegmentByID(segmentID int) (models.Segment, error)
+	UpdateSegmentAutoPct(segmentID int, autoPct int) error
+	// UpdateSegment writes the description, owner, tags, auto_add, auto_pct and default TTL of a segment.
+	UpdateSegment(segment models.Segment) error
+	// ListAutoAddSegments returns every segment with auto_add enabled and a positive auto_pct.
+	ListAutoAddSegments() ([]models.Segment, error)
+	// ListSegments returns up to filter.Limit segments matching filter, archived or not, in the requested order.
+	ListSegments(filter SegmentFilter) ([]models.Segment, error)
+}
+
+// Orders in which ListSegments can return segments. Ties are broken by ID.
+const (
+	SegmentSortSlug      = "slug"
+	SegmentSortCreatedAt = "created_at"
+)
+
+// SegmentFilter selects segments in ListSegments. Empty fields match everything.
+type SegmentFilter struct {
+	SlugPrefix string
+	State      string // models.SegmentStateActive or models.SegmentStateArchived
+	Owner      string
+	Tags       []string // Segments that have every listed tag
+	SortBy     string   // SegmentSortSlug or SegmentSortCreatedAt
+	Descending bool
+	After      *models.Segment // Keyset cursor: the last segment of the previous page
+	Limit      int
+}
+
+// MembershipRepository stores the links between users and segments.
+type MembershipRepository interface {
+	// AddMembership links a user to a segment. A zero startsAt means the membership is active
+	// immediately and a zero expiresAt means it never expires.
+	AddMembership(userID int, segmentID int, startsAt time.Time, expiresAt time.Time, source string) error
+	// AddMemberships links every listed user who is not yet a member to the segment
+	// and returns the IDs of the users that were actually added.
+	AddMemberships(segmentID int, userIDs []int, expiresAt time.Time, source string) ([]int, error)
+	// RemoveMemberships unlinks every listed user whose membership has the given source
+	// and returns the IDs of the users that were actually removed.
+	RemoveMemberships(segmentID int, userIDs []int, source string) ([]int, error)
+	GetMembership(userID int, segmentID int) (models.Membership, error)
+	// UpdateMembershipExpiry sets expires_at of a membership. A zero expiresAt means it never expires.
+	UpdateMembershipExpiry(userID int, segmentID int, expiresAt time.Time) error
+	// UpdateMembershipStart sets starts_at of a membership. A zero startsAt means it is active right away.
+	UpdateMembershipStart(userID int, segmentID int, startsAt time.Time) error
+	RemoveMembership(userID int, segmentID int) error
+	// RemoveExpiredMembership unlinks a user from a segment only if the membership's expires_at is at
+	// or before now, and reports whether it did. A membership renewed after it was listed as expired is kept.
+	RemoveExpiredMembership(userID int, segmentID int, now time.Time) (bool, error)
+	IsUserLinkedToSegment(userID int, segmentID int) (bool, error)
+	// GetUserMemberships returns the memberships of a user in segments that aren't archived
+	// that have started and not expired at now.
+	GetUserMemberships(userID int, now time.Time) ([]models.Membership, error)
+	// CountSegmentMembers counts the memberships of a segment at now. Expired ones are not counted.
+	CountSegmentMembers(segmentID int, now time.Time) (models.SegmentMemberCounts, error)
+	// ListMembers returns up to filter.Limit memberships of a segment matching filter, ordered by user ID.
+	ListMembers(filter MemberFilter) ([]models.Membership, error)
+	// CountMembers counts the memberships of a segment matching filter. AfterUserID and Limit are ignored.
+	CountMembers(filter MemberFilter) (int, error)
+	// ListExpiredMemberships returns up to limit memberships in segments that aren't archived
+	// whose expires_at is at or before now.
+	ListExpiredMemberships(now time.Time, limit int) ([]models.Membership, error)
+	// ListPendingActivations returns up to limit scheduled memberships in segments that aren't
+	// archived whose starts_at is at or before now and that have not been activated yet.
+	ListPendingActivations(now time.Time, limit int) ([]models.Membership, error)
+	// ActivateMembership marks a scheduled membership as activated.
+	ActivateMembership(userID int, segmentID int, activatedAt time.Time) error
+}
+
+// MemberFilter selects the memberships of a segment in ListMembers and CountMembers.
+// Empty fields match everything.
+type MemberFilter struct {
+	SegmentID   int
+	Status      string    // models.MembershipStatusActive, MembershipStatusScheduled or MembershipStatusExpired
+	Now         time.Time // Point in time Status is evaluated at
+	Source      string    // models.SourceManual or models.SourceAuto
+	AfterUserID int       // Keyset cursor: only users with a greater ID are returned
+	Limit       int
+}
+
+// HistoryFilter selects segment_history entries. Entries are matched on the
+// half-open interval [From, To); empty lists match everything.
+type HistoryFilter struct {
+	From         time.Time
+	To           time.Time
+	UserIDs      []int
+	SegmentSlugs []string
+	Operations   []string
+}
+
+// HistoryRepository stores the segment_history audit log.
+type HistoryRepository interface {
+	// LogSegmentHistory records entry together with the current slug of the segment. Its SegmentName is ignored.
+	LogSegmentHistory(entry models.SegmentHistoryEntry) error
+	// LogSegmentHistoryBatch records entry for each of several users at once. Its UserID is ignored.
+	LogSegmentHistoryBatch(entry models.SegmentHistoryEntry, userIDs []int) error
+	// StreamSegmentHistory calls fn for every entry matching filter in the order they were recorded,
+	// reading them from the database as it goes. It stops at the first error returned by fn.
+	StreamSegmentHistory(filter HistoryFilter, fn func(entry models.SegmentHistoryEntry) error) error
+}
+
+// SegmentAliasRepository stores the former slugs of renamed segments.
+type SegmentAliasRepository interface {
+	// AddSegmentAlias returns ErrDuplicate if the alias already belongs to a segment.
+	AddSegmentAlias(alias models.SegmentAlias) error
+	GetSegmentAlias(alias string) (models.SegmentAlias, error)
+	// ListSegmentAliases returns the aliases of a segment, oldest first.
+	ListSegmentAliases(segmentID int) ([]models.SegmentAlias, error)
+	// DeleteSegmentAlias returns ErrNotFound if the segment has no such alias.
+	DeleteSegmentAlias(segmentID int, alias string) error
+}
+
+// SegmentAuditRepository stores the segment_audit trail of changes to segment properties.
+type SegmentAuditRepository interface {
+	LogSegmentChange(entry models.SegmentAuditEntry) error
+	// ListSegmentChanges returns the changes made to a segment in the order they were recorded.
+	ListSegmentChanges(segmentID int) ([]models.SegmentAuditEntry, error)
+}
+
+// JobRepository stores background jobs.
+type JobRepository interface {
+	CreateJob(job models.Job) (int, error)
+	GetJob(jobID int) (models.Job, error)
+	// LockJob reads a job and, inside a transaction, locks it until the transaction ends.
+	LockJob(jobID int) (models.Job, error)
+	UpdateJob(job models.Job) error
+	// ListUnfinishedJobs returns pending and running jobs, oldest first.
+	ListUnfinishedJobs() ([]models.Job, error)
+	// CancelSegmentJobs cancels the pending and running jobs of a kind for a segment
+	// and returns how many were cancelled.
+	CancelSegmentJobs(segmentID int, kind string, finishedAt time.Time) (int, error)
+}
+
+// IdempotencyRepository stores responses of requests made with an Idempotency-Key.
+type IdempotencyRepository interface {
+	GetIdempotencyRecord(key string) (models.IdempotencyRecord, error)
+	// CreateIdempotencyRecord returns ErrDuplicate if the key is already stored.
+	CreateIdempotencyRecord(record models.IdempotencyRecord) error
+	UpdateIdempotencyRecord(record models.IdempotencyRecord) error
+	// RenewIdempotencyRecord moves created_at of a record that has no response yet to renewedAt,
+	// as long as it still belongs to the request with requestHash.
+	RenewIdempotencyRecord(key string, requestHash string, renewedAt time.Time) error
+	DeleteIdempotencyRecord(key string) error
+	// DeleteIdempotencyRecordsBefore removes records created before t and returns how many were removed.
+	DeleteIdempotencyRecordsBefore(t time.Time) (int, error)
+}
+
+// ReportRepository stores the state of history reports. Their content is kept in a ReportStore.
+type ReportRepository interface {
+	CreateReport(report models.Report) error
+	GetReport(reportID string) (models.Report, error)
+	// UpdateReport writes the status, rows, error and finished_at of a report.
+	UpdateReport(report models.Report) error
+	// ListPendingReports returns the reports that haven't been generated yet, oldest first.
+	ListPendingReports() ([]models.Report, error)
+	// DeleteReportsBefore removes reports created before t and returns how many were removed.
+	DeleteReportsBefore(t time.Time) (int, error)
+}
+
+// Store groups every repository behind a single backend.
+type Store interface {
+	UserRepository
+	SegmentRepository
+	MembershipRepository
+	HistoryRepository
+	SegmentAliasRepository
+	SegmentAuditRepository
+	JobRepository
+	IdempotencyRepository
+	ReportRepository
+
+	// WithinTx runs fn against a Store bound to a single transaction.
+	// The transaction is committed if fn returns nil and rolled back otherwise.
+	// Calling WithinTx on a transactional Store reuses the same transaction.
+	WithinTx(fn func(tx Store) error) error
+}
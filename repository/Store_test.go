@@ -0,0 +1,976 @@
+package repository
+
+import (
+	"avitoGoProject/models"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Whole seconds, because MySQL stores TIMESTAMP and DATETIME columns without fractions.
+var testNow = time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// storeTests describe the behaviour every Store implementation must share.
+// Each test gets a store with no rows in it.
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, store Store)
+}{
+	{"WithinTx", testWithinTx},
+	{"Users", testUsers},
+	{"Memberships", testMemberships},
+	{"HistoryUnknownUser", testHistoryUnknownUser},
+	{"GetUserMemberships", testGetUserMemberships},
+	{"ListAutoAddSegments", testListAutoAddSegments},
+	{"MembershipsBatch", testMembershipsBatch},
+	{"Jobs", testJobs},
+	{"IdempotencyRecords", testIdempotencyRecords},
+	{"ListExpiredMemberships", testListExpiredMemberships},
+	{"RemoveExpiredMembership", testRemoveExpiredMembership},
+	{"SegmentDefaultTTL", testSegmentDefaultTTL},
+	{"PendingActivations", testPendingActivations},
+	{"StreamSegmentHistory", testStreamSegmentHistory},
+	{"Reports", testReports},
+	{"DeleteSegmentKeepsHistory", testDeleteSegmentKeepsHistory},
+	{"ArchiveSegment", testArchiveSegment},
+	{"ListSegments", testListSegments},
+	{"ListMembers", testListMembers},
+	{"UniqueSegmentSlugs", testUniqueSegmentSlugs},
+	{"SegmentAliases", testSegmentAliases},
+}
+
+// runStoreTests runs storeTests against stores returned by newStore.
+func runStoreTests(t *testing.T, newStore func(t *testing.T) Store) {
+	for _, st := range storeTests {
+		t.Run(st.name, func(t *testing.T) {
+			st.test(t, newStore(t))
+		})
+	}
+}
+
+// seedStore adds users and active segments with the given slugs and returns the segment IDs by slug.
+func seedStore(t *testing.T, store Store, users int, slugs ...string) map[string]int {
+	t.Helper()
+	for i := 0; i < users; i++ {
+		if _, err := store.CreateUser(); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	segmentIDs := make(map[string]int, len(slugs))
+	for _, slug := range slugs {
+		id, err := store.CreateSegment(models.Segment{Slug: slug, Salt: slug})
+		if err != nil {
+			t.Fatalf("CreateSegment(%s) error = %v", slug, err)
+		}
+		segmentIDs[slug] = id
+	}
+	return segmentIDs
+}
+
+func membershipUserIDs(memberships []models.Membership) []int {
+	userIDs := make([]int, 0, len(memberships))
+	for _, membership := range memberships {
+		userIDs = append(userIDs, membership.UserID)
+	}
+	return userIDs
+}
+
+// streamHistory returns the entries matching filter as "user slug operation" strings.
+func streamHistory(t *testing.T, store Store, filter HistoryFilter) []string {
+	t.Helper()
+	var entries []string
+	err := store.StreamSegmentHistory(filter, func(entry models.SegmentHistoryEntry) error {
+		entries = append(entries, strconv.Itoa(entry.UserID)+" "+entry.SegmentName+" "+entry.Operation)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamSegmentHistory() error = %v", err)
+	}
+	return entries
+}
+
+func testWithinTx(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 1, "AVITO_VOICE")["AVITO_VOICE"]
+	errFail := errors.New("fail")
+	day := HistoryFilter{From: testNow.Add(-time.Hour), To: testNow.Add(time.Hour)}
+
+	addUser := func(fail bool) error {
+		return store.WithinTx(func(tx Store) error {
+			userID, err := tx.CreateUser()
+			if err != nil {
+				return err
+			}
+			if err := tx.AddMembership(userID, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+				return err
+			}
+			// Nested calls reuse the transaction, so their writes are rolled back with it
+			err = tx.WithinTx(func(tx Store) error {
+				return tx.LogSegmentHistory(models.SegmentHistoryEntry{
+					UserID: userID, SegmentID: segmentID, Operation: models.OperationAdd, SegmentTime: testNow,
+				})
+			})
+			if err != nil {
+				return err
+			}
+			if fail {
+				return errFail
+			}
+			return nil
+		})
+	}
+
+	if err := addUser(true); !errors.Is(err, errFail) {
+		t.Fatalf("WithinTx() error = %v, want the error returned by fn", err)
+	}
+	if users, _ := store.CountUsers(); users != 1 {
+		t.Errorf("CountUsers() after a rollback = %d, want 1", users)
+	}
+	if entries := streamHistory(t, store, day); len(entries) != 0 {
+		t.Errorf("history after a rollback = %q, want none", entries)
+	}
+
+	if err := addUser(false); err != nil {
+		t.Fatalf("WithinTx() error = %v", err)
+	}
+	if users, _ := store.CountUsers(); users != 2 {
+		t.Errorf("CountUsers() after a commit = %d, want 2", users)
+	}
+	userIDs, _ := store.ListUserIDsAfter(1, 10)
+	if len(userIDs) != 1 {
+		t.Fatalf("ListUserIDsAfter(1) = %v, want the committed user", userIDs)
+	}
+	if linked, _ := store.IsUserLinkedToSegment(userIDs[0], segmentID); !linked {
+		t.Errorf("IsUserLinkedToSegment() after a commit = false")
+	}
+	want := []string{strconv.Itoa(userIDs[0]) + " AVITO_VOICE add"}
+	if entries := streamHistory(t, store, day); !reflect.DeepEqual(entries, want) {
+		t.Errorf("history after a commit = %q, want %q", entries, want)
+	}
+}
+
+func testUsers(t *testing.T, store Store) {
+	seedStore(t, store, 5)
+
+	if count, err := store.CountUsers(); err != nil || count != 5 {
+		t.Errorf("CountUsers() = %d, %v, want 5", count, err)
+	}
+	pages := map[int][]int{0: {1, 2}, 2: {3, 4}, 4: {5}, 5: nil}
+	for afterID, want := range pages {
+		got, err := store.ListUserIDsAfter(afterID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("ListUserIDsAfter(%d, 2) = %v, want %v", afterID, got, want)
+		}
+	}
+}
+
+func testMemberships(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 2, "AVITO_VOICE")["AVITO_VOICE"]
+	expiresAt := testNow.Add(24 * time.Hour)
+
+	if err := store.AddMembership(1, segmentID, time.Time{}, expiresAt, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddMembership(1, segmentID, time.Time{}, time.Time{}, models.SourceManual); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddMembership() twice error = %v, want ErrDuplicate", err)
+	}
+	if err := store.AddMembership(3, segmentID, time.Time{}, time.Time{}, models.SourceManual); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddMembership() for an unknown user error = %v, want ErrNotFound", err)
+	}
+	if err := store.AddMembership(1, segmentID+1, time.Time{}, time.Time{}, models.SourceManual); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddMembership() to an unknown segment error = %v, want ErrNotFound", err)
+	}
+
+	membership, err := store.GetMembership(1, segmentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if membership.SegmentSlug != "AVITO_VOICE" || membership.Source != models.SourceManual || !membership.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("GetMembership() = %+v", membership)
+	}
+	if _, err := store.GetMembership(2, segmentID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetMembership() of a user who isn't a member error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.UpdateMembershipExpiry(1, segmentID, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if membership, _ := store.GetMembership(1, segmentID); !membership.ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt after clearing it = %v, want zero", membership.ExpiresAt)
+	}
+
+	for _, startsAt := range []time.Time{testNow.Add(time.Hour), {}} {
+		if err := store.UpdateMembershipStart(1, segmentID, startsAt); err != nil {
+			t.Fatal(err)
+		}
+		if membership, _ := store.GetMembership(1, segmentID); !membership.StartsAt.Equal(startsAt) {
+			t.Errorf("StartsAt after setting it to %v = %v", startsAt, membership.StartsAt)
+		}
+	}
+
+	if err := store.RemoveMembership(1, segmentID); err != nil {
+		t.Fatal(err)
+	}
+	if linked, _ := store.IsUserLinkedToSegment(1, segmentID); linked {
+		t.Errorf("IsUserLinkedToSegment() after RemoveMembership() = true")
+	}
+}
+
+func testHistoryUnknownUser(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 1, "AVITO_VOICE")["AVITO_VOICE"]
+	entry := models.SegmentHistoryEntry{UserID: 2, SegmentID: segmentID, Operation: models.OperationAdd, SegmentTime: testNow}
+	if err := store.LogSegmentHistory(entry); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LogSegmentHistory() for an unknown user error = %v, want ErrNotFound", err)
+	}
+	entry.UserID, entry.SegmentID = 1, segmentID+1
+	if err := store.LogSegmentHistory(entry); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LogSegmentHistory() for an unknown segment error = %v, want ErrNotFound", err)
+	}
+}
+
+func testListExpiredMemberships(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 3, "AVITO_VOICE", "AVITO_ARCHIVED")
+	voiceID, archivedID := segmentIDs["AVITO_VOICE"], segmentIDs["AVITO_ARCHIVED"]
+	memberships := []struct {
+		userID, segmentID int
+		expiresAt         time.Time
+	}{
+		{userID: 1, segmentID: voiceID, expiresAt: testNow.Add(-time.Minute)},
+		{userID: 2, segmentID: voiceID, expiresAt: testNow.Add(-time.Hour)},
+		{userID: 3, segmentID: voiceID, expiresAt: testNow},
+		{userID: 1, segmentID: archivedID, expiresAt: testNow.Add(-time.Hour)},
+		{userID: 2, segmentID: archivedID, expiresAt: time.Time{}},
+		{userID: 3, segmentID: archivedID, expiresAt: testNow.Add(time.Hour)},
+	}
+	for _, m := range memberships {
+		if err := store.AddMembership(m.userID, m.segmentID, time.Time{}, m.expiresAt, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.ArchiveSegment(archivedID, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	// Oldest expiry first, and memberships of archived segments are left alone
+	for limit, want := range map[int][]int{10: {2, 1, 3}, 2: {2, 1}} {
+		got, err := store.ListExpiredMemberships(testNow, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userIDs := membershipUserIDs(got); !reflect.DeepEqual(userIDs, want) {
+			t.Errorf("ListExpiredMemberships(%d) = %v, want %v", limit, userIDs, want)
+		}
+		for _, membership := range got {
+			if membership.SegmentID != voiceID {
+				t.Errorf("ListExpiredMemberships() returned a membership of archived segment %d", membership.SegmentID)
+			}
+		}
+	}
+}
+
+func testRemoveExpiredMembership(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 3, "AVITO_VOICE")["AVITO_VOICE"]
+	for userID, expiresAt := range map[int]time.Time{1: testNow, 2: testNow.Add(time.Second), 3: {}} {
+		if err := store.AddMembership(userID, segmentID, time.Time{}, expiresAt, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		userID  int
+		removed bool
+	}{
+		{userID: 1, removed: true},  // expires exactly now
+		{userID: 2, removed: false}, // expires later
+		{userID: 3, removed: false}, // never expires
+		{userID: 1, removed: false}, // already removed
+	}
+	for _, tt := range tests {
+		removed, err := store.RemoveExpiredMembership(tt.userID, segmentID, testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != tt.removed {
+			t.Errorf("RemoveExpiredMembership(%d) = %v, want %v", tt.userID, removed, tt.removed)
+		}
+	}
+	for userID, want := range map[int]bool{1: false, 2: true, 3: true} {
+		if linked, _ := store.IsUserLinkedToSegment(userID, segmentID); linked != want {
+			t.Errorf("IsUserLinkedToSegment(%d) = %v, want %v", userID, linked, want)
+		}
+	}
+}
+
+func testGetUserMemberships(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 2, "AVITO_VOICE", "AVITO_DISCOUNT", "AVITO_EXPIRED", "AVITO_ARCHIVED")
+	memberships := map[string]time.Time{
+		"AVITO_VOICE":    testNow.Add(time.Second),
+		"AVITO_DISCOUNT": {},
+		"AVITO_EXPIRED":  testNow,
+		"AVITO_ARCHIVED": {},
+	}
+	for slug, expiresAt := range memberships {
+		if err := store.AddMembership(1, segmentIDs[slug], time.Time{}, expiresAt, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddMembership(2, segmentIDs["AVITO_VOICE"], time.Time{}, time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ArchiveSegment(segmentIDs["AVITO_ARCHIVED"], testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetUserMemberships(1, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slugs := make(map[string]time.Time, len(got))
+	for _, membership := range got {
+		if membership.UserID != 1 || membership.AddedAt.IsZero() {
+			t.Errorf("GetUserMemberships() returned %+v", membership)
+		}
+		slugs[membership.SegmentSlug] = membership.ExpiresAt
+	}
+	want := map[string]time.Time{"AVITO_VOICE": testNow.Add(time.Second), "AVITO_DISCOUNT": {}}
+	if len(slugs) != len(want) {
+		t.Fatalf("GetUserMemberships() = %v, want %v", slugs, want)
+	}
+	for slug, expiresAt := range want {
+		if got, ok := slugs[slug]; !ok || !got.Equal(expiresAt) {
+			t.Errorf("GetUserMemberships() %s expires at %v, want %v", slug, got, expiresAt)
+		}
+	}
+}
+
+func testListAutoAddSegments(t *testing.T, store Store) {
+	segments := []models.Segment{
+		{Slug: "AVITO_EVERYONE", AutoAdd: true, AutoPct: 100},
+		{Slug: "AVITO_MANUAL", AutoPct: 100},
+		{Slug: "AVITO_NOBODY", AutoAdd: true},
+		{Slug: "AVITO_HALF", AutoAdd: true, AutoPct: 50},
+		{Slug: "AVITO_ARCHIVED", AutoAdd: true, AutoPct: 100},
+	}
+	for _, segment := range segments {
+		if _, err := store.CreateSegment(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.ArchiveSegment(5, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.ListAutoAddSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slugs []string
+	for _, segment := range got {
+		slugs = append(slugs, segment.Slug)
+	}
+	if want := []string{"AVITO_EVERYONE", "AVITO_HALF"}; !reflect.DeepEqual(slugs, want) {
+		t.Errorf("ListAutoAddSegments() = %v, want %v", slugs, want)
+	}
+}
+
+func testMembershipsBatch(t *testing.T, store Store) {
+	// More users than fit in one statement
+	users := 2*membershipBatchSize + 100
+	segmentID := seedStore(t, store, users, "AVITO_VOICE")["AVITO_VOICE"]
+	if err := store.AddMembership(1, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+
+	userIDs := make([]int, 0, users)
+	for userID := 1; userID <= users; userID++ {
+		userIDs = append(userIDs, userID)
+	}
+	added, err := store.AddMemberships(segmentID, userIDs, time.Time{}, models.SourceAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != users-1 || added[0] != 2 || added[len(added)-1] != users {
+		t.Errorf("AddMemberships() added %d users from %v, want every user but the member", len(added), added[:1])
+	}
+	if count, _ := store.CountMembers(MemberFilter{SegmentID: segmentID, Now: testNow}); count != users {
+		t.Errorf("CountMembers() = %d, want %d", count, users)
+	}
+	if added, err := store.AddMemberships(segmentID, userIDs[:10], time.Time{}, models.SourceAuto); err != nil || len(added) != 0 {
+		t.Errorf("AddMemberships() of members = %v, %v, want none added", added, err)
+	}
+
+	removed, err := store.RemoveMemberships(segmentID, userIDs, models.SourceAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != users-1 {
+		t.Errorf("RemoveMemberships() removed %d users, want every auto member (%d)", len(removed), users-1)
+	}
+	members, err := store.ListMembers(MemberFilter{SegmentID: segmentID, Now: testNow, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userIDs := membershipUserIDs(members); !reflect.DeepEqual(userIDs, []int{1}) {
+		t.Errorf("members after RemoveMemberships() = %v, want only the manual member", userIDs)
+	}
+}
+
+func testJobs(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 0, "AVITO_VOICE", "AVITO_DISCOUNT")
+	voiceID, discountID := segmentIDs["AVITO_VOICE"], segmentIDs["AVITO_DISCOUNT"]
+	jobs := []models.Job{
+		{Kind: models.JobKindAutoAdd, SegmentID: voiceID, Status: models.JobStatusPending},
+		{Kind: models.JobKindAutoAdd, SegmentID: voiceID, Status: models.JobStatusRunning},
+		{Kind: models.JobKindAutoAdd, SegmentID: voiceID, Status: models.JobStatusCompleted},
+		{Kind: models.JobKindRebalance, SegmentID: voiceID, Status: models.JobStatusPending, FromPct: 10, ToPct: 30},
+		{Kind: models.JobKindAutoAdd, SegmentID: discountID, Status: models.JobStatusPending},
+	}
+	for i, job := range jobs {
+		id, err := store.CreateJob(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != i+1 {
+			t.Errorf("CreateJob() = %d, want %d", id, i+1)
+		}
+	}
+	if _, err := store.GetJob(len(jobs) + 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetJob() of an unknown job error = %v, want ErrNotFound", err)
+	}
+
+	// Progress is written back and read again
+	err := store.WithinTx(func(tx Store) error {
+		job, err := tx.LockJob(4)
+		if err != nil {
+			return err
+		}
+		job.Total, job.Processed, job.Added, job.Removed, job.CursorUserID = 100, 40, 3, 2, 40
+		job.Error = "interrupted"
+		return tx.UpdateJob(job)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.GetJob(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Processed != 40 || job.Added != 3 || job.Removed != 2 || job.CursorUserID != 40 || job.Error != "interrupted" ||
+		job.FromPct != 10 || job.ToPct != 30 || !job.FinishedAt.IsZero() {
+		t.Errorf("GetJob() after UpdateJob() = %+v", job)
+	}
+
+	cancelled, err := store.CancelSegmentJobs(voiceID, models.JobKindAutoAdd, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled != 2 {
+		t.Errorf("CancelSegmentJobs() = %d, want 2", cancelled)
+	}
+	want := []string{
+		models.JobStatusCancelled,
+		models.JobStatusCancelled,
+		models.JobStatusCompleted,
+		models.JobStatusPending,
+		models.JobStatusPending,
+	}
+	for i, status := range want {
+		job, err := store.GetJob(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != status {
+			t.Errorf("job %d status = %s, want %s", job.ID, job.Status, status)
+		}
+		if status == models.JobStatusCancelled && !job.FinishedAt.Equal(testNow) {
+			t.Errorf("job %d finished_at = %v, want %v", job.ID, job.FinishedAt, testNow)
+		}
+	}
+	unfinished, _ := store.ListUnfinishedJobs()
+	if len(unfinished) != 2 || unfinished[0].ID != 4 || unfinished[1].ID != 5 {
+		t.Errorf("ListUnfinishedJobs() = %+v, want jobs 4 and 5", unfinished)
+	}
+}
+
+func testIdempotencyRecords(t *testing.T, store Store) {
+	for i, key := range []string{"old", "pending", "done"} {
+		record := models.IdempotencyRecord{Key: key, RequestHash: "hash-" + key, CreatedAt: testNow.Add(time.Duration(i-1) * time.Hour)}
+		if err := store.CreateIdempotencyRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CreateIdempotencyRecord(models.IdempotencyRecord{Key: "done", RequestHash: "other", CreatedAt: testNow}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("CreateIdempotencyRecord() of a stored key error = %v, want ErrDuplicate", err)
+	}
+
+	response := models.IdempotencyRecord{Key: "done", StatusCode: 201, ContentType: "application/json", Body: []byte(`{"ok":true}`)}
+	if err := store.UpdateIdempotencyRecord(response); err != nil {
+		t.Fatal(err)
+	}
+	record, err := store.GetIdempotencyRecord("done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RequestHash != "hash-done" || record.StatusCode != 201 || record.ContentType != "application/json" ||
+		string(record.Body) != `{"ok":true}` || !record.CreatedAt.Equal(testNow.Add(time.Hour)) {
+		t.Errorf("GetIdempotencyRecord() = %+v", record)
+	}
+
+	// Only a record still waiting for its response, and only for the same request, is renewed
+	renewedAt := testNow.Add(2 * time.Hour)
+	renewals := []struct{ key, hash string }{{"pending", "hash-pending"}, {"old", "hash-other"}, {"done", "hash-done"}}
+	for _, renewal := range renewals {
+		if err := store.RenewIdempotencyRecord(renewal.key, renewal.hash, renewedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, want := range map[string]time.Time{"pending": renewedAt, "old": testNow.Add(-time.Hour), "done": testNow.Add(time.Hour)} {
+		if record, _ := store.GetIdempotencyRecord(key); !record.CreatedAt.Equal(want) {
+			t.Errorf("%s created_at = %v, want %v", key, record.CreatedAt, want)
+		}
+	}
+
+	deleted, err := store.DeleteIdempotencyRecordsBefore(testNow)
+	if err != nil || deleted != 1 {
+		t.Errorf("DeleteIdempotencyRecordsBefore() = %d, %v, want 1", deleted, err)
+	}
+	if err := store.DeleteIdempotencyRecord("done"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]error{"old": ErrNotFound, "done": ErrNotFound, "pending": nil} {
+		if _, err := store.GetIdempotencyRecord(key); !errors.Is(err, want) {
+			t.Errorf("GetIdempotencyRecord(%s) error = %v, want %v", key, err, want)
+		}
+	}
+}
+
+func testSegmentDefaultTTL(t *testing.T, store Store) {
+	segmentID, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE", Salt: "AVITO_VOICE", DefaultTTL: 72 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err := store.GetSegmentBySlug("AVITO_VOICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.ID != segmentID || segment.DefaultTTL != 72*time.Hour {
+		t.Errorf("GetSegmentBySlug() = %+v, want default TTL 72h", segment)
+	}
+
+	segment.DefaultTTL = 0
+	if err := store.UpdateSegment(segment); err != nil {
+		t.Fatal(err)
+	}
+	if segment, _ := store.GetSegmentBySlug("AVITO_VOICE"); segment.DefaultTTL != 0 {
+		t.Errorf("DefaultTTL after clearing it = %v, want 0", segment.DefaultTTL)
+	}
+}
+
+func testPendingActivations(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 3, "AVITO_VOICE", "AVITO_ARCHIVED")
+	segmentID := segmentIDs["AVITO_VOICE"]
+	for userID, startsAt := range map[int]time.Time{1: testNow.Add(-time.Minute), 2: testNow.Add(time.Minute), 3: {}} {
+		if err := store.AddMembership(userID, segmentID, startsAt, time.Time{}, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddMembership(1, segmentIDs["AVITO_ARCHIVED"], testNow.Add(-time.Minute), time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ArchiveSegment(segmentIDs["AVITO_ARCHIVED"], testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := store.ListPendingActivations(testNow, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userIDs := membershipUserIDs(pending); !reflect.DeepEqual(userIDs, []int{1}) || pending[0].SegmentID != segmentID {
+		t.Fatalf("ListPendingActivations() = %+v, want user 1 in AVITO_VOICE", pending)
+	}
+
+	if err := store.ActivateMembership(1, segmentID, testNow); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = store.ListPendingActivations(testNow.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userIDs := membershipUserIDs(pending); !reflect.DeepEqual(userIDs, []int{2}) {
+		t.Errorf("ListPendingActivations() after activation = %v, want [2]", userIDs)
+	}
+}
+
+func testStreamSegmentHistory(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 2, "AVITO_VOICE", "AVITO_DISCOUNT")
+	entries := []models.SegmentHistoryEntry{
+		{UserID: 1, SegmentID: segmentIDs["AVITO_VOICE"], Operation: models.OperationAdd, SegmentTime: testNow},
+		{UserID: 2, SegmentID: segmentIDs["AVITO_DISCOUNT"], Operation: models.OperationAdd, SegmentTime: testNow.Add(time.Hour)},
+		{UserID: 1, SegmentID: segmentIDs["AVITO_VOICE"], Operation: models.OperationRemove, SegmentTime: testNow.Add(2 * time.Hour)},
+	}
+	for _, entry := range entries {
+		if err := store.LogSegmentHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	period := HistoryFilter{From: testNow, To: testNow.Add(3 * time.Hour)}
+	withUsers, withSlugs, withOperations := period, period, period
+	withUsers.UserIDs = []int{2}
+	withSlugs.SegmentSlugs = []string{"AVITO_VOICE"}
+	withOperations.Operations = []string{models.OperationRemove, models.OperationExpire}
+
+	tests := []struct {
+		name   string
+		filter HistoryFilter
+		want   []string
+	}{
+		{name: "whole period", filter: period, want: []string{"1 AVITO_VOICE add", "2 AVITO_DISCOUNT add", "1 AVITO_VOICE remove"}},
+		{name: "to is exclusive", filter: HistoryFilter{From: testNow, To: testNow.Add(time.Hour)}, want: []string{"1 AVITO_VOICE add"}},
+		{name: "from is inclusive", filter: HistoryFilter{From: testNow.Add(time.Hour), To: testNow.Add(3 * time.Hour)}, want: []string{"2 AVITO_DISCOUNT add", "1 AVITO_VOICE remove"}},
+		{name: "users", filter: withUsers, want: []string{"2 AVITO_DISCOUNT add"}},
+		{name: "slugs", filter: withSlugs, want: []string{"1 AVITO_VOICE add", "1 AVITO_VOICE remove"}},
+		{name: "operations", filter: withOperations, want: []string{"1 AVITO_VOICE remove"}},
+		{name: "empty period", filter: HistoryFilter{From: testNow.Add(-time.Hour), To: testNow}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamHistory(t, store, tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StreamSegmentHistory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func testReports(t *testing.T, store Store) {
+	for i, id := range []string{"new.csv", "old.json", "older.csv"} {
+		report := models.Report{ID: id, Format: "csv", Status: models.ReportStatusPending, Filter: []byte(`{}`), CreatedAt: testNow.Add(-time.Duration(i) * time.Hour)}
+		if err := store.CreateReport(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CreateReport(models.Report{ID: "new.csv", Status: models.ReportStatusPending, CreatedAt: testNow}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("CreateReport() twice error = %v, want ErrDuplicate", err)
+	}
+
+	finished := models.Report{ID: "old.json", Status: models.ReportStatusFailed, Error: "disk full", FinishedAt: testNow}
+	if err := store.UpdateReport(finished); err != nil {
+		t.Fatal(err)
+	}
+	report, err := store.GetReport("old.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != models.ReportStatusFailed || report.Error != "disk full" || !report.FinishedAt.Equal(testNow) || string(report.Filter) != `{}` {
+		t.Errorf("GetReport() after UpdateReport() = %+v", report)
+	}
+	if _, err := store.GetReport("missing.csv"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetReport() of an unknown report error = %v, want ErrNotFound", err)
+	}
+
+	pending, err := store.ListPendingReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, report := range pending {
+		ids = append(ids, report.ID)
+	}
+	if want := []string{"older.csv", "new.csv"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListPendingReports() = %v, want oldest first %v", ids, want)
+	}
+
+	deleted, err := store.DeleteReportsBefore(testNow.Add(-30 * time.Minute))
+	if err != nil || deleted != 2 {
+		t.Errorf("DeleteReportsBefore() = %d, %v, want 2", deleted, err)
+	}
+	if _, err := store.GetReport("new.csv"); err != nil {
+		t.Errorf("GetReport() of a kept report error = %v", err)
+	}
+}
+
+func testDeleteSegmentKeepsHistory(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 1, "AVITO_VOICE", "AVITO_DISCOUNT")
+	for _, segmentID := range segmentIDs {
+		if err := store.AddMembership(1, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+		entry := models.SegmentHistoryEntry{UserID: 1, SegmentID: segmentID, Operation: models.OperationAdd, SegmentTime: testNow}
+		if err := store.LogSegmentHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.DeleteSegment(segmentIDs["AVITO_VOICE"]); err != nil {
+		t.Fatal(err)
+	}
+	if linked, _ := store.IsUserLinkedToSegment(1, segmentIDs["AVITO_VOICE"]); linked {
+		t.Error("a membership of a deleted segment is still linked")
+	}
+	if _, err := store.GetSegmentBySlug("AVITO_VOICE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSegmentBySlug() of a deleted segment error = %v, want ErrNotFound", err)
+	}
+	// History rows keep the slug the segment had, so they can still be filtered by it
+	day := HistoryFilter{From: testNow.Add(-time.Hour), To: testNow.Add(time.Hour)}
+	if got, want := streamHistory(t, store, day), []string{"1 AVITO_VOICE add", "1 AVITO_DISCOUNT add"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamSegmentHistory() after delete = %q, want %q", got, want)
+	}
+	day.SegmentSlugs = []string{"AVITO_VOICE"}
+	if got, want := streamHistory(t, store, day), []string{"1 AVITO_VOICE add"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamSegmentHistory() of the deleted slug = %q, want %q", got, want)
+	}
+}
+
+func testArchiveSegment(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 1, "AVITO_VOICE")["AVITO_VOICE"]
+	if err := store.AddMembership(1, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ArchiveSegment(segmentID, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetSegmentBySlug("AVITO_VOICE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSegmentBySlug() of an archived segment error = %v, want ErrNotFound", err)
+	}
+	archived, err := store.GetArchivedSegmentBySlug("AVITO_VOICE")
+	if err != nil || archived.ID != segmentID || !archived.ArchivedAt.Equal(testNow) {
+		t.Errorf("GetArchivedSegmentBySlug() = %+v, %v, want the segment archived at %v", archived, err, testNow)
+	}
+	if memberships, _ := store.GetUserMemberships(1, testNow); len(memberships) != 0 {
+		t.Errorf("GetUserMemberships() = %+v, want the archived segment hidden", memberships)
+	}
+
+	// The slug is free while the segment is archived, and restoring over it fails
+	newID, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE", Salt: "AVITO_VOICE"})
+	if err != nil {
+		t.Fatalf("CreateSegment() with an archived slug error = %v", err)
+	}
+	if err := store.RestoreSegment(segmentID); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("RestoreSegment() over a taken slug error = %v, want ErrDuplicate", err)
+	}
+	if err := store.DeleteSegment(newID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RestoreSegment(segmentID); err != nil {
+		t.Fatal(err)
+	}
+	segment, err := store.GetSegmentBySlug("AVITO_VOICE")
+	if err != nil || segment.ID != segmentID || !segment.ArchivedAt.IsZero() {
+		t.Errorf("GetSegmentBySlug() after restore = %+v, %v", segment, err)
+	}
+	if memberships, _ := store.GetUserMemberships(1, testNow); len(memberships) != 1 {
+		t.Errorf("GetUserMemberships() after restore = %+v, want the membership back", memberships)
+	}
+}
+
+func testListSegments(t *testing.T, store Store) {
+	segments := []models.Segment{
+		{Slug: "AVITO_B", Owner: "ads", Tags: []string{"mobile", "beta"}},
+		{Slug: "AVITO_A", Owner: "ads", Tags: []string{"mobile"}},
+		{Slug: "OTHER_C", Owner: "search"},
+		{Slug: "AVITO_D", Owner: "search", Tags: []string{"beta"}},
+	}
+	segmentIDs := make(map[string]int, len(segments))
+	for _, segment := range segments {
+		id, err := store.CreateSegment(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segmentIDs[segment.Slug] = id
+	}
+	if err := store.ArchiveSegment(segmentIDs["AVITO_D"], testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter SegmentFilter
+		want   []string
+	}{
+		{name: "all by slug", filter: SegmentFilter{Limit: 10}, want: []string{"AVITO_A", "AVITO_B", "AVITO_D", "OTHER_C"}},
+		{name: "descending", filter: SegmentFilter{Descending: true, Limit: 10}, want: []string{"OTHER_C", "AVITO_D", "AVITO_B", "AVITO_A"}},
+		{name: "slug prefix", filter: SegmentFilter{SlugPrefix: "AVITO_", Limit: 10}, want: []string{"AVITO_A", "AVITO_B", "AVITO_D"}},
+		{name: "active", filter: SegmentFilter{State: models.SegmentStateActive, Limit: 10}, want: []string{"AVITO_A", "AVITO_B", "OTHER_C"}},
+		{name: "archived", filter: SegmentFilter{State: models.SegmentStateArchived, Limit: 10}, want: []string{"AVITO_D"}},
+		{name: "owner", filter: SegmentFilter{Owner: "search", Limit: 10}, want: []string{"AVITO_D", "OTHER_C"}},
+		{name: "every tag", filter: SegmentFilter{Tags: []string{"mobile", "beta"}, Limit: 10}, want: []string{"AVITO_B"}},
+		{name: "limit", filter: SegmentFilter{Limit: 2}, want: []string{"AVITO_A", "AVITO_B"}},
+		{name: "after", filter: SegmentFilter{After: &models.Segment{Slug: "AVITO_B"}, Limit: 10}, want: []string{"AVITO_D", "OTHER_C"}},
+		{name: "created_at", filter: SegmentFilter{SortBy: SegmentSortCreatedAt, After: &models.Segment{Slug: "AVITO_B"}, Limit: 2}, want: []string{"AVITO_A", "OTHER_C"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.After != nil {
+				// created_at ties with other segments are broken by ID, so the cursor needs the stored value
+				segment, err := store.GetSegmentByID(segmentIDs[tt.filter.After.Slug])
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.filter.After = &segment
+			}
+			got, err := store.ListSegments(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slugs := make([]string, 0, len(got))
+			for _, segment := range got {
+				slugs = append(slugs, segment.Slug)
+			}
+			if !reflect.DeepEqual(slugs, tt.want) {
+				t.Errorf("ListSegments() = %v, want %v", slugs, tt.want)
+			}
+		})
+	}
+}
+
+func testListMembers(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 6, "AVITO_VOICE")
+	segmentID := segmentIDs["AVITO_VOICE"]
+	memberships := []struct {
+		userID    int
+		startsAt  time.Time
+		expiresAt time.Time
+		source    string
+	}{
+		{userID: 1, source: models.SourceManual},
+		{userID: 2, source: models.SourceAuto},
+		{userID: 3, expiresAt: testNow.Add(-time.Minute), source: models.SourceManual},
+		{userID: 4, startsAt: testNow.Add(time.Hour), source: models.SourceManual},
+		{userID: 6, expiresAt: testNow.Add(time.Hour), source: models.SourceAuto},
+	}
+	for _, m := range memberships {
+		if err := store.AddMembership(m.userID, segmentID, m.startsAt, m.expiresAt, m.source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filter    MemberFilter
+		want      []int
+		wantCount int
+	}{
+		{name: "all", filter: MemberFilter{Limit: 10}, want: []int{1, 2, 3, 4, 6}, wantCount: 5},
+		{name: "first page", filter: MemberFilter{Limit: 2}, want: []int{1, 2}, wantCount: 5},
+		{name: "next page", filter: MemberFilter{AfterUserID: 2, Limit: 2}, want: []int{3, 4}, wantCount: 5},
+		{name: "last page", filter: MemberFilter{AfterUserID: 4, Limit: 2}, want: []int{6}, wantCount: 5},
+		{name: "active", filter: MemberFilter{Status: models.MembershipStatusActive, Limit: 10}, want: []int{1, 2, 6}, wantCount: 3},
+		{name: "scheduled", filter: MemberFilter{Status: models.MembershipStatusScheduled, Limit: 10}, want: []int{4}, wantCount: 1},
+		{name: "expired", filter: MemberFilter{Status: models.MembershipStatusExpired, Limit: 10}, want: []int{3}, wantCount: 1},
+		{name: "source", filter: MemberFilter{Source: models.SourceAuto, Limit: 10}, want: []int{2, 6}, wantCount: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.SegmentID = segmentID
+			tt.filter.Now = testNow
+			got, err := store.ListMembers(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userIDs := membershipUserIDs(got); !reflect.DeepEqual(userIDs, tt.want) {
+				t.Errorf("ListMembers() = %v, want %v", userIDs, tt.want)
+			}
+
+			// CountMembers ignores the cursor and the limit
+			count, err := store.CountMembers(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantCount {
+				t.Errorf("CountMembers() = %d, want %d", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func testUniqueSegmentSlugs(t *testing.T, store Store) {
+	segmentID := seedStore(t, store, 0, "AVITO_VOICE")["AVITO_VOICE"]
+	if _, err := store.CreateSegment(models.Segment{Slug: "AVITO_VOICE", Salt: "AVITO_VOICE"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("CreateSegment() with a taken slug error = %v, want ErrDuplicate", err)
+	}
+
+	// Only one of several concurrent inserts of a new slug wins
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.CreateSegment(models.Segment{Slug: "AVITO_DISCOUNT", Salt: "AVITO_DISCOUNT"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrDuplicate):
+			t.Errorf("concurrent CreateSegment() error = %v, want ErrDuplicate", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent CreateSegment() calls succeeded, want 1", created)
+	}
+
+	if id, err := store.GetSegmentIDBySlug("AVITO_VOICE"); err != nil || id != segmentID {
+		t.Errorf("GetSegmentIDBySlug() = %d, %v, want %d", id, err, segmentID)
+	}
+}
+
+func testSegmentAliases(t *testing.T, store Store) {
+	segmentIDs := seedStore(t, store, 1, "AVITO_VOICE", "AVITO_DISCOUNT")
+	voiceID := segmentIDs["AVITO_VOICE"]
+	if err := store.AddMembership(1, voiceID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LogSegmentHistory(models.SegmentHistoryEntry{
+		UserID: 1, SegmentID: voiceID, SegmentName: "AVITO_VOICE", Operation: models.OperationAdd, SegmentTime: testNow,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming keeps the old slug resolving through an alias
+	if err := store.RenameSegment(voiceID, "AVITO_VOICE_MESSAGES"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSegmentAlias(models.SegmentAlias{Alias: "AVITO_VOICE", SegmentID: voiceID, CreatedAt: testNow}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSegmentAlias(models.SegmentAlias{Alias: "AVITO_VOICE", SegmentID: segmentIDs["AVITO_DISCOUNT"], CreatedAt: testNow}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddSegmentAlias() of a taken alias error = %v, want ErrDuplicate", err)
+	}
+	for _, slug := range []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES"} {
+		segment, err := store.GetSegmentBySlug(slug)
+		if err != nil || segment.ID != voiceID || segment.Slug != "AVITO_VOICE_MESSAGES" {
+			t.Errorf("GetSegmentBySlug(%s) = %+v, %v, want segment %d", slug, segment, err, voiceID)
+		}
+	}
+
+	// History keeps the slug the segment had at the time; the slugs in a filter match that recorded slug
+	got := streamHistory(t, store, HistoryFilter{To: testNow.Add(time.Hour), SegmentSlugs: []string{"AVITO_VOICE"}})
+	if want := []string{"1 AVITO_VOICE add"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamSegmentHistory() after a rename = %q, want %q", got, want)
+	}
+
+	if err := store.DeleteSegmentAlias(voiceID, "AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSegmentIDBySlug("AVITO_VOICE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSegmentIDBySlug() of a removed alias error = %v, want ErrNotFound", err)
+	}
+	if err := store.DeleteSegmentAlias(voiceID, "AVITO_VOICE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteSegmentAlias() twice error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"log"
+	"time"
+)
+
+// ActivationScheduler periodically activates scheduled memberships whose
+// starts_at has passed and records an "activate" operation in segment_history
+// for each of them. Memberships are hidden from GetUserSegments until they
+// start regardless of when the scheduler runs; it only records the event.
+type ActivationScheduler struct {
+	store     repository.Store
+	interval  time.Duration
+	batchSize int
+	now       Clock
+}
+
+func NewActivationScheduler(store repository.Store, interval time.Duration, batchSize int) *ActivationScheduler {
+	return &ActivationScheduler{
+		store:     store,
+		interval:  interval,
+		batchSize: batchSize,
+		now:       time.Now,
+	}
+}
+
+// Run activates memberships once per interval until ctx is cancelled.
+func (a *ActivationScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		activated, err := a.Activate(ctx)
+		if err != nil {
+			log.Printf("activation scheduler: %v", err)
+		} else if activated > 0 {
+			log.Printf("activation scheduler: activated %d scheduled memberships", activated)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Activate activates every membership that has started at the current time,
+// one batch per transaction, and returns the number of memberships activated.
+func (a *ActivationScheduler) Activate(ctx context.Context) (int, error) {
+	activated := 0
+	for ctx.Err() == nil {
+		now := a.now()
+		var batch []models.Membership
+		err := a.store.WithinTx(func(tx repository.Store) error {
+			var err error
+			batch, err = tx.ListPendingActivations(now, a.batchSize)
+			if err != nil {
+				return err
+			}
+			for _, membership := range batch {
+				if err := tx.ActivateMembership(membership.UserID, membership.SegmentID, now); err != nil {
+					return err
+				}
+				// The event is dated when the membership went live, not when the scheduler noticed
+				err := tx.LogSegmentHistory(models.SegmentHistoryEntry{
+					UserID:      membership.UserID,
+					SegmentID:   membership.SegmentID,
+					Operation:   models.OperationActivate,
+					Reason:      models.ReasonSchedule,
+					SegmentTime: membership.StartsAt,
+					StartsAt:    membership.StartsAt,
+					ExpiresAt:   membership.ExpiresAt,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return activated, err
+		}
+
+		activated += len(batch)
+		if len(batch) < a.batchSize {
+			break
+		}
+	}
+	return activated, nil
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestActivationSchedulerActivate(t *testing.T) {
+	env := newTestEnv(t, 3, models.Segment{Slug: "AVITO_VOICE"})
+	startsAt := map[int]time.Time{
+		1: testNow.Add(-time.Hour),
+		2: testNow.Add(-time.Minute),
+		3: testNow.Add(time.Hour),
+	}
+	for userID := 1; userID <= 3; userID++ {
+		update := SegmentsUpdate{UserID: userID, SegmentsToAdd: []string{"AVITO_VOICE"}, StartsAt: startsAt[userID]}
+		env.clock.now = startsAt[userID].Add(-time.Second)
+		if _, err := env.users.UpdateUserSegments(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env.clock.now = testNow
+	scheduler := NewActivationScheduler(env.store, time.Hour, 1)
+	scheduler.now = env.clock.Now
+	activated, err := scheduler.Activate(context.Background())
+	if err != nil || activated != 2 {
+		t.Fatalf("Activate() = %d, %v, want 2", activated, err)
+	}
+	if activated, err := scheduler.Activate(context.Background()); activated != 0 || err != nil {
+		t.Errorf("second Activate() = %d, %v, want nothing left", activated, err)
+	}
+
+	// Activations are dated when the membership started, not when the scheduler ran
+	filter := repository.HistoryFilter{From: testNow.Add(-24 * time.Hour), To: testNow.Add(24 * time.Hour), Operations: []string{models.OperationActivate}}
+	activations := 0
+	err = env.store.StreamSegmentHistory(filter, func(entry models.SegmentHistoryEntry) error {
+		activations++
+		if entry.Reason != models.ReasonSchedule || !entry.SegmentTime.Equal(startsAt[entry.UserID]) {
+			t.Errorf("activation of user %d = %s at %v, want schedule at %v", entry.UserID, entry.Reason, entry.SegmentTime, startsAt[entry.UserID])
+		}
+		return nil
+	})
+	if err != nil || activations != 2 {
+		t.Errorf("history has %d activations, %v, want 2", activations, err)
+	}
+
+	env.clock.now = testNow.Add(time.Hour)
+	if activated, err := scheduler.Activate(context.Background()); activated != 1 || err != nil {
+		t.Errorf("Activate() an hour later = %d, %v, want 1", activated, err)
+	}
+}
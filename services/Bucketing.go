@@ -0,0 +1,32 @@
+package services
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// BucketCount is the number of buckets users are hashed into for percentage rollouts.
+const BucketCount = 10000
+
+// Bucket deterministically maps a user to one of BucketCount buckets of a segment.
+// The same (salt, userID) pair always lands in the same bucket on every instance.
+func Bucket(salt string, userID int) int {
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte{':'})
+	h.Write([]byte(strconv.Itoa(userID)))
+	return int(h.Sum64() % BucketCount)
+}
+
+// RolloutThreshold returns the number of buckets covered by a rollout of autoPct percent.
+// Users whose bucket is below the threshold are in the rollout.
+func RolloutThreshold(autoPct int) int {
+	return autoPct * BucketCount / 100
+}
+
+// InRollout reports whether a user falls into a segment's percentage rollout.
+// Because the threshold only moves, widening a rollout keeps every user that was
+// already in it, and narrowing it only drops users from the top buckets.
+func InRollout(salt string, userID int, autoPct int) bool {
+	return Bucket(salt, userID) < RolloutThreshold(autoPct)
+}
@@ -0,0 +1,97 @@
+package services
+
+import "testing"
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		salt   string
+		userID int
+	}{
+		{salt: "AVITO_VOICE_MESSAGES", userID: 1},
+		{salt: "AVITO_VOICE_MESSAGES", userID: 1000},
+		{salt: "AVITO_DISCOUNT_30", userID: 1},
+		{salt: "", userID: 0},
+	}
+
+	for _, tt := range tests {
+		bucket := Bucket(tt.salt, tt.userID)
+		if bucket < 0 || bucket >= BucketCount {
+			t.Errorf("Bucket(%q, %d) = %d, want 0-%d", tt.salt, tt.userID, bucket, BucketCount-1)
+		}
+		for i := 0; i < 3; i++ {
+			if again := Bucket(tt.salt, tt.userID); again != bucket {
+				t.Errorf("Bucket(%q, %d) = %d, then %d", tt.salt, tt.userID, bucket, again)
+			}
+		}
+	}
+
+	// The salt separates segments, so the same user lands in unrelated buckets
+	same := 0
+	for userID := 1; userID <= 1000; userID++ {
+		if Bucket("AVITO_VOICE_MESSAGES", userID) == Bucket("AVITO_DISCOUNT_30", userID) {
+			same++
+		}
+	}
+	if same > 10 {
+		t.Errorf("%d of 1000 users share a bucket in two segments", same)
+	}
+}
+
+func TestRolloutThreshold(t *testing.T) {
+	tests := []struct {
+		autoPct int
+		want    int
+	}{
+		{autoPct: 0, want: 0},
+		{autoPct: 1, want: 100},
+		{autoPct: 30, want: 3000},
+		{autoPct: 100, want: BucketCount},
+	}
+
+	for _, tt := range tests {
+		if got := RolloutThreshold(tt.autoPct); got != tt.want {
+			t.Errorf("RolloutThreshold(%d) = %d, want %d", tt.autoPct, got, tt.want)
+		}
+	}
+}
+
+func TestInRollout(t *testing.T) {
+	const users = 10000
+	tests := []struct {
+		name           string
+		fromPct, toPct int
+	}{
+		{name: "empty to partial", fromPct: 0, toPct: 10},
+		{name: "widen", fromPct: 10, toPct: 30},
+		{name: "by one percent", fromPct: 30, toPct: 31},
+		{name: "to everyone", fromPct: 50, toPct: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inFrom, inTo := 0, 0
+			for userID := 1; userID <= users; userID++ {
+				wasIn := InRollout("AVITO_VOICE_MESSAGES", userID, tt.fromPct)
+				isIn := InRollout("AVITO_VOICE_MESSAGES", userID, tt.toPct)
+				// Widening never drops a user, so narrowing back only drops the ones it added
+				if wasIn && !isIn {
+					t.Fatalf("user %d left the rollout when it widened from %d%% to %d%%", userID, tt.fromPct, tt.toPct)
+				}
+				if wasIn {
+					inFrom++
+				}
+				if isIn {
+					inTo++
+				}
+			}
+
+			// Buckets are spread evenly, so the share of users is close to the percentage
+			for _, c := range []struct{ pct, in int }{{tt.fromPct, inFrom}, {tt.toPct, inTo}} {
+				want := c.pct * users / 100
+				if c.in < want-users/50 || c.in > want+users/50 {
+					t.Errorf("%d of %d users in a %d%% rollout, want about %d", c.in, users, c.pct, want)
+				}
+			}
+		})
+	}
+}
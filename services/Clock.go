@@ -0,0 +1,9 @@
+package services
+
+import (
+	"time"
+)
+
+// Clock returns the current time. Services take it as a dependency so that
+// time-dependent behaviour can be driven by a fixed clock in tests.
+type Clock func() time.Time
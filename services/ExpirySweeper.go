@@ -0,0 +1,98 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"log"
+	"time"
+)
+
+// ExpirySweeper periodically removes memberships whose expires_at has passed
+// and records an "expire" operation in segment_history for each of them.
+type ExpirySweeper struct {
+	store     repository.Store
+	interval  time.Duration
+	batchSize int
+	now       Clock
+}
+
+func NewExpirySweeper(store repository.Store, interval time.Duration, batchSize int) *ExpirySweeper {
+	return &ExpirySweeper{
+		store:     store,
+		interval:  interval,
+		batchSize: batchSize,
+		now:       time.Now,
+	}
+}
+
+// Run sweeps once per interval until ctx is cancelled.
+func (s *ExpirySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.Sweep(ctx)
+		if err != nil {
+			log.Printf("expiry sweeper: %v", err)
+		} else if removed > 0 {
+			log.Printf("expiry sweeper: removed %d expired memberships", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes every membership expired at the current time, one batch per
+// transaction, and returns the number of memberships removed. A membership
+// renewed between being listed and being removed is kept and not logged.
+func (s *ExpirySweeper) Sweep(ctx context.Context) (int, error) {
+	removed := 0
+	for ctx.Err() == nil {
+		now := s.now()
+		var batch []models.Membership
+		batchRemoved := 0
+		err := s.store.WithinTx(func(tx repository.Store) error {
+			var err error
+			batch, err = tx.ListExpiredMemberships(now, s.batchSize)
+			if err != nil {
+				return err
+			}
+			batchRemoved = 0
+			for _, membership := range batch {
+				ok, err := tx.RemoveExpiredMembership(membership.UserID, membership.SegmentID, now)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				err = tx.LogSegmentHistory(models.SegmentHistoryEntry{
+					UserID:      membership.UserID,
+					SegmentID:   membership.SegmentID,
+					Operation:   models.OperationExpire,
+					Reason:      models.ReasonExpiry,
+					SegmentTime: now,
+				})
+				if err != nil {
+					return err
+				}
+				batchRemoved++
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		removed += batchRemoved
+		if len(batch) < s.batchSize {
+			break
+		}
+	}
+	return removed, nil
+}
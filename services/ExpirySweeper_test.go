@@ -0,0 +1,155 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// segmentMembers returns the IDs of every member of a segment and their sources.
+func segmentMembers(t *testing.T, store repository.Store, segmentID int) map[int]string {
+	t.Helper()
+	memberships, err := store.ListMembers(repository.MemberFilter{SegmentID: segmentID, Limit: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := make(map[int]string, len(memberships))
+	for _, membership := range memberships {
+		members[membership.UserID] = membership.Source
+	}
+	return members
+}
+
+func TestExpirySweeperSweep(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		expired   int
+	}{
+		{name: "nothing expired", batchSize: 2, expired: 0},
+		{name: "less than a batch", batchSize: 10, expired: 3},
+		{name: "exact batches", batchSize: 2, expired: 4},
+		{name: "several batches", batchSize: 2, expired: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, tt.expired+2, models.Segment{Slug: "AVITO_VOICE"})
+			for userID := 1; userID <= tt.expired; userID++ {
+				expiresAt := testNow.Add(-time.Duration(userID) * time.Minute)
+				if err := env.store.AddMembership(userID, 1, time.Time{}, expiresAt, models.SourceManual); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Neither a membership that expires later nor one that never expires is removed
+			if err := env.store.AddMembership(tt.expired+1, 1, time.Time{}, testNow.Add(time.Minute), models.SourceManual); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.store.AddMembership(tt.expired+2, 1, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+				t.Fatal(err)
+			}
+
+			sweeper := NewExpirySweeper(env.store, time.Hour, tt.batchSize)
+			sweeper.now = env.clock.Now
+			removed, err := sweeper.Sweep(context.Background())
+			if err != nil {
+				t.Fatalf("Sweep() error = %v", err)
+			}
+			if removed != tt.expired {
+				t.Errorf("Sweep() = %d, want %d", removed, tt.expired)
+			}
+
+			members := segmentMembers(t, env.store, 1)
+			want := map[int]string{tt.expired + 1: models.SourceManual, tt.expired + 2: models.SourceManual}
+			if !reflect.DeepEqual(members, want) {
+				t.Errorf("members = %v, want %v", members, want)
+			}
+			history := env.history(t)
+			if len(history) != tt.expired {
+				t.Errorf("history has %d entries, want %d", len(history), tt.expired)
+			}
+			for _, entry := range history {
+				if !strings.HasSuffix(entry, " expire expiry") {
+					t.Errorf("history entry %q, want expire expiry", entry)
+				}
+			}
+
+			if removed, err := sweeper.Sweep(context.Background()); removed != 0 || err != nil {
+				t.Errorf("second Sweep() = %d, %v, want nothing left", removed, err)
+			}
+		})
+	}
+}
+
+// renewingStore renews a membership right after it is listed as expired, like a
+// request that commits between the sweeper's SELECT and its DELETE.
+type renewingStore struct {
+	repository.Store
+	renew func(tx repository.Store) error
+}
+
+func (s *renewingStore) WithinTx(fn func(tx repository.Store) error) error {
+	return s.Store.WithinTx(func(tx repository.Store) error {
+		return fn(&renewingStore{Store: tx, renew: s.renew})
+	})
+}
+
+func (s *renewingStore) ListExpiredMemberships(now time.Time, limit int) ([]models.Membership, error) {
+	memberships, err := s.Store.ListExpiredMemberships(now, limit)
+	if err != nil || len(memberships) == 0 {
+		return memberships, err
+	}
+	return memberships, s.renew(s.Store)
+}
+
+func TestExpirySweeperKeepsRenewedMemberships(t *testing.T) {
+	env := newTestEnv(t, 2, models.Segment{Slug: "AVITO_VOICE"})
+	for userID := 1; userID <= 2; userID++ {
+		if err := env.store.AddMembership(userID, 1, time.Time{}, testNow.Add(-time.Minute), models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &renewingStore{Store: env.store, renew: func(tx repository.Store) error {
+		return tx.UpdateMembershipExpiry(1, 1, testNow.Add(time.Hour))
+	}}
+	sweeper := NewExpirySweeper(store, time.Hour, 10)
+	sweeper.now = env.clock.Now
+	removed, err := sweeper.Sweep(context.Background())
+	if err != nil {
+		t.Fatalf("Sweep() error = %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Sweep() = %d, want only the membership that wasn't renewed", removed)
+	}
+	if members := segmentMembers(t, env.store, 1); !reflect.DeepEqual(members, map[int]string{1: models.SourceManual}) {
+		t.Errorf("members = %v, want the renewed user", members)
+	}
+	if got, want := env.history(t), []string{"2 AVITO_VOICE expire expiry"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
+func TestExpirySweeperSkipsArchivedSegments(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	if err := env.store.AddMembership(1, 1, time.Time{}, testNow.Add(time.Hour), models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The membership expires while the segment is deleted; its removal was already logged
+	env.clock.now = testNow.Add(2 * time.Hour)
+	sweeper := NewExpirySweeper(env.store, time.Hour, 10)
+	sweeper.now = env.clock.Now
+	if removed, err := sweeper.Sweep(context.Background()); removed != 0 || err != nil {
+		t.Errorf("Sweep() = %d, %v, want the archived segment skipped", removed, err)
+	}
+	if got, want := env.history(t), []string{"1 AVITO_VOICE remove segment_deleted"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a different request.
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+	// ErrIdempotencyKeyInProgress is returned while the first request with a key is still being processed.
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotencyService stores responses of mutating requests under their
+// Idempotency-Key so that retried requests replay the first response instead
+// of being applied twice. Keys are remembered for the configured window. A key
+// whose request never finished, for example because the process crashed, is
+// reserved for at most the lease and can then be used again. A request that is
+// still running keeps its key by renewing the lease with KeepAlive.
+type IdempotencyService struct {
+	store  repository.Store
+	window time.Duration
+	lease  time.Duration
+	now    Clock
+}
+
+func NewIdempotencyService(store repository.Store, window time.Duration, lease time.Duration) *IdempotencyService {
+	return &IdempotencyService{store: store, window: window, lease: lease, now: time.Now}
+}
+
+// Begin reserves key for a request identified by requestHash. If the key was
+// already used within the window for the same request, the stored response is
+// returned and must be replayed; otherwise the caller must process the request
+// and then call Complete or Release.
+func (i *IdempotencyService) Begin(key string, requestHash string) (*models.IdempotencyRecord, error) {
+	var replay *models.IdempotencyRecord
+	err := i.store.WithinTx(func(tx repository.Store) error {
+		now := i.now()
+		record, err := tx.GetIdempotencyRecord(key)
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+		case err != nil:
+			return err
+		case record.CreatedAt.Before(now.Add(-i.window)),
+			record.StatusCode == 0 && record.CreatedAt.Before(now.Add(-i.lease)):
+			// The key expired or its request never finished, so it can be used for a new request
+			if err := tx.DeleteIdempotencyRecord(key); err != nil {
+				return err
+			}
+		case record.RequestHash != requestHash:
+			return ErrIdempotencyKeyReused
+		case record.StatusCode == 0:
+			return ErrIdempotencyKeyInProgress
+		default:
+			replay = &record
+			return nil
+		}
+
+		err = tx.CreateIdempotencyRecord(models.IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: now})
+		if errors.Is(err, repository.ErrDuplicate) {
+			// Another request reserved the key concurrently
+			return ErrIdempotencyKeyInProgress
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return replay, nil
+}
+
+// Complete stores the response of a request started with Begin.
+func (i *IdempotencyService) Complete(key string, statusCode int, contentType string, body []byte) error {
+	return i.store.UpdateIdempotencyRecord(models.IdempotencyRecord{
+		Key:         key,
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Body:        body,
+	})
+}
+
+// KeepAlive renews the lease of a key reserved with Begin every third of the lease, so that a request
+// running longer than the lease isn't processed a second time by a retry. The renewal stops when the
+// returned function is called, which must happen before Complete or Release.
+func (i *IdempotencyService) KeepAlive(key string, requestHash string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(max(i.lease/3, time.Millisecond))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := i.store.RenewIdempotencyRecord(key, requestHash, i.now()); err != nil {
+				log.Printf("idempotency key %q: renewing the lease: %v", key, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// Release forgets a key reserved with Begin, so that the request can be retried.
+func (i *IdempotencyService) Release(key string) error {
+	return i.store.DeleteIdempotencyRecord(key)
+}
+
+// Run removes expired keys once per interval until ctx is cancelled.
+func (i *IdempotencyService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := i.store.DeleteIdempotencyRecordsBefore(i.now().Add(-i.window))
+		if err != nil {
+			log.Printf("idempotency cleanup: %v", err)
+		} else if deleted > 0 {
+			log.Printf("idempotency cleanup: removed %d expired keys", deleted)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"avitoGoProject/repository"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyService(t *testing.T) {
+	const window, lease = 24 * time.Hour, time.Minute
+
+	// step is one call made at an offset from testNow
+	type step struct {
+		at         time.Duration
+		call       string // "begin", "renew", "complete" or "release"
+		hash       string
+		wantErr    error
+		wantReplay bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "replay a completed request",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{call: "complete"},
+				{at: time.Hour, call: "begin", hash: "a", wantReplay: true},
+			},
+		},
+		{
+			name: "reuse with a different request",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{call: "complete"},
+				{at: time.Hour, call: "begin", hash: "b", wantErr: ErrIdempotencyKeyReused},
+			},
+		},
+		{
+			name: "retry while in progress",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{at: time.Second, call: "begin", hash: "a", wantErr: ErrIdempotencyKeyInProgress},
+				{at: time.Second, call: "begin", hash: "b", wantErr: ErrIdempotencyKeyReused},
+			},
+		},
+		{
+			name: "retry after release",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{call: "release"},
+				{at: time.Second, call: "begin", hash: "b"},
+			},
+		},
+		{
+			name: "abandoned reservation is reclaimed after the lease",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{at: lease - time.Second, call: "begin", hash: "a", wantErr: ErrIdempotencyKeyInProgress},
+				{at: lease + time.Second, call: "begin", hash: "a"},
+				{at: lease + 2*time.Second, call: "begin", hash: "a", wantErr: ErrIdempotencyKeyInProgress},
+			},
+		},
+		{
+			name: "renewed reservation outlives the lease",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{at: lease / 2, call: "renew", hash: "a"},
+				{at: lease + time.Second, call: "begin", hash: "a", wantErr: ErrIdempotencyKeyInProgress},
+				{at: lease/2 + lease + time.Second, call: "begin", hash: "a"},
+			},
+		},
+		{
+			name: "renewing for another request changes nothing",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{at: lease / 2, call: "renew", hash: "b"},
+				{at: lease + time.Second, call: "begin", hash: "a"},
+			},
+		},
+		{
+			name: "completed request outlives the lease",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{call: "complete"},
+				{at: 2 * lease, call: "begin", hash: "a", wantReplay: true},
+			},
+		},
+		{
+			name: "key expires after the window",
+			steps: []step{
+				{call: "begin", hash: "a"},
+				{call: "complete"},
+				{at: window + time.Second, call: "begin", hash: "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{now: testNow}
+			idempotency := NewIdempotencyService(repository.NewMemoryStore(), window, lease)
+			idempotency.now = clock.Now
+
+			for i, s := range tt.steps {
+				clock.now = testNow.Add(s.at)
+				switch s.call {
+				case "begin":
+					replay, err := idempotency.Begin("key", s.hash)
+					if !errors.Is(err, s.wantErr) {
+						t.Fatalf("step %d: Begin() error = %v, want %v", i, err, s.wantErr)
+					}
+					if (replay != nil) != s.wantReplay {
+						t.Fatalf("step %d: Begin() replay = %+v, want a replay: %v", i, replay, s.wantReplay)
+					}
+					if replay != nil && (replay.StatusCode != 200 || string(replay.Body) != `{"ok":true}`) {
+						t.Errorf("step %d: replayed %d %s, want the stored response", i, replay.StatusCode, replay.Body)
+					}
+				case "renew":
+					if err := idempotency.store.RenewIdempotencyRecord("key", s.hash, clock.now); err != nil {
+						t.Fatalf("step %d: RenewIdempotencyRecord() error = %v", i, err)
+					}
+				case "complete":
+					if err := idempotency.Complete("key", 200, "application/json", []byte(`{"ok":true}`)); err != nil {
+						t.Fatalf("step %d: Complete() error = %v", i, err)
+					}
+				case "release":
+					if err := idempotency.Release("key"); err != nil {
+						t.Fatalf("step %d: Release() error = %v", i, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeepAlive(t *testing.T) {
+	const lease = 30 * time.Millisecond
+	idempotency := NewIdempotencyService(repository.NewMemoryStore(), time.Hour, lease)
+	if _, err := idempotency.Begin("key", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := idempotency.KeepAlive("key", "a")
+	time.Sleep(4 * lease)
+	if _, err := idempotency.Begin("key", "a"); !errors.Is(err, ErrIdempotencyKeyInProgress) {
+		t.Errorf("Begin() while kept alive error = %v, want ErrIdempotencyKeyInProgress", err)
+	}
+	stop()
+	stop() // Stopping twice is harmless
+
+	time.Sleep(2 * lease)
+	if _, err := idempotency.Begin("key", "a"); err != nil {
+		t.Errorf("Begin() after the lease ran out error = %v, want the key reclaimed", err)
+	}
+}
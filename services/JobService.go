@@ -0,0 +1,294 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// JobService runs persisted background jobs that populate auto_add segments and
+// re-balance them after their auto_pct changes. Jobs run one after another in
+// the order they were created.
+// Each batch of users is processed in one transaction together with the job's
+// cursor, so a job interrupted by a crash resumes right after its last batch.
+type JobService struct {
+	store        repository.Store
+	pollInterval time.Duration
+	batchSize    int
+	now          Clock
+	wake         chan struct{}
+}
+
+func NewJobService(store repository.Store, pollInterval time.Duration, batchSize int) *JobService {
+	return &JobService{
+		store:        store,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		now:          time.Now,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// GetJob @Summary Get job
+// @Description Get the state and progress of a background job.
+// @Tags jobs
+// @Produce json
+// @Param jobID path int true "Job ID"
+// @Success 200 {object} models.Job "Job"
+// @Failure 404 {string} string "Job not found"
+func (j *JobService) GetJob(jobID int) (models.Job, error) {
+	return j.store.GetJob(jobID)
+}
+
+// Notify wakes the runner so that newly created jobs start without waiting for the next poll.
+func (j *JobService) Notify() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes unfinished jobs until ctx is cancelled. Jobs left running by a
+// previous process are picked up again on the first pass.
+func (j *JobService) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		jobs, err := j.store.ListUnfinishedJobs()
+		if err != nil {
+			log.Printf("job runner: %v", err)
+		}
+		for _, job := range jobs {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := j.runJob(ctx, job.ID); err != nil {
+				log.Printf("job runner: job %d: %v", job.ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-j.wake:
+		}
+	}
+}
+
+// runJob processes batches of a job until it finishes or ctx is cancelled.
+func (j *JobService) runJob(ctx context.Context, jobID int) error {
+	for ctx.Err() == nil {
+		done, err := j.runBatch(jobID)
+		if err != nil {
+			// The failed batch was rolled back, record the failure separately
+			return j.failJob(jobID, err)
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// runBatch processes the next batch of a job in a single transaction and
+// reports whether the job has finished.
+func (j *JobService) runBatch(jobID int) (bool, error) {
+	done := false
+	err := j.store.WithinTx(func(tx repository.Store) error {
+		job, err := tx.LockJob(jobID)
+		if err != nil {
+			return err
+		}
+		if job.Status != models.JobStatusPending && job.Status != models.JobStatusRunning {
+			done = true
+			return nil
+		}
+
+		if job.Status == models.JobStatusPending {
+			job.Status = models.JobStatusRunning
+			if job.Total, err = tx.CountUsers(); err != nil {
+				return err
+			}
+		}
+
+		switch job.Kind {
+		case models.JobKindAutoAdd:
+			done, err = j.autoAddBatch(tx, &job)
+		case models.JobKindRebalance:
+			done, err = j.rebalanceBatch(tx, &job)
+		default:
+			err = fmt.Errorf("unknown job kind %q", job.Kind)
+		}
+		if err != nil {
+			return err
+		}
+
+		if done {
+			if job.Status == models.JobStatusRunning {
+				job.Status = models.JobStatusCompleted
+			}
+			job.FinishedAt = j.now()
+		}
+		return tx.UpdateJob(job)
+	})
+	return done, err
+}
+
+// jobSegment returns the segment a job works on, failing if it was deleted in the meantime.
+func jobSegment(tx repository.Store, job *models.Job) (models.Segment, error) {
+	segment, err := tx.GetSegmentByID(job.SegmentID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return models.Segment{}, fmt.Errorf("segment %d no longer exists", job.SegmentID)
+	}
+	if err != nil {
+		return models.Segment{}, err
+	}
+	if !segment.ArchivedAt.IsZero() {
+		return models.Segment{}, fmt.Errorf("segment %d was deleted", job.SegmentID)
+	}
+	return segment, nil
+}
+
+// autoAddBatch adds the next batch of users that fall into the segment's rollout.
+func (j *JobService) autoAddBatch(tx repository.Store, job *models.Job) (bool, error) {
+	segment, err := jobSegment(tx, job)
+	if err != nil {
+		return false, err
+	}
+	// auto_add was disabled or the rollout emptied after the job was queued
+	if !segment.AutoAdd || segment.AutoPct <= 0 {
+		job.Status = models.JobStatusCancelled
+		return true, nil
+	}
+
+	userIDs, err := tx.ListUserIDsAfter(job.CursorUserID, j.batchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(userIDs) == 0 {
+		return true, nil
+	}
+
+	var inRollout []int
+	for _, userID := range userIDs {
+		if InRollout(segment.Salt, userID, segment.AutoPct) {
+			inRollout = append(inRollout, userID)
+		}
+	}
+
+	now := j.now()
+	expiresAt := defaultExpiry(segment, now)
+	added, err := tx.AddMemberships(segment.ID, inRollout, expiresAt, models.SourceAuto)
+	if err != nil {
+		return false, err
+	}
+	err = tx.LogSegmentHistoryBatch(models.SegmentHistoryEntry{
+		SegmentID:   segment.ID,
+		Operation:   models.OperationAdd,
+		Reason:      models.ReasonAutoAdd,
+		SegmentTime: now,
+		ExpiresAt:   expiresAt,
+	}, added)
+	if err != nil {
+		return false, err
+	}
+
+	job.CursorUserID = userIDs[len(userIDs)-1]
+	job.Processed += len(userIDs)
+	job.Added += len(added)
+	return false, nil
+}
+
+// rebalanceBatch brings the next batch of users in line with the segment's current auto_pct: users in
+// the rollout are added and auto members outside it are removed. It follows the segment rather than the
+// job's FromPct and ToPct, so members left behind by an earlier auto_pct are cleaned up and several
+// queued jobs end at the latest percentage. Manual members are never removed.
+func (j *JobService) rebalanceBatch(tx repository.Store, job *models.Job) (bool, error) {
+	segment, err := jobSegment(tx, job)
+	if err != nil {
+		return false, err
+	}
+	// Users are only re-balanced while auto_add is enabled
+	if !segment.AutoAdd {
+		job.Status = models.JobStatusCancelled
+		return true, nil
+	}
+
+	userIDs, err := tx.ListUserIDsAfter(job.CursorUserID, j.batchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(userIDs) == 0 {
+		return true, nil
+	}
+
+	// AddMemberships skips current members and RemoveMemberships skips manual ones
+	var toAdd, toRemove []int
+	for _, userID := range userIDs {
+		if InRollout(segment.Salt, userID, segment.AutoPct) {
+			toAdd = append(toAdd, userID)
+		} else {
+			toRemove = append(toRemove, userID)
+		}
+	}
+
+	now := j.now()
+	expiresAt := defaultExpiry(segment, now)
+	added, err := tx.AddMemberships(segment.ID, toAdd, expiresAt, models.SourceAuto)
+	if err != nil {
+		return false, err
+	}
+	err = tx.LogSegmentHistoryBatch(models.SegmentHistoryEntry{
+		SegmentID:   segment.ID,
+		Operation:   models.OperationAdd,
+		Reason:      models.ReasonAutoRebalance,
+		SegmentTime: now,
+		ExpiresAt:   expiresAt,
+	}, added)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := tx.RemoveMemberships(segment.ID, toRemove, models.SourceAuto)
+	if err != nil {
+		return false, err
+	}
+	err = tx.LogSegmentHistoryBatch(models.SegmentHistoryEntry{
+		SegmentID:   segment.ID,
+		Operation:   models.OperationRemove,
+		Reason:      models.ReasonAutoRebalance,
+		SegmentTime: now,
+	}, removed)
+	if err != nil {
+		return false, err
+	}
+
+	job.CursorUserID = userIDs[len(userIDs)-1]
+	job.Processed += len(userIDs)
+	job.Added += len(added)
+	job.Removed += len(removed)
+	return false, nil
+}
+
+func (j *JobService) failJob(jobID int, cause error) error {
+	err := j.store.WithinTx(func(tx repository.Store) error {
+		job, err := tx.LockJob(jobID)
+		if err != nil {
+			return err
+		}
+		job.Status = models.JobStatusFailed
+		job.Error = cause.Error()
+		job.FinishedAt = j.now()
+		return tx.UpdateJob(job)
+	})
+	if err != nil {
+		return fmt.Errorf("%v (recording the failure: %w)", cause, err)
+	}
+	return cause
+}
@@ -0,0 +1,463 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJobService returns a job runner on the environment's store and clock.
+func newTestJobService(env *testEnv, batchSize int) *JobService {
+	jobs := NewJobService(env.store, time.Hour, batchSize)
+	jobs.now = env.clock.Now
+	return jobs
+}
+
+func TestAutoAddJob(t *testing.T) {
+	tests := []struct {
+		name      string
+		users     int
+		batchSize int
+		autoPct   int
+	}{
+		{name: "several batches", users: 95, batchSize: 10, autoPct: 40},
+		{name: "exact batches", users: 40, batchSize: 10, autoPct: 100},
+		{name: "one batch", users: 5, batchSize: 100, autoPct: 60},
+		{name: "no users", users: 0, batchSize: 10, autoPct: 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, tt.users)
+			// A manual member is kept and not added twice
+			segmentID, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: tt.autoPct})
+			if err != nil || jobID == 0 {
+				t.Fatalf("CreateSegment() = %d, %v, want a job", jobID, err)
+			}
+			if tt.users > 0 {
+				if err := env.store.AddMembership(1, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			jobs := newTestJobService(env, tt.batchSize)
+			if err := jobs.runJob(context.Background(), jobID); err != nil {
+				t.Fatalf("runJob() error = %v", err)
+			}
+
+			wantMembers := make(map[int]string)
+			for userID := 1; userID <= tt.users; userID++ {
+				if InRollout("AVITO_VOICE", userID, tt.autoPct) {
+					wantMembers[userID] = models.SourceAuto
+				}
+			}
+			wantAdded := len(wantMembers)
+			if tt.users > 0 {
+				if _, ok := wantMembers[1]; ok {
+					wantAdded--
+				}
+				wantMembers[1] = models.SourceManual
+			}
+			if got := segmentMembers(t, env.store, segmentID); !reflect.DeepEqual(got, wantMembers) {
+				t.Errorf("members = %v, want %v", got, wantMembers)
+			}
+
+			job, err := jobs.GetJob(jobID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status != models.JobStatusCompleted || job.Total != tt.users || job.Processed != tt.users || job.Added != wantAdded {
+				t.Errorf("job = %+v, want completed with %d processed and %d added", job, tt.users, wantAdded)
+			}
+			if job.FinishedAt.IsZero() {
+				t.Error("finished_at isn't set")
+			}
+			if history := env.history(t); len(history) != wantAdded {
+				t.Errorf("history has %d entries, want one add per added user (%d)", len(history), wantAdded)
+			}
+		})
+	}
+}
+
+func TestAutoAddJobResumes(t *testing.T) {
+	env := newTestEnv(t, 25)
+	segmentID, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each batch commits its progress, so a new runner continues after the last one
+	jobs := newTestJobService(env, 10)
+	if done, err := jobs.runBatch(jobID); done || err != nil {
+		t.Fatalf("runBatch() = %v, %v, want another batch", done, err)
+	}
+	job, _ := jobs.GetJob(jobID)
+	if job.Status != models.JobStatusRunning || job.CursorUserID != 10 || job.Processed != 10 {
+		t.Fatalf("job after one batch = %+v, want running at user 10", job)
+	}
+
+	if err := newTestJobService(env, 10).runJob(context.Background(), jobID); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = jobs.GetJob(jobID)
+	if job.Status != models.JobStatusCompleted || job.Processed != 25 || job.Added != 25 {
+		t.Errorf("job = %+v, want completed with 25 added", job)
+	}
+	if members := segmentMembers(t, env.store, segmentID); len(members) != 25 {
+		t.Errorf("segment has %d members, want 25", len(members))
+	}
+}
+
+func TestAutoAddJobCancelsItself(t *testing.T) {
+	env := newTestEnv(t, 30)
+	segmentID, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turning auto_add off behind the service's back still stops the job at its next batch
+	segment, _ := env.store.GetSegmentByID(segmentID)
+	segment.AutoAdd = false
+	if err := env.store.UpdateSegment(segment); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := newTestJobService(env, 10)
+	if err := jobs.runJob(context.Background(), jobID); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.GetJob(jobID); job.Status != models.JobStatusCancelled || job.Added != 0 {
+		t.Errorf("job = %+v, want cancelled without adding anyone", job)
+	}
+}
+
+func TestRebalanceJob(t *testing.T) {
+	const users = 200
+	tests := []struct {
+		name           string
+		fromPct, toPct int
+	}{
+		{name: "widen", fromPct: 20, toPct: 60},
+		{name: "narrow", fromPct: 60, toPct: 20},
+		{name: "to zero", fromPct: 50, toPct: 0},
+		{name: "from zero", fromPct: 0, toPct: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, users)
+			segmentID, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wasIn := make(map[int]bool)
+			var autoMembers []int
+			for userID := 1; userID <= users; userID++ {
+				if InRollout("AVITO_VOICE", userID, tt.fromPct) {
+					wasIn[userID] = true
+					autoMembers = append(autoMembers, userID)
+				}
+			}
+			if _, err := env.store.AddMemberships(segmentID, autoMembers, time.Time{}, models.SourceAuto); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.store.UpdateSegmentAutoPct(segmentID, tt.fromPct); err != nil {
+				t.Fatal(err)
+			}
+			// Manual members stay even when the rollout no longer covers them
+			var manual int
+			for userID := 1; userID <= users; userID++ {
+				if !InRollout("AVITO_VOICE", userID, tt.toPct) && !wasIn[userID] {
+					manual = userID
+					break
+				}
+			}
+			if manual != 0 {
+				if err := env.store.AddMembership(manual, segmentID, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := env.segments.UpdateAutoPct("AVITO_VOICE", tt.toPct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.OldAutoPct != tt.fromPct || result.NewAutoPct != tt.toPct || result.JobID == 0 {
+				t.Fatalf("UpdateAutoPct() = %+v, want a job from %d%% to %d%%", result, tt.fromPct, tt.toPct)
+			}
+			// Nothing moves until the job runs
+			before := len(autoMembers)
+			if manual != 0 {
+				before++
+			}
+			if members := segmentMembers(t, env.store, segmentID); len(members) != before {
+				t.Errorf("segment has %d members before the job ran, want %d", len(members), before)
+			}
+
+			jobs := newTestJobService(env, 32)
+			if err := jobs.runJob(context.Background(), result.JobID); err != nil {
+				t.Fatalf("runJob() error = %v", err)
+			}
+
+			wantMembers := make(map[int]string)
+			wantAdded, wantRemoved := 0, 0
+			for userID := 1; userID <= users; userID++ {
+				isIn := InRollout("AVITO_VOICE", userID, tt.toPct)
+				if isIn {
+					wantMembers[userID] = models.SourceAuto
+				}
+				switch {
+				case isIn && !wasIn[userID]:
+					wantAdded++
+				case !isIn && wasIn[userID]:
+					wantRemoved++
+				}
+			}
+			if manual != 0 {
+				wantMembers[manual] = models.SourceManual
+			}
+			if got := segmentMembers(t, env.store, segmentID); !reflect.DeepEqual(got, wantMembers) {
+				t.Errorf("members = %v, want %v", sortedKeys(got), sortedKeys(wantMembers))
+			}
+
+			job, _ := jobs.GetJob(result.JobID)
+			if job.Kind != models.JobKindRebalance || job.Status != models.JobStatusCompleted ||
+				job.Processed != users || job.Added != wantAdded || job.Removed != wantRemoved {
+				t.Errorf("job = %+v, want completed with %d added and %d removed", job, wantAdded, wantRemoved)
+			}
+			history := env.history(t)
+			if len(history) != wantAdded+wantRemoved {
+				t.Errorf("history has %d entries, want %d", len(history), wantAdded+wantRemoved)
+			}
+			for _, entry := range history {
+				if !strings.HasSuffix(entry, " auto_rebalance") {
+					t.Errorf("history entry %q, want reason auto_rebalance", entry)
+				}
+			}
+		})
+	}
+}
+
+func TestRebalanceJobCancelled(t *testing.T) {
+	env := newTestEnv(t, 20)
+	if _, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := env.segments.UpdateAutoPct("AVITO_VOICE", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled := false
+	if _, err := env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{AutoAdd: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := newTestJobService(env, 10)
+	if err := jobs.runJob(context.Background(), result.JobID); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.GetJob(result.JobID); job.Status != models.JobStatusCancelled || job.Added != 0 {
+		t.Errorf("job = %+v, want cancelled without adding anyone", job)
+	}
+
+	// Without auto_add, changing auto_pct moves nobody
+	result, err = env.segments.UpdateAutoPct("AVITO_VOICE", 80)
+	if err != nil || result.JobID != 0 {
+		t.Errorf("UpdateAutoPct() without auto_add = %+v, %v, want no job", result, err)
+	}
+}
+
+// Members left over from an earlier auto_pct are removed even if the job's own change doesn't cover them.
+func TestRebalanceJobRemovesStaleMembers(t *testing.T) {
+	const users = 200
+	env := newTestEnv(t, users)
+	segmentID, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stale []int
+	for userID := 1; userID <= users; userID++ {
+		if InRollout("AVITO_VOICE", userID, 60) {
+			stale = append(stale, userID)
+		}
+	}
+	if _, err := env.store.AddMemberships(segmentID, stale, time.Time{}, models.SourceAuto); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := env.segments.UpdateAutoPct("AVITO_VOICE", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestJobService(env, 50).runJob(context.Background(), result.JobID); err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, source := range segmentMembers(t, env.store, segmentID) {
+		if !InRollout("AVITO_VOICE", userID, 30) || source != models.SourceAuto {
+			t.Errorf("user %d (%s) is still a member outside the 30%% rollout", userID, source)
+		}
+	}
+	for userID := 1; userID <= users; userID++ {
+		if linked, _ := env.store.IsUserLinkedToSegment(userID, segmentID); InRollout("AVITO_VOICE", userID, 30) && !linked {
+			t.Errorf("user %d is in the 30%% rollout but not a member", userID)
+		}
+	}
+}
+
+// Jobs queued by several changes in a row all work towards the latest auto_pct.
+func TestRebalanceJobsFollowLatestPct(t *testing.T) {
+	const users = 200
+	env := newTestEnv(t, users)
+	segmentID, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobIDs []int
+	for _, autoPct := range []int{60, 10, 40} {
+		result, err := env.segments.UpdateAutoPct("AVITO_VOICE", autoPct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobIDs = append(jobIDs, result.JobID)
+	}
+
+	jobs := newTestJobService(env, 64)
+	for _, jobID := range jobIDs {
+		if err := jobs.runJob(context.Background(), jobID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := make(map[int]string)
+	for userID := 1; userID <= users; userID++ {
+		if InRollout("AVITO_VOICE", userID, 40) {
+			want[userID] = models.SourceAuto
+		}
+	}
+	if got := segmentMembers(t, env.store, segmentID); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", sortedKeys(got), sortedKeys(want))
+	}
+	// The first job already reached 40%, so the others had nothing left to do
+	for i, jobID := range jobIDs {
+		job, _ := jobs.GetJob(jobID)
+		if i > 0 && (job.Added != 0 || job.Removed != 0) {
+			t.Errorf("job %d = %+v, want no changes", jobID, job)
+		}
+	}
+}
+
+func sortedKeys(m map[int]string) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func TestJobFailsWhenSegmentDeleted(t *testing.T) {
+	env := newTestEnv(t, 10)
+	_, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := newTestJobService(env, 10)
+	if err := jobs.runJob(context.Background(), jobID); err == nil {
+		t.Fatal("runJob() succeeded for a deleted segment")
+	}
+	if job, _ := jobs.GetJob(jobID); job.Status != models.JobStatusFailed || job.Error == "" || job.Added != 0 {
+		t.Errorf("job = %+v, want failed with an error", job)
+	}
+}
+
+func TestAutoAddJobCancelled(t *testing.T) {
+	disabled := false
+	zero := 0
+	tests := []struct {
+		name   string
+		update SegmentUpdate
+	}{
+		{name: "auto_add disabled", update: SegmentUpdate{AutoAdd: &disabled}},
+		{name: "auto_pct set to 0", update: SegmentUpdate{AutoPct: &zero}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 30)
+			segmentID, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs := newTestJobService(env, 10)
+			if _, err := jobs.runBatch(jobID); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := env.segments.UpdateSegment("AVITO_VOICE", tt.update); err != nil {
+				t.Fatal(err)
+			}
+			if err := jobs.runJob(context.Background(), jobID); err != nil {
+				t.Fatal(err)
+			}
+
+			job, _ := jobs.GetJob(jobID)
+			if job.Status != models.JobStatusCancelled || job.Processed != 10 {
+				t.Errorf("job = %+v, want cancelled after the first batch", job)
+			}
+			if members := segmentMembers(t, env.store, segmentID); len(members) != 10 {
+				t.Errorf("segment has %d members, want the 10 added before the job was cancelled", len(members))
+			}
+		})
+	}
+}
+
+func TestReenablingAutoAddRemovesStaleMembers(t *testing.T) {
+	env := newTestEnv(t, 200)
+	segmentID, jobID, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := newTestJobService(env, 50)
+	if err := jobs.runJob(context.Background(), jobID); err != nil {
+		t.Fatal(err)
+	}
+
+	// auto_pct is lowered while auto_add is off, so nobody is moved until it is enabled again
+	disabled, enabled, pct := false, true, 20
+	if _, err := env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{AutoAdd: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{AutoPct: &pct})
+	if err != nil || result.Rebalance == nil || result.Rebalance.JobID != 0 {
+		t.Fatalf("UpdateSegment(auto_pct) = %+v, %v, want no job while auto_add is off", result.Rebalance, err)
+	}
+	result, err = env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{AutoAdd: &enabled})
+	if err != nil || result.JobID == 0 {
+		t.Fatalf("UpdateSegment(auto_add) = %+v, %v, want a job", result, err)
+	}
+	if err := jobs.runJob(context.Background(), result.JobID); err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := env.store.GetSegmentBySlug("AVITO_VOICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []int
+	for userID := 1; userID <= 200; userID++ {
+		if InRollout(segment.Salt, userID, pct) {
+			want = append(want, userID)
+		}
+	}
+	if got := sortedKeys(segmentMembers(t, env.store, segmentID)); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want the %d users in the 20%% rollout", got, len(want))
+	}
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/parquet-go/parquet-go"
+	"hash"
+	"io"
+	"strconv"
+	"time"
+)
+
+// HistoryEncoder writes history entries to a report in one format.
+type HistoryEncoder interface {
+	Encode(entry models.SegmentHistoryEntry) error
+	// Close writes whatever the format needs after the last entry and flushes
+	// buffered output. It doesn't close the underlying writer.
+	Close() error
+}
+
+// ReportFormat is a file format history reports can be generated in.
+type ReportFormat struct {
+	Name        string // Value of the format query parameter
+	Extension   string // Extension of stored reports, including the dot
+	ContentType string
+	NewEncoder  func(w io.Writer) HistoryEncoder
+}
+
+// ReportFormats lists the supported formats; the first one is the default.
+var ReportFormats = []ReportFormat{
+	{Name: "csv", Extension: ".csv", ContentType: "text/csv", NewEncoder: newCSVHistoryEncoder},
+	{Name: "json", Extension: ".json", ContentType: "application/json", NewEncoder: newJSONHistoryEncoder},
+	{Name: "ndjson", Extension: ".ndjson", ContentType: "application/x-ndjson", NewEncoder: newNDJSONHistoryEncoder},
+	{Name: "parquet", Extension: ".parquet", ContentType: "application/vnd.apache.parquet", NewEncoder: newParquetHistoryEncoder},
+}
+
+// ReportFormatByName returns the format with the given name.
+func ReportFormatByName(name string) (ReportFormat, bool) {
+	for _, format := range ReportFormats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+	return ReportFormat{}, false
+}
+
+// ReportFormatByExtension returns the format of a stored report from its extension.
+func ReportFormatByExtension(extension string) (ReportFormat, bool) {
+	for _, format := range ReportFormats {
+		if format.Extension == extension {
+			return format, true
+		}
+	}
+	return ReportFormat{}, false
+}
+
+// historyCSVHeader names the columns of the history report.
+var historyCSVHeader = []string{"user_id", "segment", "operation", "timestamp"}
+
+// historyFlushRows is how many rows are buffered before they are written out.
+const historyFlushRows = 1000
+
+// csvHistoryEncoder frames the rows by a header row and a trailer row
+// "#end,<rows>,sha256,<hex>", where the checksum covers every byte before the
+// trailer, so that a truncated file can be detected.
+type csvHistoryEncoder struct {
+	w         io.Writer
+	csvWriter *csv.Writer
+	checksum  hash.Hash
+	rows      int
+}
+
+func newCSVHistoryEncoder(w io.Writer) HistoryEncoder {
+	checksum := sha256.New()
+	csvWriter := csv.NewWriter(io.MultiWriter(w, checksum))
+	csvWriter.Write(historyCSVHeader)
+	return &csvHistoryEncoder{w: w, csvWriter: csvWriter, checksum: checksum}
+}
+
+func (e *csvHistoryEncoder) Encode(entry models.SegmentHistoryEntry) error {
+	err := e.csvWriter.Write([]string{
+		strconv.Itoa(entry.UserID),
+		entry.SegmentName,
+		entry.Operation,
+		entry.SegmentTime.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%historyFlushRows == 0 {
+		e.csvWriter.Flush()
+		return e.csvWriter.Error()
+	}
+	return nil
+}
+
+func (e *csvHistoryEncoder) Close() error {
+	e.csvWriter.Flush()
+	if err := e.csvWriter.Error(); err != nil {
+		return err
+	}
+
+	// The trailer is written past the checksum writer so that it doesn't hash itself
+	trailer := csv.NewWriter(e.w)
+	trailer.Write([]string{"#end", strconv.Itoa(e.rows), "sha256", hex.EncodeToString(e.checksum.Sum(nil))})
+	trailer.Flush()
+	return trailer.Error()
+}
+
+// historyRecord is how an entry is represented in the JSON, NDJSON and Parquet reports.
+type historyRecord struct {
+	UserID    int64     `json:"user_id" parquet:"user_id"`
+	Segment   string    `json:"segment" parquet:"segment"`
+	Operation string    `json:"operation" parquet:"operation"`
+	Timestamp time.Time `json:"timestamp" parquet:"timestamp,timestamp(millisecond)"`
+}
+
+func newHistoryRecord(entry models.SegmentHistoryEntry) historyRecord {
+	return historyRecord{
+		UserID:    int64(entry.UserID),
+		Segment:   entry.SegmentName,
+		Operation: entry.Operation,
+		Timestamp: entry.SegmentTime.UTC(),
+	}
+}
+
+// jsonHistoryEncoder writes a single JSON array of records.
+type jsonHistoryEncoder struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+	rows     int
+}
+
+func newJSONHistoryEncoder(w io.Writer) HistoryEncoder {
+	buffered := bufio.NewWriter(w)
+	buffered.WriteString("[")
+	return &jsonHistoryEncoder{buffered: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+func (e *jsonHistoryEncoder) Encode(entry models.SegmentHistoryEntry) error {
+	if e.rows > 0 {
+		if _, err := e.buffered.WriteString(","); err != nil {
+			return err
+		}
+	}
+	e.rows++
+	return e.encoder.Encode(newHistoryRecord(entry))
+}
+
+func (e *jsonHistoryEncoder) Close() error {
+	if _, err := e.buffered.WriteString("]\n"); err != nil {
+		return err
+	}
+	return e.buffered.Flush()
+}
+
+// ndjsonHistoryEncoder writes one JSON record per line.
+type ndjsonHistoryEncoder struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func newNDJSONHistoryEncoder(w io.Writer) HistoryEncoder {
+	buffered := bufio.NewWriter(w)
+	return &ndjsonHistoryEncoder{buffered: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+func (e *ndjsonHistoryEncoder) Encode(entry models.SegmentHistoryEntry) error {
+	return e.encoder.Encode(newHistoryRecord(entry))
+}
+
+func (e *ndjsonHistoryEncoder) Close() error {
+	return e.buffered.Flush()
+}
+
+// historyParquetRowGroupRows bounds how many rows the Parquet writer keeps in memory.
+const historyParquetRowGroupRows = 64 * 1024
+
+// parquetHistoryEncoder writes a Parquet file with one row group per historyParquetRowGroupRows entries.
+type parquetHistoryEncoder struct {
+	writer *parquet.GenericWriter[historyRecord]
+	batch  []historyRecord
+}
+
+func newParquetHistoryEncoder(w io.Writer) HistoryEncoder {
+	return &parquetHistoryEncoder{
+		writer: parquet.NewGenericWriter[historyRecord](w, parquet.MaxRowsPerRowGroup(historyParquetRowGroupRows)),
+		batch:  make([]historyRecord, 0, historyFlushRows),
+	}
+}
+
+func (e *parquetHistoryEncoder) Encode(entry models.SegmentHistoryEntry) error {
+	e.batch = append(e.batch, newHistoryRecord(entry))
+	if len(e.batch) < historyFlushRows {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *parquetHistoryEncoder) flush() error {
+	if _, err := e.writer.Write(e.batch); err != nil {
+		return err
+	}
+	e.batch = e.batch[:0]
+	return nil
+}
+
+func (e *parquetHistoryEncoder) Close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.writer.Close()
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/parquet-go/parquet-go"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHistoryEntries returns n entries alternating between two segments, a minute apart.
+func testHistoryEntries(n int) []models.SegmentHistoryEntry {
+	entries := make([]models.SegmentHistoryEntry, n)
+	for i := range entries {
+		entries[i] = models.SegmentHistoryEntry{
+			UserID:      i + 1,
+			SegmentName: []string{"AVITO_VOICE", "AVITO_DISCOUNT"}[i%2],
+			Operation:   []string{models.OperationAdd, models.OperationRemove}[i%2],
+			SegmentTime: testNow.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	return entries
+}
+
+// decodeHistoryReport reads a report written in format back into records.
+func decodeHistoryReport(t *testing.T, format string, data []byte) []historyRecord {
+	t.Helper()
+	records := []historyRecord{}
+	switch format {
+	case "csv":
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows[0], historyCSVHeader) {
+			t.Fatalf("header = %v, want %v", rows[0], historyCSVHeader)
+		}
+		trailer := rows[len(rows)-1]
+		body := rows[1 : len(rows)-1]
+		checksum := sha256.Sum256(data[:bytes.LastIndex(data, []byte("#end,"))])
+		wantTrailer := []string{"#end", strconv.Itoa(len(body)), "sha256", hex.EncodeToString(checksum[:])}
+		if !reflect.DeepEqual(trailer, wantTrailer) {
+			t.Fatalf("trailer = %v, want %v", trailer, wantTrailer)
+		}
+		for _, row := range body {
+			userID, _ := strconv.Atoi(row[0])
+			timestamp, _ := time.Parse(time.RFC3339, row[3])
+			records = append(records, historyRecord{UserID: int64(userID), Segment: row[1], Operation: row[2], Timestamp: timestamp})
+		}
+	case "json":
+		if err := json.Unmarshal(data, &records); err != nil {
+			t.Fatal(err)
+		}
+	case "ndjson":
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var record historyRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+	case "parquet":
+		rows, err := parquet.Read[historyRecord](bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rows...)
+	default:
+		t.Fatalf("unknown format %s", format)
+	}
+	return records
+}
+
+func TestCSVHistoryEncoder(t *testing.T) {
+	// Past historyFlushRows the rows are written in more than one flush
+	for _, rows := range []int{0, 3, historyFlushRows + 1} {
+		var buf bytes.Buffer
+		encoder := newCSVHistoryEncoder(&buf)
+		entries := testHistoryEntries(rows)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := encoder.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []historyRecord{}
+		for _, entry := range entries {
+			want = append(want, newHistoryRecord(entry))
+		}
+		if got := decodeHistoryReport(t, "csv", buf.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d rows: records = %+v, want %+v", rows, got, want)
+		}
+	}
+}
+
+func TestReportFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		rows   int
+	}{
+		{format: "json", rows: 0},
+		{format: "json", rows: 3},
+		{format: "ndjson", rows: 0},
+		{format: "ndjson", rows: 3},
+		{format: "parquet", rows: 0},
+		{format: "parquet", rows: historyFlushRows + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+strconv.Itoa(tt.rows), func(t *testing.T) {
+			format, ok := ReportFormatByName(tt.format)
+			if !ok {
+				t.Fatalf("ReportFormatByName(%s) not found", tt.format)
+			}
+			if byExtension, ok := ReportFormatByExtension(format.Extension); !ok || byExtension.Name != tt.format {
+				t.Errorf("ReportFormatByExtension(%s) = %s, want %s", format.Extension, byExtension.Name, tt.format)
+			}
+
+			var buf bytes.Buffer
+			encoder := format.NewEncoder(&buf)
+			entries := testHistoryEntries(tt.rows)
+			for _, entry := range entries {
+				if err := encoder.Encode(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := encoder.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			records := decodeHistoryReport(t, tt.format, buf.Bytes())
+			want := []historyRecord{}
+			for _, entry := range entries {
+				want = append(want, newHistoryRecord(entry))
+			}
+			if len(records) != len(want) {
+				t.Fatalf("decoded %d records, want %d", len(records), len(want))
+			}
+			for i := range records {
+				if !records[i].Timestamp.Equal(want[i].Timestamp) {
+					t.Errorf("record %d timestamp = %v, want %v", i, records[i].Timestamp, want[i].Timestamp)
+				}
+				records[i].Timestamp, want[i].Timestamp = time.Time{}, time.Time{}
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("records = %+v, want %+v", records, want)
+			}
+		})
+	}
+
+	for _, unknown := range []string{"xml", ""} {
+		if _, ok := ReportFormatByName(unknown); ok {
+			t.Errorf("ReportFormatByName(%q) found a format", unknown)
+		}
+	}
+	for _, unknown := range []string{".xml", "csv", ""} {
+		if _, ok := ReportFormatByExtension(unknown); ok {
+			t.Errorf("ReportFormatByExtension(%q) found a format", unknown)
+		}
+	}
+}
+
+func TestCSVTrailerDetectsTruncation(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := newCSVHistoryEncoder(&buf)
+	for _, entry := range testHistoryEntries(3) {
+		if err := encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping a row leaves a trailer whose count and checksum no longer match the body
+	lines := strings.SplitAfter(buf.String(), "\n")
+	truncated := strings.Join(append(lines[:2:2], lines[3:]...), "")
+	trailerStart := strings.LastIndex(truncated, "#end,")
+	checksum := sha256.Sum256([]byte(truncated[:trailerStart]))
+	if strings.Contains(truncated[trailerStart:], hex.EncodeToString(checksum[:])) {
+		t.Error("the trailer checksum matches a truncated report")
+	}
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+var (
+	// ErrInvalidHistoryFilter is returned for a history report over an empty or inverted period.
+	ErrInvalidHistoryFilter = errors.New("invalid history filter")
+	// ErrReportPending is returned when downloading a report that hasn't been generated yet.
+	ErrReportPending = errors.New("report is still being generated")
+	// ErrReportFailed is returned when downloading a report whose generation failed.
+	ErrReportFailed = errors.New("report generation failed")
+)
+
+// ReportService generates history reports in the background and writes them to
+// a report store, from which they are downloaded later. Reports that were still
+// pending when the process stopped are generated after the next start. Reports
+// are deleted once they are older than the retention.
+type ReportService struct {
+	store     repository.Store
+	reports   repository.ReportStore
+	retention time.Duration
+	now       Clock
+	wake      chan struct{}
+}
+
+func NewReportService(store repository.Store, reports repository.ReportStore, retention time.Duration) *ReportService {
+	return &ReportService{store: store, reports: reports, retention: retention, now: time.Now, wake: make(chan struct{}, 1)}
+}
+
+// GenerateHistoryReport @Summary Request a segment history report
+// @Description Queue a report of the history entries matching filter in format and return its description.
+// @Description The report is generated in the background; its status tells when it can be downloaded.
+// @Tags reports
+// @Success 202 {object} models.Report "Pending report"
+func (r *ReportService) GenerateHistoryReport(filter repository.HistoryFilter, format ReportFormat) (models.Report, error) {
+	if !filter.From.Before(filter.To) {
+		return models.Report{}, fmt.Errorf("%w: from must be before to", ErrInvalidHistoryFilter)
+	}
+	// Aliases are resolved now, so the report covers the segments as they were named in the request
+	segmentSlugs, err := segmentNames(r.store, filter.SegmentSlugs)
+	if err != nil {
+		return models.Report{}, err
+	}
+	filter.SegmentSlugs = segmentSlugs
+	encodedFilter, err := json.Marshal(filter)
+	if err != nil {
+		return models.Report{}, err
+	}
+
+	id, err := newReportID()
+	if err != nil {
+		return models.Report{}, err
+	}
+	report := models.Report{
+		ID:        id + format.Extension,
+		Format:    format.Name,
+		Status:    models.ReportStatusPending,
+		Filter:    encodedFilter,
+		CreatedAt: r.now(),
+	}
+	if err := r.store.CreateReport(report); err != nil {
+		return models.Report{}, err
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return report, nil
+}
+
+// generateReport writes a pending report to the report store and records whether it succeeded.
+func (r *ReportService) generateReport(report models.Report) error {
+	err := r.writeReport(&report)
+	report.FinishedAt = r.now()
+	if err != nil {
+		report.Status = models.ReportStatusFailed
+		report.Error = err.Error()
+	} else {
+		report.Status = models.ReportStatusCompleted
+	}
+	if updateErr := r.store.UpdateReport(report); updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+// writeReport streams the history entries of a report into the report store and counts them.
+func (r *ReportService) writeReport(report *models.Report) error {
+	format, ok := ReportFormatByName(report.Format)
+	if !ok {
+		return fmt.Errorf("unknown report format %q", report.Format)
+	}
+	var filter repository.HistoryFilter
+	if err := json.Unmarshal(report.Filter, &filter); err != nil {
+		return err
+	}
+
+	report.Rows = 0
+	return r.reports.Save(report.ID, func(w io.Writer) error {
+		// Entries are streamed from the database cursor straight into the encoder
+		encoder := format.NewEncoder(w)
+		err := r.store.StreamSegmentHistory(filter, func(entry models.SegmentHistoryEntry) error {
+			report.Rows++
+			return encoder.Encode(entry)
+		})
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	})
+}
+
+// segmentNames adds the current slug and every alias of the segments named by slugs, so history
+// recorded before or after a rename is matched. Slugs of purged segments are kept as they are.
+func segmentNames(store repository.Store, slugs []string) ([]string, error) {
+	names := append([]string(nil), slugs...)
+	for _, slug := range slugs {
+		segment, err := findSegment(store, slug)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		aliases, err := store.ListSegmentAliases(segment.ID)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, segment.Slug)
+		for _, alias := range aliases {
+			names = append(names, alias.Alias)
+		}
+	}
+	return names, nil
+}
+
+// GetReport returns the description and status of a report.
+func (r *ReportService) GetReport(id string) (models.Report, error) {
+	return r.store.GetReport(id)
+}
+
+// OpenReport returns the content and creation time of a completed report. It returns ErrReportPending
+// while the report is being generated and ErrReportFailed if generating it failed.
+func (r *ReportService) OpenReport(id string) (io.ReadSeekCloser, time.Time, error) {
+	report, err := r.store.GetReport(id)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// Reports generated before their state was stored only exist as files
+	case err != nil:
+		return nil, time.Time{}, err
+	case report.Status == models.ReportStatusPending:
+		return nil, time.Time{}, ErrReportPending
+	case report.Status == models.ReportStatusFailed:
+		return nil, time.Time{}, fmt.Errorf("%w: %s", ErrReportFailed, report.Error)
+	}
+	return r.reports.Open(id)
+}
+
+// Run generates pending reports as they are requested and deletes reports older than the retention
+// once per interval, until ctx is cancelled.
+func (r *ReportService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.generatePending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+			continue
+		case <-ticker.C:
+		}
+
+		before := r.now().Add(-r.retention)
+		deleted, err := r.reports.DeleteBefore(before)
+		if err == nil {
+			_, err = r.store.DeleteReportsBefore(before)
+		}
+		if err != nil {
+			log.Printf("report cleanup: %v", err)
+		} else if deleted > 0 {
+			log.Printf("report cleanup: removed %d expired reports", deleted)
+		}
+	}
+}
+
+// generatePending generates every pending report, oldest first.
+func (r *ReportService) generatePending(ctx context.Context) {
+	reports, err := r.store.ListPendingReports()
+	if err != nil {
+		log.Printf("report generator: %v", err)
+		return
+	}
+	for _, report := range reports {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := r.generateReport(report); err != nil {
+			log.Printf("report generator: report %s: %v", report.ID, err)
+		}
+	}
+}
+
+// newReportID returns a random identifier that can't be guessed from other reports.
+func newReportID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestReportService returns a report service on the environment's store that keeps reports in a temporary directory.
+func newTestReportService(t *testing.T, env *testEnv) *ReportService {
+	t.Helper()
+	reportStore, err := repository.NewLocalReportStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := NewReportService(env.store, reportStore, time.Hour)
+	reports.now = env.clock.Now
+	return reports
+}
+
+// readReport downloads a completed report.
+func readReport(t *testing.T, reports *ReportService, id string) []byte {
+	t.Helper()
+	file, _, err := reports.OpenReport(id)
+	if err != nil {
+		t.Fatalf("OpenReport() error = %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGenerateHistoryReport(t *testing.T) {
+	env := newTestEnv(t, 2, models.Segment{Slug: "AVITO_VOICE"}, models.Segment{Slug: "AVITO_DISCOUNT"})
+	updates := []struct {
+		at     time.Duration
+		update SegmentsUpdate
+	}{
+		{at: 0, update: SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE", "AVITO_DISCOUNT"}}},
+		{at: time.Hour, update: SegmentsUpdate{UserID: 2, SegmentsToAdd: []string{"AVITO_VOICE"}}},
+		{at: 2 * time.Hour, update: SegmentsUpdate{UserID: 1, SegmentsToRemove: []string{"AVITO_VOICE"}}},
+	}
+	for _, u := range updates {
+		env.clock.now = testNow.Add(u.at)
+		if _, err := env.users.UpdateUserSegments(u.update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record := func(userID int, segment, operation string, at time.Duration) historyRecord {
+		return historyRecord{UserID: int64(userID), Segment: segment, Operation: operation, Timestamp: testNow.Add(at)}
+	}
+	tests := []struct {
+		name   string
+		filter repository.HistoryFilter
+		want   []historyRecord
+	}{
+		{
+			name:   "whole period",
+			filter: repository.HistoryFilter{From: testNow, To: testNow.Add(3 * time.Hour)},
+			want: []historyRecord{
+				record(1, "AVITO_VOICE", "add", 0),
+				record(1, "AVITO_DISCOUNT", "add", 0),
+				record(2, "AVITO_VOICE", "add", time.Hour),
+				record(1, "AVITO_VOICE", "remove", 2*time.Hour),
+			},
+		},
+		{
+			name:   "to is exclusive",
+			filter: repository.HistoryFilter{From: testNow, To: testNow.Add(time.Hour)},
+			want:   []historyRecord{record(1, "AVITO_VOICE", "add", 0), record(1, "AVITO_DISCOUNT", "add", 0)},
+		},
+		{
+			name:   "user",
+			filter: repository.HistoryFilter{From: testNow, To: testNow.Add(3 * time.Hour), UserIDs: []int{2}},
+			want:   []historyRecord{record(2, "AVITO_VOICE", "add", time.Hour)},
+		},
+		{
+			name:   "segment and operation",
+			filter: repository.HistoryFilter{From: testNow, To: testNow.Add(3 * time.Hour), SegmentSlugs: []string{"AVITO_VOICE"}, Operations: []string{"remove"}},
+			want:   []historyRecord{record(1, "AVITO_VOICE", "remove", 2*time.Hour)},
+		},
+		{
+			name:   "empty",
+			filter: repository.HistoryFilter{From: testNow.Add(-time.Hour), To: testNow},
+			want:   []historyRecord{},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, format := range ReportFormats {
+			t.Run(tt.name+"/"+format.Name, func(t *testing.T) {
+				reports := newTestReportService(t, env)
+				report, err := reports.GenerateHistoryReport(tt.filter, format)
+				if err != nil {
+					t.Fatalf("GenerateHistoryReport() error = %v", err)
+				}
+				if report.Status != models.ReportStatusPending || report.Format != format.Name {
+					t.Errorf("report = %+v, want a pending %s report", report, format.Name)
+				}
+				// The report is generated in the background, so it can't be downloaded yet
+				if _, _, err := reports.OpenReport(report.ID); !errors.Is(err, ErrReportPending) {
+					t.Fatalf("OpenReport() of a pending report error = %v, want ErrReportPending", err)
+				}
+
+				reports.generatePending(context.Background())
+				report, err = reports.GetReport(report.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Status != models.ReportStatusCompleted || report.Rows != len(tt.want) || report.FinishedAt.IsZero() {
+					t.Errorf("report = %+v, want completed with %d rows", report, len(tt.want))
+				}
+				if got := decodeHistoryReport(t, format.Name, readReport(t, reports, report.ID)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("report = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestGenerateHistoryReportOfRenamedSegment(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.segments.RenameSegment("AVITO_VOICE", "AVITO_VOICE_MESSAGES"); err != nil {
+		t.Fatal(err)
+	}
+	env.clock.now = testNow.Add(time.Hour)
+	if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToRemove: []string{"AVITO_VOICE_MESSAGES"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Either slug selects the whole history of the segment, and each row keeps the slug it was recorded under
+	want := []historyRecord{
+		{UserID: 1, Segment: "AVITO_VOICE", Operation: "add", Timestamp: testNow},
+		{UserID: 1, Segment: "AVITO_VOICE_MESSAGES", Operation: "remove", Timestamp: testNow.Add(time.Hour)},
+	}
+	for _, slug := range []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES"} {
+		reports := newTestReportService(t, env)
+		filter := repository.HistoryFilter{From: testNow, To: testNow.Add(2 * time.Hour), SegmentSlugs: []string{slug}}
+		report, err := reports.GenerateHistoryReport(filter, ReportFormats[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports.generatePending(context.Background())
+		if got := decodeHistoryReport(t, ReportFormats[0].Name, readReport(t, reports, report.ID)); !reflect.DeepEqual(got, want) {
+			t.Errorf("report of %s = %+v, want %+v", slug, got, want)
+		}
+	}
+}
+
+func TestGenerateHistoryReportInvalidPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to time.Time
+	}{
+		{name: "empty", from: testNow, to: testNow},
+		{name: "inverted", from: testNow, to: testNow.Add(-time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 0)
+			reports := newTestReportService(t, env)
+			_, err := reports.GenerateHistoryReport(repository.HistoryFilter{From: tt.from, To: tt.to}, ReportFormats[0])
+			if !errors.Is(err, ErrInvalidHistoryFilter) {
+				t.Errorf("GenerateHistoryReport() error = %v, want ErrInvalidHistoryFilter", err)
+			}
+			if pending, _ := env.store.ListPendingReports(); len(pending) != 0 {
+				t.Errorf("%d reports were queued", len(pending))
+			}
+		})
+	}
+}
+
+func TestOpenReport(t *testing.T) {
+	env := newTestEnv(t, 0)
+	reports := newTestReportService(t, env)
+	// A report whose generation fails is marked failed and can't be downloaded
+	err := env.store.CreateReport(models.Report{ID: "broken.xml", Format: "xml", Status: models.ReportStatusPending, Filter: []byte("{}"), CreatedAt: testNow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports.generatePending(context.Background())
+
+	report, err := reports.GetReport("broken.xml")
+	if err != nil || report.Status != models.ReportStatusFailed || report.Error == "" {
+		t.Errorf("GetReport() = %+v, %v, want a failed report", report, err)
+	}
+	if _, _, err := reports.OpenReport("broken.xml"); !errors.Is(err, ErrReportFailed) {
+		t.Errorf("OpenReport() of a failed report error = %v, want ErrReportFailed", err)
+	}
+	if _, _, err := reports.OpenReport("missing.csv"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("OpenReport() of an unknown report error = %v, want ErrNotFound", err)
+	}
+	if pending, _ := env.store.ListPendingReports(); len(pending) != 0 {
+		t.Errorf("%d reports are still pending", len(pending))
+	}
+}
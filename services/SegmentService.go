@@ -1,63 +1,935 @@
 package services
 
 import (
-	"database/sql"
-	_ "github.com/go-sql-driver/mysql" // MySQL driver import
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+var (
+	// ErrInvalidSlug is returned when a new segment's slug isn't upper snake case or is too long.
+	ErrInvalidSlug = fmt.Errorf("slug must be upper snake case like AVITO_VOICE_MESSAGES, at most %d characters", MaxSegmentSlugLength)
+	// ErrInvalidAutoPct is returned when auto_pct is outside 0-100.
+	ErrInvalidAutoPct = errors.New("auto_pct must be between 0 and 100")
+	// ErrSegmentSlugTaken is returned when creating, renaming or restoring a segment to a slug that another
+	// segment uses as its slug or alias.
+	ErrSegmentSlugTaken = errors.New("another segment uses this slug")
+	// ErrSegmentNotArchived is returned when purging a segment that hasn't been deleted first.
+	ErrSegmentNotArchived = errors.New("segment must be deleted before it can be purged")
+	// ErrSegmentArchived is returned when changing a deleted segment without restoring it.
+	ErrSegmentArchived = errors.New("segment is deleted; set state to active to change it")
+	// ErrInvalidDescription is returned when a description is longer than MaxSegmentDescriptionLength.
+	ErrInvalidDescription = fmt.Errorf("description must be at most %d characters", MaxSegmentDescriptionLength)
+	// ErrInvalidDefaultTTL is returned when a default TTL is negative or shorter than a second.
+	ErrInvalidDefaultTTL = errors.New("default_ttl must be at least 1s, or 0 to remove it")
+	// ErrInvalidSegmentState is returned for a state other than active or archived.
+	ErrInvalidSegmentState = errors.New("state must be active or archived")
+	// ErrInvalidOwner is returned when an owner is longer than MaxSegmentOwnerLength.
+	ErrInvalidOwner = fmt.Errorf("owner must be at most %d characters", MaxSegmentOwnerLength)
+	// ErrInvalidTags is returned for malformed tags or more than MaxSegmentTags of them.
+	ErrInvalidTags = fmt.Errorf("tags must be at most %d lowercase words of letters, digits, '-' and '_', up to 50 characters each", MaxSegmentTags)
+	// ErrInvalidCursor is returned when a page cursor is malformed or was issued for a different sort order.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+const (
+	// MaxSegmentSlugLength is the longest slug a new segment can have.
+	MaxSegmentSlugLength = 64
+	// MaxSegmentDescriptionLength is the longest description a segment can have, in characters.
+	MaxSegmentDescriptionLength = 1000
+	// MaxSegmentOwnerLength is the longest owner a segment can have, in characters.
+	MaxSegmentOwnerLength = 255
+	// MaxSegmentTags is the number of tags a segment can have.
+	MaxSegmentTags = 10
+)
+
+var (
+	// slugPattern accepts upper snake case: words of capital letters and digits joined by single underscores.
+	slugPattern = regexp.MustCompile(`^[A-Z][A-Z0-9]*(_[A-Z0-9]+)*$`)
+	tagPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+)
+
+// normalizeTags validates tags and returns them sorted and without duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	normalized := make([]string, 0, len(sorted))
+	for i, tag := range sorted {
+		if !tagPattern.MatchString(tag) {
+			return nil, ErrInvalidTags
+		}
+		if i == 0 || tag != sorted[i-1] {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxSegmentTags {
+		return nil, ErrInvalidTags
+	}
+	return normalized, nil
+}
+
 type SegmentService struct {
-	db *sql.DB // Database connection
+	store repository.Store // Storage backend
+	now   Clock            // Source of the current time
+}
+
+func NewSegmentService(store repository.Store) *SegmentService {
+	return &SegmentService{store: store, now: time.Now}
 }
 
-func NewSegmentService(db *sql.DB) *SegmentService {
-	return &SegmentService{db: db}
+// SetClock replaces the clock used to decide which memberships have expired.
+func (s *SegmentService) SetClock(now Clock) {
+	s.now = now
 }
 
-// CreateSegmentAndGetID @Summary Create a new segment and get its ID
-// @Description Create a new segment and retrieve its ID by providing slug, autoAdd, and autoPct.
+// CreateSegment @Summary Create a new segment and get its ID
+// @Description Create a new segment by providing slug, autoAdd, autoPct and an optional salt, description, owner and tags.
+// @Description For auto_add segments a background job that populates the segment is created
+// @Description in the same transaction; its ID is returned as jobID (0 when no job is needed).
+// @Description The slug must be upper snake case and not used by another segment that isn't deleted.
 // @Tags segments
 // @Accept json
 // @Produce json
-// @Param slug body string true "Slug of the segment"
-// @Param autoAdd body bool true "Auto Add flag"
-// @Param autoPct body int true "Auto Percentage"
+// @Param segment body models.Segment true "Segment to create"
 // @Success 200 {integer} int "Segment ID"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 409 {string} string "Another segment uses the slug"
 // @Failure 500 {string} string "Internal Server Error"
-func (s *SegmentService) CreateSegmentAndGetID(slug string, autoAdd bool, autoPct int) (int, error) {
-	query := "INSERT INTO segments (slug, auto_add, auto_pct, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)"
-	_, err := s.db.Exec(query, slug, autoAdd, autoPct)
-	if err != nil {
-		return 0, err
+func (s *SegmentService) CreateSegment(segment models.Segment) (segmentID int, jobID int, err error) {
+	if len(segment.Slug) > MaxSegmentSlugLength || !slugPattern.MatchString(segment.Slug) {
+		return 0, 0, ErrInvalidSlug
+	}
+	if segment.AutoPct < 0 || segment.AutoPct > 100 {
+		return 0, 0, ErrInvalidAutoPct
+	}
+	if utf8.RuneCountInString(segment.Description) > MaxSegmentDescriptionLength {
+		return 0, 0, ErrInvalidDescription
+	}
+	if utf8.RuneCountInString(segment.Owner) > MaxSegmentOwnerLength {
+		return 0, 0, ErrInvalidOwner
+	}
+	if segment.Tags, err = normalizeTags(segment.Tags); err != nil {
+		return 0, 0, err
+	}
+	// Salting with the slug keeps bucket assignment stable if the segment is recreated
+	if segment.Salt == "" {
+		segment.Salt = segment.Slug
 	}
 
-	// Get the ID of the newly inserted segment
-	segmentID, err := s.GetSegmentIDBySlug(slug)
+	err = s.store.WithinTx(func(tx repository.Store) error {
+		if err := checkAliasFree(tx, segment.Slug, 0); err != nil {
+			return err
+		}
+		segmentID, err = tx.CreateSegment(segment)
+		if errors.Is(err, repository.ErrDuplicate) {
+			return ErrSegmentSlugTaken
+		}
+		if err != nil {
+			return err
+		}
+		if !segment.AutoAdd || segment.AutoPct <= 0 {
+			return nil
+		}
+
+		jobID, err = createAutoAddJob(tx, segmentID)
+		return err
+	})
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return segmentID, nil
+	return segmentID, jobID, nil
 }
 
 // DeleteSegment @Summary Delete a segment by slug
-// @Description Delete a segment by providing its slug.
+// @Description Archive a segment by providing its slug or one of its aliases. The segment and its memberships
+// @Description are hidden from reads and assignments until RestoreSegment is called. Every current member gets
+// @Description a "remove" operation with reason "segment_deleted". Use PurgeSegment to delete it permanently.
+// @Description The current slug of the deleted segment is returned.
 // @Tags segments
 // @Accept json
 // @Produce json
 // @Param slug path string true "Slug of the segment"
 // @Success 200 {string} string "Segment deleted"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
 // @Failure 500 {string} string "Internal Server Error"
-func (s *SegmentService) DeleteSegment(slug string) error {
-	query := "DELETE FROM segments WHERE slug = ?"
-	_, err := s.db.Exec(query, slug)
+func (s *SegmentService) DeleteSegment(slug string) (canonicalSlug string, err error) {
+	err = s.store.WithinTx(func(tx repository.Store) error {
+		now := s.now()
+		// Every segment with the slug is archived, in case duplicates predate unique slugs
+		for {
+			segment, err := tx.GetSegmentBySlug(slug)
+			if errors.Is(err, repository.ErrNotFound) && canonicalSlug != "" {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if canonicalSlug == "" {
+				canonicalSlug = segment.Slug
+			}
+			if err := archiveSegment(tx, segment, now); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return canonicalSlug, nil
+}
+
+// membershipPageSize is how many memberships are read at once when every member of a segment is processed.
+const membershipPageSize = 1000
+
+// forEachMembershipPage calls fn with every membership of a segment, expired or not, one page at a time
+// in user ID order, so that large segments never have to fit in memory.
+func forEachMembershipPage(tx repository.Store, segmentID int, fn func(memberships []models.Membership) error) error {
+	filter := repository.MemberFilter{SegmentID: segmentID, Limit: membershipPageSize}
+	for {
+		memberships, err := tx.ListMembers(filter)
+		if err != nil {
+			return err
+		}
+		if len(memberships) > 0 {
+			if err := fn(memberships); err != nil {
+				return err
+			}
+		}
+		if len(memberships) < membershipPageSize {
+			return nil
+		}
+		filter.AfterUserID = memberships[len(memberships)-1].UserID
+	}
+}
+
+// archiveSegment archives a segment, logging a "remove" for each current member and the state change.
+// The expiry sweeper skips archived segments, so memberships that have already expired are removed
+// here with the "expire" the sweeper would have logged.
+func archiveSegment(tx repository.Store, segment models.Segment, now time.Time) error {
+	err := forEachMembershipPage(tx, segment.ID, func(memberships []models.Membership) error {
+		userIDs := make([]int, 0, len(memberships))
+		var expired []int
+		for _, membership := range memberships {
+			if !membership.ExpiresAt.IsZero() && !membership.ExpiresAt.After(now) {
+				removed, err := tx.RemoveExpiredMembership(membership.UserID, segment.ID, now)
+				if err != nil {
+					return err
+				}
+				if removed {
+					expired = append(expired, membership.UserID)
+					continue
+				}
+			}
+			userIDs = append(userIDs, membership.UserID)
+		}
+		err := tx.LogSegmentHistoryBatch(models.SegmentHistoryEntry{
+			SegmentID:   segment.ID,
+			Operation:   models.OperationExpire,
+			Reason:      models.ReasonExpiry,
+			SegmentTime: now,
+		}, expired)
+		if err != nil {
+			return err
+		}
+		return tx.LogSegmentHistoryBatch(models.SegmentHistoryEntry{
+			SegmentID:   segment.ID,
+			Operation:   models.OperationRemove,
+			Reason:      models.ReasonSegmentDeleted,
+			SegmentTime: now,
+		}, userIDs)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.ArchiveSegment(segment.ID, now); err != nil {
+		return err
+	}
+	return logSegmentChange(tx, segment, models.SegmentFieldState, models.SegmentStateActive, models.SegmentStateArchived, now)
+}
+
+// RestoreResult describes a segment brought back by RestoreSegment.
+type RestoreResult struct {
+	Slug        string `json:"slug"`
+	Memberships int    `json:"memberships"`      // Memberships that became visible again
+	JobID       int    `json:"job_id,omitempty"` // Job adding users created while the segment was archived
+}
+
+// RestoreSegment @Summary Restore a deleted segment
+// @Description Bring back the most recently deleted segment with the slug together with its memberships.
+// @Description Memberships that expired in the meantime stay gone. Every restored membership gets an "add"
+// @Description operation with reason "segment_restored". For auto_add segments a job enrolls users created
+// @Description while the segment was archived.
+// @Tags segments
+// @Param slug body string true "Slug of the segment"
+// @Success 200 {object} RestoreResult "Restored segment"
+// @Failure 404 {string} string "No deleted segment with the slug"
+// @Failure 409 {string} string "Another segment uses the slug"
+func (s *SegmentService) RestoreSegment(slug string) (RestoreResult, error) {
+	var result RestoreResult
+	err := s.store.WithinTx(func(tx repository.Store) error {
+		segment, err := tx.GetArchivedSegmentBySlug(slug)
+		if err != nil {
+			return err
+		}
+		result, err = restoreSegment(tx, segment, s.now())
+		if err != nil || !segment.AutoAdd || segment.AutoPct <= 0 {
+			return err
+		}
+		result.JobID, err = createAutoAddJob(tx, segment.ID)
+		return err
+	})
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	return result, nil
+}
+
+// restoreSegment brings back an archived segment, logging an "add" for each membership that hasn't
+// expired and the state change. Memberships that expired while the segment was archived are dropped
+// without an "expire", because their "remove" was logged when it was archived.
+func restoreSegment(tx repository.Store, segment models.Segment, now time.Time) (RestoreResult, error) {
+	result := RestoreResult{Slug: segment.Slug}
+	_, err := tx.GetSegmentIDBySlug(segment.Slug)
+	if err == nil {
+		return result, ErrSegmentSlugTaken
+	}
+	if !errors.Is(err, repository.ErrNotFound) {
+		return result, err
+	}
+
+	err = tx.RestoreSegment(segment.ID)
+	if errors.Is(err, repository.ErrDuplicate) {
+		return result, ErrSegmentSlugTaken
+	}
+	if err != nil {
+		return result, err
+	}
+
+	err = forEachMembershipPage(tx, segment.ID, func(memberships []models.Membership) error {
+		for _, membership := range memberships {
+			if !membership.ExpiresAt.IsZero() && !membership.ExpiresAt.After(now) {
+				removed, err := tx.RemoveExpiredMembership(membership.UserID, segment.ID, now)
+				if err != nil {
+					return err
+				}
+				if removed {
+					continue
+				}
+			}
+			err := tx.LogSegmentHistory(models.SegmentHistoryEntry{
+				UserID:      membership.UserID,
+				SegmentID:   segment.ID,
+				Operation:   models.OperationAdd,
+				Reason:      models.ReasonSegmentRestored,
+				SegmentTime: now,
+				StartsAt:    membership.StartsAt,
+				ExpiresAt:   membership.ExpiresAt,
+			})
+			if err != nil {
+				return err
+			}
+			result.Memberships++
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	err = logSegmentChange(tx, segment, models.SegmentFieldState, models.SegmentStateArchived, models.SegmentStateActive, now)
+	return result, err
+}
+
+// createAutoAddJob creates a job that adds every user in the segment's rollout.
+func createAutoAddJob(tx repository.Store, segmentID int) (int, error) {
+	return tx.CreateJob(models.Job{
+		Kind:      models.JobKindAutoAdd,
+		SegmentID: segmentID,
+		Status:    models.JobStatusPending,
+	})
+}
+
+// PurgeSegment @Summary Permanently delete a segment
+// @Description Permanently delete every deleted segment with the slug, including its memberships.
+// @Description The history is kept. Segments that haven't been deleted with DeleteSegment first are refused.
+// @Tags admin
+// @Param slug query string true "Slug of the segment"
+// @Success 200 {integer} int "Number of segments purged"
+// @Failure 404 {string} string "No deleted segment with the slug"
+// @Failure 409 {string} string "The segment hasn't been deleted"
+func (s *SegmentService) PurgeSegment(slug string) (int, error) {
+	purged := 0
+	err := s.store.WithinTx(func(tx repository.Store) error {
+		for {
+			segment, err := tx.GetArchivedSegmentBySlug(slug)
+			if errors.Is(err, repository.ErrNotFound) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.DeleteSegment(segment.ID); err != nil {
+				return err
+			}
+			purged++
+		}
+		if purged > 0 {
+			return nil
+		}
+
+		_, err := tx.GetSegmentIDBySlug(slug)
+		if err == nil {
+			return ErrSegmentNotArchived
+		}
+		return err
+	})
+	return purged, err
+}
+
+// SegmentUpdate lists the properties to change in UpdateSegment. Nil fields are left as they are.
+type SegmentUpdate struct {
+	Description *string
+	Owner       *string
+	Tags        *[]string
+	AutoAdd     *bool
+	AutoPct     *int
+	DefaultTTL  *time.Duration // 0 removes the default TTL
+	State       *string        // models.SegmentStateActive or models.SegmentStateArchived
+}
+
+// Validate checks every field that is set.
+func (u SegmentUpdate) Validate() error {
+	if u.Description != nil && utf8.RuneCountInString(*u.Description) > MaxSegmentDescriptionLength {
+		return ErrInvalidDescription
+	}
+	if u.Owner != nil && utf8.RuneCountInString(*u.Owner) > MaxSegmentOwnerLength {
+		return ErrInvalidOwner
+	}
+	if u.Tags != nil {
+		if _, err := normalizeTags(*u.Tags); err != nil {
+			return err
+		}
+	}
+	if u.AutoPct != nil && (*u.AutoPct < 0 || *u.AutoPct > 100) {
+		return ErrInvalidAutoPct
+	}
+	if u.DefaultTTL != nil && *u.DefaultTTL != 0 && *u.DefaultTTL < time.Second {
+		return ErrInvalidDefaultTTL
+	}
+	if u.State != nil && *u.State != models.SegmentStateActive && *u.State != models.SegmentStateArchived {
+		return ErrInvalidSegmentState
+	}
+	return nil
+}
+
+// SegmentUpdateResult describes what UpdateSegment changed.
+type SegmentUpdateResult struct {
+	Segment   models.Segment
+	Changes   []models.SegmentAuditEntry // One entry per property whose value changed
+	Rebalance *RebalanceResult           // Set when auto_pct changed; its JobID re-balances the members
+	Restore   *RestoreResult             // Set when the segment was restored
+	JobID     int                        // Job re-balancing the segment after auto_add was enabled or the segment restored
+}
+
+// UpdateSegment @Summary Update a segment
+// @Description Change the description, owner, tags, auto_add, auto_pct, default TTL or state of a segment in one transaction.
+// @Description While auto_add ends up enabled, changing auto_pct, enabling auto_add or restoring the segment creates one job
+// @Description that re-balances the segment like UpdateAutoPct. Disabling auto_add keeps the current members and cancels
+// @Description unfinished auto_add and rebalance jobs of the segment. Archiving creates no job. The default TTL only
+// @Description applies to memberships added afterwards. Setting state to "archived" deletes the segment like
+// @Description DeleteSegment and setting it to "active" restores a deleted one like RestoreSegment; a deleted
+// @Description segment can't be changed otherwise. Every change is recorded in segment_audit.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Param update body SegmentUpdate true "Properties to change"
+// @Success 200 {object} SegmentUpdateResult "Updated segment and its changes"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 409 {string} string "The segment is deleted or another segment uses the slug"
+func (s *SegmentService) UpdateSegment(slug string, update SegmentUpdate) (SegmentUpdateResult, error) {
+	if err := update.Validate(); err != nil {
+		return SegmentUpdateResult{}, err
+	}
+
+	var result SegmentUpdateResult
+	err := s.store.WithinTx(func(tx repository.Store) error {
+		now := s.now()
+		segment, err := tx.GetSegmentBySlug(slug)
+		if errors.Is(err, repository.ErrNotFound) {
+			segment, err = tx.GetArchivedSegmentBySlug(slug)
+		}
+		if err != nil {
+			return err
+		}
+		// Only the changes made by this update are reported
+		previous, err := tx.ListSegmentChanges(segment.ID)
+		if err != nil {
+			return err
+		}
+		previousChanges := len(previous)
+
+		if segment.State() == models.SegmentStateArchived {
+			if update.State == nil || *update.State != models.SegmentStateActive {
+				return ErrSegmentArchived
+			}
+			restore, err := restoreSegment(tx, segment, now)
+			if err != nil {
+				return err
+			}
+			result.Restore = &restore
+			segment.ArchivedAt = time.Time{}
+		}
+
+		updated := segment
+		if update.Description != nil {
+			updated.Description = *update.Description
+		}
+		if update.Owner != nil {
+			updated.Owner = *update.Owner
+		}
+		if update.Tags != nil {
+			updated.Tags, _ = normalizeTags(*update.Tags)
+		}
+		if update.AutoAdd != nil {
+			updated.AutoAdd = *update.AutoAdd
+		}
+		if update.DefaultTTL != nil {
+			updated.DefaultTTL = *update.DefaultTTL
+		}
+
+		pctChanged := update.AutoPct != nil && *update.AutoPct != segment.AutoPct
+		if pctChanged {
+			// The job is created below, once it is known whether the segment keeps auto_add
+			target := segment
+			target.AutoAdd = false
+			rebalance, err := rebalanceSegment(tx, target, *update.AutoPct, now)
+			if err != nil {
+				return err
+			}
+			result.Rebalance = &rebalance
+			updated.AutoPct = *update.AutoPct
+		}
+
+		if err := tx.UpdateSegment(updated); err != nil {
+			return err
+		}
+		fields := []struct {
+			field    string
+			old, new string
+		}{
+			{models.SegmentFieldDescription, segment.Description, updated.Description},
+			{models.SegmentFieldOwner, segment.Owner, updated.Owner},
+			{models.SegmentFieldTags, strings.Join(segment.Tags, ","), strings.Join(updated.Tags, ",")},
+			{models.SegmentFieldAutoAdd, strconv.FormatBool(segment.AutoAdd), strconv.FormatBool(updated.AutoAdd)},
+			{models.SegmentFieldDefaultTTL, segment.DefaultTTL.String(), updated.DefaultTTL.String()},
+		}
+		for _, change := range fields {
+			if change.old == change.new {
+				continue
+			}
+			if err := logSegmentChange(tx, segment, change.field, change.old, change.new, now); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case update.State != nil && *update.State == models.SegmentStateArchived:
+			// Jobs fail on an archived segment, so none is created
+			if err := archiveSegment(tx, updated, now); err != nil {
+				return err
+			}
+			updated.ArchivedAt = now
+		case updated.AutoAdd && (pctChanged || !segment.AutoAdd || result.Restore != nil):
+			// The members are brought in line with the final auto_pct in the background. This enrolls users
+			// who joined while auto_add was off or the segment was deleted, and removes auto members left
+			// outside the rollout by an auto_pct set in the meantime
+			jobID, err := createRebalanceJob(tx, segment.ID, segment.AutoPct, updated.AutoPct)
+			if err != nil {
+				return err
+			}
+			if pctChanged {
+				result.Rebalance.JobID = jobID
+			} else {
+				result.JobID = jobID
+			}
+			// The rebalance also adds the users a queued auto_add job would have added
+			if _, err := tx.CancelSegmentJobs(segment.ID, models.JobKindAutoAdd, now); err != nil {
+				return err
+			}
+		case !updated.AutoAdd || updated.AutoPct <= 0:
+			// A queued or running job must not keep enrolling users once auto_add is off
+			if _, err := tx.CancelSegmentJobs(segment.ID, models.JobKindAutoAdd, now); err != nil {
+				return err
+			}
+			if !updated.AutoAdd {
+				if _, err := tx.CancelSegmentJobs(segment.ID, models.JobKindRebalance, now); err != nil {
+					return err
+				}
+			}
+		}
+
+		result.Segment = updated
+		changes, err := tx.ListSegmentChanges(segment.ID)
+		if err != nil {
+			return err
+		}
+		result.Changes = changes[previousChanges:]
+		return nil
+	})
+	if err != nil {
+		return SegmentUpdateResult{}, err
+	}
+
+	return result, nil
+}
+
+// GetSegmentChanges @Summary Get a segment's audit trail
+// @Description List every change made to the properties of a segment, oldest first. Deleted segments
+// @Description that can still be restored are included.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Success 200 {array} models.SegmentAuditEntry "Changes"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) GetSegmentChanges(slug string) (models.Segment, []models.SegmentAuditEntry, error) {
+	segment, err := findSegment(s.store, slug)
+	if err != nil {
+		return models.Segment{}, nil, err
+	}
+	changes, err := s.store.ListSegmentChanges(segment.ID)
+	if err != nil {
+		return models.Segment{}, nil, err
+	}
+	return segment, changes, nil
+}
+
+// findSegment returns the segment with the slug or alias or, if there is none, the most recently deleted one.
+func findSegment(store repository.Store, slug string) (models.Segment, error) {
+	segment, err := store.GetSegmentBySlug(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		return store.GetArchivedSegmentBySlug(slug)
+	}
+	return segment, err
+}
+
+// GetSegment @Summary Get a segment
+// @Description Get a segment by slug together with the number of its current and scheduled members.
+// @Description Deleted segments that can still be restored are returned as well.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Success 200 {object} models.Segment "Segment"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) GetSegment(slug string) (models.Segment, models.SegmentMemberCounts, error) {
+	segment, err := findSegment(s.store, slug)
+	if err != nil {
+		return models.Segment{}, models.SegmentMemberCounts{}, err
+	}
+	counts, err := s.store.CountSegmentMembers(segment.ID, s.now())
+	if err != nil {
+		return models.Segment{}, models.SegmentMemberCounts{}, err
+	}
+	return segment, counts, nil
+}
+
+// SegmentPage is one page of ListSegments. NextCursor is empty on the last page.
+type SegmentPage struct {
+	Segments   []models.Segment
+	NextCursor string
+}
+
+// segmentCursor is the position after the last segment of a page, together with the order it belongs to.
+type segmentCursor struct {
+	SortBy     string     `json:"s"`
+	Descending bool       `json:"d,omitempty"`
+	ID         int        `json:"id"`
+	Slug       string     `json:"slug,omitempty"`
+	CreatedAt  *time.Time `json:"t,omitempty"`
+}
+
+// ListSegments @Summary List segments
+// @Description List segments matching filter, one page at a time. Pass the NextCursor of a page as cursor
+// @Description to get the next one; the cursor only works with the sort order it was issued for.
+// @Tags segments
+// @Param cursor query string false "Cursor returned with the previous page"
+// @Success 200 {object} SegmentPage "Segments"
+// @Failure 400 {string} string "Invalid cursor"
+func (s *SegmentService) ListSegments(filter repository.SegmentFilter, cursor string) (SegmentPage, error) {
+	if cursor != "" {
+		var after segmentCursor
+		if err := decodeCursor(cursor, &after); err != nil {
+			return SegmentPage{}, err
+		}
+		if after.SortBy != filter.SortBy || after.Descending != filter.Descending {
+			return SegmentPage{}, ErrInvalidCursor
+		}
+		filter.After = &models.Segment{ID: after.ID, Slug: after.Slug}
+		if after.CreatedAt != nil {
+			filter.After.CreatedAt = *after.CreatedAt
+		}
+	}
+
+	// One extra segment tells whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	segments, err := s.store.ListSegments(filter)
+	if err != nil {
+		return SegmentPage{}, err
+	}
+	if len(segments) <= limit {
+		return SegmentPage{Segments: segments}, nil
+	}
+
+	segments = segments[:limit]
+	last := segments[limit-1]
+	next := segmentCursor{SortBy: filter.SortBy, Descending: filter.Descending, ID: last.ID}
+	if filter.SortBy == repository.SegmentSortCreatedAt {
+		next.CreatedAt = &last.CreatedAt
+	} else {
+		next.Slug = last.Slug
+	}
+	nextCursor, err := encodeCursor(next)
+	if err != nil {
+		return SegmentPage{}, err
+	}
+	return SegmentPage{Segments: segments, NextCursor: nextCursor}, nil
+}
+
+// MemberPage is one page of ListSegmentMembers. NextCursor is empty on the last page.
+type MemberPage struct {
+	Slug       string // Current slug of the segment, even if it was requested by an alias
+	Members    []models.Membership
+	NextCursor string
+	At         time.Time // Point in time the members' status was evaluated at
+}
+
+// memberCursor is the position after the last member of a page.
+type memberCursor struct {
+	UserID int `json:"u"`
+}
+
+// ListSegmentMembers @Summary List the members of a segment
+// @Description List the memberships of a segment matching filter in user ID order, one page at a time.
+// @Description filter.SegmentID and filter.Now are filled in. Pass the NextCursor of a page as cursor to get the next one.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Param cursor query string false "Cursor returned with the previous page"
+// @Success 200 {object} MemberPage "Members"
+// @Failure 400 {string} string "Invalid cursor"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) ListSegmentMembers(slug string, filter repository.MemberFilter, cursor string) (MemberPage, error) {
+	if cursor != "" {
+		var after memberCursor
+		if err := decodeCursor(cursor, &after); err != nil {
+			return MemberPage{}, err
+		}
+		filter.AfterUserID = after.UserID
+	}
+
+	segment, err := findSegment(s.store, slug)
+	if err != nil {
+		return MemberPage{}, err
+	}
+	filter.SegmentID = segment.ID
+	filter.Now = s.now()
+
+	// One extra member tells whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	members, err := s.store.ListMembers(filter)
+	if err != nil {
+		return MemberPage{}, err
+	}
+	if len(members) <= limit {
+		return MemberPage{Slug: segment.Slug, Members: members, At: filter.Now}, nil
+	}
+
+	members = members[:limit]
+	nextCursor, err := encodeCursor(memberCursor{UserID: members[limit-1].UserID})
+	if err != nil {
+		return MemberPage{}, err
+	}
+	return MemberPage{Slug: segment.Slug, Members: members, NextCursor: nextCursor, At: filter.Now}, nil
+}
+
+// CountSegmentMembers @Summary Count the members of a segment
+// @Description Count the memberships of a segment matching filter. filter.SegmentID and filter.Now are filled in.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Success 200 {integer} int "Number of members"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) CountSegmentMembers(slug string, filter repository.MemberFilter) (canonicalSlug string, count int, err error) {
+	segment, err := findSegment(s.store, slug)
+	if err != nil {
+		return "", 0, err
+	}
+	filter.SegmentID = segment.ID
+	filter.Now = s.now()
+	count, err = s.store.CountMembers(filter)
+	return segment.Slug, count, err
+}
+
+// encodeCursor turns a page position into an opaque cursor.
+func encodeCursor(position interface{}) (string, error) {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor reads a cursor made by encodeCursor into position.
+func decodeCursor(cursor string, position interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, position); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// logSegmentChange records a change to one of a segment's properties in segment_audit.
+func logSegmentChange(tx repository.Store, segment models.Segment, field, oldValue, newValue string, now time.Time) error {
+	return tx.LogSegmentChange(models.SegmentAuditEntry{
+		SegmentID:   segment.ID,
+		SegmentSlug: segment.Slug,
+		Field:       field,
+		OldValue:    oldValue,
+		NewValue:    newValue,
+		ChangedAt:   now,
+	})
+}
+
+// RenameSegment @Summary Rename a segment
+// @Description Change the slug of a segment. The old slug is kept as an alias, so every endpoint keeps accepting it,
+// @Description and the salt is unchanged, so users stay in the same rollout buckets. Renaming a segment back to one
+// @Description of its aliases removes that alias. The rename is recorded in segment_audit.
+// @Tags segments
+// @Param slug path string true "Current slug or alias of the segment"
+// @Param newSlug body string true "New slug"
+// @Success 200 {object} models.Segment "Renamed segment"
+// @Failure 400 {string} string "Invalid slug"
+// @Failure 404 {string} string "Segment not found"
+// @Failure 409 {string} string "The segment is deleted or another segment uses the slug"
+func (s *SegmentService) RenameSegment(slug string, newSlug string) (models.Segment, error) {
+	if len(newSlug) > MaxSegmentSlugLength || !slugPattern.MatchString(newSlug) {
+		return models.Segment{}, ErrInvalidSlug
+	}
+
+	var segment models.Segment
+	err := s.store.WithinTx(func(tx repository.Store) error {
+		var err error
+		segment, err = findSegment(tx, slug)
+		if err != nil {
+			return err
+		}
+		if segment.State() == models.SegmentStateArchived {
+			return ErrSegmentArchived
+		}
+		if newSlug == segment.Slug {
+			return nil
+		}
+
+		if err := checkAliasFree(tx, newSlug, segment.ID); err != nil {
+			return err
+		}
+		err = tx.DeleteSegmentAlias(segment.ID, newSlug)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return err
+		}
+		err = tx.RenameSegment(segment.ID, newSlug)
+		if errors.Is(err, repository.ErrDuplicate) {
+			return ErrSegmentSlugTaken
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.AddSegmentAlias(models.SegmentAlias{Alias: segment.Slug, SegmentID: segment.ID})
+		if errors.Is(err, repository.ErrDuplicate) {
+			return ErrSegmentSlugTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		err = logSegmentChange(tx, segment, models.SegmentFieldSlug, segment.Slug, newSlug, s.now())
+		segment.Slug = newSlug
+		return err
+	})
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	return segment, nil
+}
+
+// checkAliasFree returns ErrSegmentSlugTaken if slug is an alias of a segment other than segmentID.
+func checkAliasFree(tx repository.Store, slug string, segmentID int) error {
+	alias, err := tx.GetSegmentAlias(slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	if alias.SegmentID != segmentID {
+		return ErrSegmentSlugTaken
+	}
 	return nil
 }
 
+// ListSegmentAliases @Summary List a segment's aliases
+// @Description List the former slugs of a segment that still resolve to it, oldest first.
+// @Tags segments
+// @Param slug path string true "Slug or alias of the segment"
+// @Success 200 {array} models.SegmentAlias "Aliases"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) ListSegmentAliases(slug string) (models.Segment, []models.SegmentAlias, error) {
+	segment, err := findSegment(s.store, slug)
+	if err != nil {
+		return models.Segment{}, nil, err
+	}
+	aliases, err := s.store.ListSegmentAliases(segment.ID)
+	if err != nil {
+		return models.Segment{}, nil, err
+	}
+	return segment, aliases, nil
+}
+
+// DeleteSegmentAlias @Summary Remove a segment's alias
+// @Description Stop resolving a former slug to the segment. The slug can then be used by another segment.
+// @Description The removal is recorded in segment_audit.
+// @Tags segments
+// @Param slug path string true "Slug of the segment"
+// @Param alias path string true "Alias to remove"
+// @Success 200 {string} string "Alias removed"
+// @Failure 404 {string} string "Segment or alias not found"
+func (s *SegmentService) DeleteSegmentAlias(slug string, alias string) error {
+	return s.store.WithinTx(func(tx repository.Store) error {
+		segment, err := findSegment(tx, slug)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteSegmentAlias(segment.ID, alias); err != nil {
+			return err
+		}
+		return logSegmentChange(tx, segment, models.SegmentFieldAlias, alias, "", s.now())
+	})
+}
+
 // GetSegmentIDBySlug @Summary Get segment ID by slug
 // @Description Get segment ID by providing its slug.
 // @Tags segments
@@ -69,59 +941,207 @@ func (s *SegmentService) DeleteSegment(slug string) error {
 // @Failure 404 {string} string "Segment not found"
 // @Failure 500 {string} string "Internal Server Error"
 func (s *SegmentService) GetSegmentIDBySlug(slug string) (int, error) {
-	var segmentID int
-
-	query := "SELECT id FROM segments WHERE slug = ?"
-	err := s.db.QueryRow(query, slug).Scan(&segmentID)
-	if err != nil {
-		return 0, err
-	}
-
-	return segmentID, nil
+	return s.store.GetSegmentIDBySlug(slug)
 }
 
 // GetUserSegments @Summary Get user's segments by user ID
-// @Description Get a list of segments linked to a user by providing the user ID.
+// @Description Get the segments linked to a user by providing the user ID. Expired memberships are never returned.
 // @Tags segments
 // @Accept json
 // @Produce json
 // @Param userID path int true "User ID"
-// @Success 200 {array} string "List of segment slugs"
+// @Success 200 {array} models.Membership "List of memberships"
 // @Failure 400 {string} string "Bad Request"
 // @Failure 404 {string} string "User not found"
 // @Failure 500 {string} string "Internal Server Error"
-func (s *SegmentService) GetUserSegments(userID int) ([]string, error) {
-	var segments []string
+func (s *SegmentService) GetUserSegments(userID int) ([]models.Membership, error) {
+	return s.store.GetUserMemberships(userID, s.now())
+}
 
-	query := `
-		SELECT segments.slug
-		FROM segments
-		JOIN user_segments ON segments.id = user_segments.segment_id
-		WHERE user_segments.user_id = ?
-	`
-	rows, err := s.db.Query(query, userID)
+// GetUserSegmentsAt @Summary Get user's segments at a point in time
+// @Description Reconstruct the memberships of a user that were active at the given time by replaying
+// @Description segment_history up to it, including the expiry each membership had then. A zero time
+// @Description means now. The time the memberships were reconstructed at is returned with them.
+// @Tags segments
+// @Produce json
+// @Param userID path int true "User ID"
+// @Param at query string false "Point in time (RFC3339), defaults to now"
+// @Success 200 {array} models.Membership "List of memberships"
+func (s *SegmentService) GetUserSegmentsAt(userID int, at time.Time) ([]models.Membership, time.Time, error) {
+	if at.IsZero() {
+		at = s.now()
+	}
+
+	// DATETIME columns keep at most microseconds, so this makes the period include at itself
+	filter := repository.HistoryFilter{UserIDs: []int{userID}, To: at.Add(time.Microsecond)}
+	var entries []models.SegmentHistoryEntry
+	err := s.store.StreamSegmentHistory(filter, func(entry models.SegmentHistoryEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, at, err
+	}
+	// Entries come back in the order they were written, which concurrent transactions don't keep
+	// in time order. They are replayed by time; entries at the same time keep their order
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].SegmentTime.Before(entries[j].SegmentTime) })
+
+	memberships := make(map[int]models.Membership)
+	for _, entry := range entries {
+		switch entry.Operation {
+		case models.OperationAdd:
+			source := models.SourceManual
+			if entry.Reason == models.ReasonAutoAdd || entry.Reason == models.ReasonAutoRebalance {
+				source = models.SourceAuto
+			}
+			memberships[entry.SegmentID] = models.Membership{
+				UserID:      userID,
+				SegmentID:   entry.SegmentID,
+				SegmentSlug: entry.SegmentName,
+				Source:      source,
+				AddedAt:     entry.SegmentTime,
+				StartsAt:    entry.StartsAt,
+				ExpiresAt:   entry.ExpiresAt,
+			}
+		case models.OperationRenew:
+			// A renewal records the start too, which moves if the membership was rescheduled
+			if membership, ok := memberships[entry.SegmentID]; ok {
+				membership.StartsAt = entry.StartsAt
+				membership.ExpiresAt = entry.ExpiresAt
+				memberships[entry.SegmentID] = membership
+			}
+		case models.OperationRemove, models.OperationExpire:
+			delete(memberships, entry.SegmentID)
+		}
+	}
+
+	// A membership is active once it has started and until it expires, whether
+	// or not the activation scheduler and expiry sweeper had caught up by then
+	var active []models.Membership
+	for _, membership := range memberships {
+		if membership.StartsAt.After(at) {
+			continue
+		}
+		if !membership.ExpiresAt.IsZero() && !membership.ExpiresAt.After(at) {
+			continue
+		}
+		active = append(active, membership)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].SegmentID < active[j].SegmentID })
+	return active, at, nil
+}
+
+// RebalanceResult describes a change of auto_pct made by UpdateAutoPct. The users are moved by the job JobID.
+type RebalanceResult struct {
+	Slug       string `json:"slug"`
+	OldAutoPct int    `json:"old_auto_pct"`
+	NewAutoPct int    `json:"new_auto_pct"`
+	JobID      int    `json:"job_id,omitempty"` // 0 when auto_add is disabled and no users are moved
+}
+
+// UpdateAutoPct @Summary Change a segment's rollout percentage
+// @Description Change auto_pct and create a job that re-balances the segment. Only users whose bucket lies between
+// @Description the old and the new threshold are added or removed; manual members are never removed. Every change
+// @Description is logged in segment_history with reason auto_rebalance.
+// @Tags segments
+// @Param slug body string true "Slug of the segment"
+// @Param autoPct body int true "New auto percentage"
+// @Success 200 {object} RebalanceResult "New percentage and the re-balancing job"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) UpdateAutoPct(slug string, autoPct int) (RebalanceResult, error) {
+	if autoPct < 0 || autoPct > 100 {
+		return RebalanceResult{}, ErrInvalidAutoPct
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var segment string
-		if err := rows.Scan(&segment); err != nil {
-			return nil, err
+	var result RebalanceResult
+	err := s.store.WithinTx(func(tx repository.Store) error {
+		segment, err := tx.GetSegmentBySlug(slug)
+		if err != nil {
+			return err
 		}
-		segments = append(segments, segment)
+		result, err = rebalanceSegment(tx, segment, autoPct, s.now())
+		return err
+	})
+	if err != nil {
+		return RebalanceResult{}, err
+	}
+
+	return result, nil
+}
+
+// rebalanceSegment sets a segment's auto_pct and, if auto_add is enabled, creates a job that adds or removes
+// the users whose bucket lies between the old and the new threshold.
+func rebalanceSegment(tx repository.Store, segment models.Segment, autoPct int, now time.Time) (RebalanceResult, error) {
+	result := RebalanceResult{Slug: segment.Slug, OldAutoPct: segment.AutoPct, NewAutoPct: autoPct}
+	if autoPct == segment.AutoPct {
+		return result, nil
+	}
+
+	if err := tx.UpdateSegmentAutoPct(segment.ID, autoPct); err != nil {
+		return result, err
+	}
+	err := logSegmentChange(tx, segment, models.SegmentFieldAutoPct, strconv.Itoa(segment.AutoPct), strconv.Itoa(autoPct), now)
+	if err != nil {
+		return result, err
 	}
+	if !segment.AutoAdd {
+		return result, nil
+	}
+
+	result.JobID, err = createRebalanceJob(tx, segment.ID, segment.AutoPct, autoPct)
+	return result, err
+}
+
+// createRebalanceJob creates a job that brings the members of a segment in line with its auto_pct.
+func createRebalanceJob(tx repository.Store, segmentID int, fromPct int, toPct int) (int, error) {
+	return tx.CreateJob(models.Job{
+		Kind:      models.JobKindRebalance,
+		SegmentID: segmentID,
+		Status:    models.JobStatusPending,
+		FromPct:   fromPct,
+		ToPct:     toPct,
+	})
+}
 
-	return segments, nil
+// BucketExplanation describes where a user falls in a segment's percentage rollout.
+type BucketExplanation struct {
+	Slug        string `json:"slug"`
+	UserID      int    `json:"user_id"`
+	Salt        string `json:"salt"`
+	Bucket      int    `json:"bucket"`
+	BucketCount int    `json:"bucket_count"`
+	AutoAdd     bool   `json:"auto_add"`
+	AutoPct     int    `json:"auto_pct"`
+	Threshold   int    `json:"threshold"`
+	InRollout   bool   `json:"in_rollout"`
 }
 
-func (u *UserService) IsUserLinkedToSegment(userID int, segmentID int) (bool, error) {
-	query := "SELECT COUNT(*) FROM user_segments WHERE user_id = ? AND segment_id = ?"
-	var count int
-	err := u.db.QueryRow(query, userID, segmentID).Scan(&count)
+// ExplainBucket @Summary Explain a user's rollout bucket
+// @Description Compute which bucket a user is hashed into for a segment and whether that bucket is inside the rollout.
+// @Tags segments
+// @Produce json
+// @Param slug query string true "Slug of the segment"
+// @Param userID query int true "User ID"
+// @Success 200 {object} BucketExplanation "Bucket explanation"
+// @Failure 404 {string} string "Segment not found"
+func (s *SegmentService) ExplainBucket(slug string, userID int) (BucketExplanation, error) {
+	segment, err := s.store.GetSegmentBySlug(slug)
 	if err != nil {
-		return false, err
+		return BucketExplanation{}, err
 	}
-	return count > 0, nil
+
+	bucket := Bucket(segment.Salt, userID)
+	threshold := RolloutThreshold(segment.AutoPct)
+	return BucketExplanation{
+		Slug:        segment.Slug,
+		UserID:      userID,
+		Salt:        segment.Salt,
+		Bucket:      bucket,
+		BucketCount: BucketCount,
+		AutoAdd:     segment.AutoAdd,
+		AutoPct:     segment.AutoPct,
+		Threshold:   threshold,
+		InRollout:   segment.AutoAdd && bucket < threshold,
+	}, nil
 }
@@ -0,0 +1,764 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetUserSegmentsSkipsExpired(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"}, models.Segment{Slug: "AVITO_DISCOUNT"})
+	if err := env.store.AddMembership(1, 1, time.Time{}, testNow.Add(time.Hour), models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.store.AddMembership(1, 2, time.Time{}, time.Time{}, models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		want []string
+	}{
+		{at: testNow, want: []string{"AVITO_VOICE", "AVITO_DISCOUNT"}},
+		{at: testNow.Add(time.Hour - time.Second), want: []string{"AVITO_VOICE", "AVITO_DISCOUNT"}},
+		// Expired memberships disappear even before the sweeper removes them
+		{at: testNow.Add(time.Hour), want: []string{"AVITO_DISCOUNT"}},
+	}
+	for _, tt := range tests {
+		env.clock.now = tt.at
+		if got := env.userSegments(t, 1); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("segments at %v = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestExplainBucket(t *testing.T) {
+	env := newTestEnv(t, 0,
+		models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 30},
+		models.Segment{Slug: "AVITO_MANUAL", AutoPct: 100},
+	)
+
+	for userID := 1; userID <= 50; userID++ {
+		explanation, err := env.segments.ExplainBucket("AVITO_VOICE", userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := BucketExplanation{
+			Slug:        "AVITO_VOICE",
+			UserID:      userID,
+			Salt:        "AVITO_VOICE",
+			Bucket:      Bucket("AVITO_VOICE", userID),
+			BucketCount: BucketCount,
+			AutoAdd:     true,
+			AutoPct:     30,
+			Threshold:   3000,
+			InRollout:   InRollout("AVITO_VOICE", userID, 30),
+		}
+		if explanation != want {
+			t.Errorf("ExplainBucket(%d) = %+v, want %+v", userID, explanation, want)
+		}
+	}
+
+	// Only auto_add segments enroll anyone
+	explanation, err := env.segments.ExplainBucket("AVITO_MANUAL", 1)
+	if err != nil || explanation.InRollout {
+		t.Errorf("ExplainBucket() of a manual segment = %+v, %v, want not in rollout", explanation, err)
+	}
+	if _, err := env.segments.ExplainBucket("AVITO_MISSING", 1); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ExplainBucket() of an unknown segment error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetUserSegmentsAt(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"}, models.Segment{Slug: "AVITO_DISCOUNT"})
+	updates := []struct {
+		at     time.Time
+		update SegmentsUpdate
+	}{
+		{at: testNow, update: SegmentsUpdate{SegmentsToAdd: []string{"AVITO_VOICE"}, TTL: 2 * time.Hour}},
+		{at: testNow, update: SegmentsUpdate{SegmentsToAdd: []string{"AVITO_DISCOUNT"}}},
+		{at: testNow.Add(time.Hour), update: SegmentsUpdate{SegmentsToRemove: []string{"AVITO_DISCOUNT"}}},
+		{at: testNow.Add(time.Hour), update: SegmentsUpdate{SegmentsToAdd: []string{"AVITO_VOICE"}, TTL: 3 * time.Hour}},
+	}
+	for _, u := range updates {
+		env.clock.now = u.at
+		u.update.UserID = 1
+		if _, err := env.users.UpdateUserSegments(u.update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		at            time.Time
+		want          []string
+		wantExpiresAt time.Time
+	}{
+		{name: "before", at: testNow.Add(-time.Minute), want: []string{}},
+		{name: "at the first add", at: testNow, want: []string{"AVITO_VOICE", "AVITO_DISCOUNT"}, wantExpiresAt: testNow.Add(2 * time.Hour)},
+		{name: "at the removal", at: testNow.Add(time.Hour), want: []string{"AVITO_VOICE"}, wantExpiresAt: testNow.Add(4 * time.Hour)},
+		{name: "after the original expiry", at: testNow.Add(3 * time.Hour), want: []string{"AVITO_VOICE"}, wantExpiresAt: testNow.Add(4 * time.Hour)},
+		{name: "after the renewed expiry", at: testNow.Add(4 * time.Hour), want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memberships, at, err := env.segments.GetUserSegmentsAt(1, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !at.Equal(tt.at) {
+				t.Errorf("GetUserSegmentsAt() at = %v, want %v", at, tt.at)
+			}
+			got := []string{}
+			for _, membership := range memberships {
+				got = append(got, membership.SegmentSlug)
+				if membership.SegmentSlug == "AVITO_VOICE" && !membership.ExpiresAt.Equal(tt.wantExpiresAt) {
+					t.Errorf("expires_at = %v, want %v", membership.ExpiresAt, tt.wantExpiresAt)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetUserSegmentsAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUserSegmentsAtDefaultsToNow(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service clock decides what now is, not the wall clock
+	env.clock.now = testNow.Add(2 * time.Hour)
+	memberships, at, err := env.segments.GetUserSegmentsAt(1, time.Time{})
+	if err != nil || !at.Equal(env.clock.now) || len(memberships) != 0 {
+		t.Errorf("GetUserSegmentsAt(zero) = %v, %v, %v, want no segments at %v", memberships, at, err, env.clock.now)
+	}
+}
+
+func TestGetUserSegmentsAtReplaysInTimeOrder(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	// The removal was written before the add it follows, as when two transactions commit out of order
+	entries := []models.SegmentHistoryEntry{
+		{UserID: 1, SegmentID: 1, Operation: models.OperationRemove, Reason: models.ReasonManual, SegmentTime: testNow.Add(time.Hour)},
+		{UserID: 1, SegmentID: 1, Operation: models.OperationAdd, Reason: models.ReasonManual, SegmentTime: testNow},
+	}
+	for _, entry := range entries {
+		if err := env.store.LogSegmentHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for at, want := range map[time.Time]int{testNow: 1, testNow.Add(2 * time.Hour): 0} {
+		memberships, _, err := env.segments.GetUserSegmentsAt(1, at)
+		if err != nil || len(memberships) != want {
+			t.Errorf("GetUserSegmentsAt(%v) = %v, %v, want %d segments", at, memberships, err, want)
+		}
+	}
+}
+
+func TestGetUserSegmentsAtFollowsReschedule(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	for _, startsAt := range []time.Time{testNow.Add(time.Hour), testNow.Add(3 * time.Hour)} {
+		if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, StartsAt: startsAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for at, want := range map[time.Time]int{testNow.Add(2 * time.Hour): 0, testNow.Add(3 * time.Hour): 1} {
+		memberships, _, err := env.segments.GetUserSegmentsAt(1, at)
+		if err != nil || len(memberships) != want {
+			t.Errorf("GetUserSegmentsAt(%v) = %v, %v, want %d segments", at, memberships, err, want)
+		}
+	}
+}
+
+func TestDeleteSegmentLogsRemovals(t *testing.T) {
+	env := newTestEnv(t, 3, models.Segment{Slug: "AVITO_VOICE"})
+	memberships := map[int]time.Time{
+		1: {},                        // permanent
+		2: testNow.Add(time.Hour),    // still active
+		3: testNow.Add(-time.Minute), // already expired, but not swept yet
+	}
+	for userID, expiresAt := range memberships {
+		if err := env.store.AddMembership(userID, 1, time.Time{}, expiresAt, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatalf("DeleteSegment() error = %v", err)
+	}
+	// An expired member gets the expire it was due, the others a removal with the reason
+	wantHistory := []string{
+		"3 AVITO_VOICE expire expiry",
+		"1 AVITO_VOICE remove segment_deleted",
+		"2 AVITO_VOICE remove segment_deleted",
+	}
+	if got := env.history(t); !reflect.DeepEqual(got, wantHistory) {
+		t.Errorf("history after delete = %q, want %q", got, wantHistory)
+	}
+	if got := env.userSegments(t, 1); len(got) != 0 {
+		t.Errorf("segments of a member of a deleted segment = %v, want none", got)
+	}
+}
+
+func TestRestorePurgeSegment(t *testing.T) {
+	env := newTestEnv(t, 3, models.Segment{Slug: "AVITO_VOICE"})
+	memberships := map[int]time.Time{
+		1: {},                     // permanent
+		2: testNow.Add(time.Hour), // expires while the segment is deleted
+	}
+	for userID, expiresAt := range memberships {
+		if err := env.store.AddMembership(userID, 1, time.Time{}, expiresAt, models.SourceManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+	if segment, _, err := env.segments.GetSegment("AVITO_VOICE"); err != nil || segment.State() != models.SegmentStateArchived {
+		t.Errorf("GetSegment() = %s, %v, want the archived segment", segment.State(), err)
+	}
+
+	env.clock.now = testNow.Add(2 * time.Hour)
+	result, err := env.segments.RestoreSegment("AVITO_VOICE")
+	if err != nil {
+		t.Fatalf("RestoreSegment() error = %v", err)
+	}
+	if result.Memberships != 1 {
+		t.Errorf("RestoreSegment() restored %d memberships, want 1", result.Memberships)
+	}
+	wantHistory := []string{
+		"1 AVITO_VOICE remove segment_deleted",
+		"2 AVITO_VOICE remove segment_deleted",
+		"1 AVITO_VOICE add segment_restored",
+	}
+	if got := env.history(t); !reflect.DeepEqual(got, wantHistory) {
+		t.Errorf("history after restore = %q, want %q", got, wantHistory)
+	}
+	if got := env.userSegments(t, 1); !reflect.DeepEqual(got, []string{"AVITO_VOICE"}) {
+		t.Errorf("segments after restore = %v, want [AVITO_VOICE]", got)
+	}
+	if linked, _ := env.store.IsUserLinkedToSegment(2, 1); linked {
+		t.Error("a membership that expired while the segment was deleted was restored")
+	}
+	if _, err := env.segments.RestoreSegment("AVITO_VOICE"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("RestoreSegment() of an active segment error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := env.segments.PurgeSegment("AVITO_VOICE"); !errors.Is(err, ErrSegmentNotArchived) {
+		t.Errorf("PurgeSegment() of an active segment error = %v, want ErrSegmentNotArchived", err)
+	}
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := env.segments.PurgeSegment("AVITO_VOICE")
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeSegment() = %d, %v, want 1", purged, err)
+	}
+	if _, err := env.segments.PurgeSegment("AVITO_VOICE"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("PurgeSegment() twice error = %v, want ErrNotFound", err)
+	}
+	// The history of a purged segment is kept under its slug
+	if got := env.history(t); len(got) != len(wantHistory)+1 {
+		t.Errorf("history after purge = %q, want %d entries", got, len(wantHistory)+1)
+	}
+}
+
+func TestRestoreSegmentSlugTaken(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+	// A deleted segment frees its slug for a new one
+	if _, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); err != nil {
+		t.Fatalf("CreateSegment() after delete error = %v", err)
+	}
+	if _, err := env.segments.RestoreSegment("AVITO_VOICE"); !errors.Is(err, ErrSegmentSlugTaken) {
+		t.Errorf("RestoreSegment() over a taken slug error = %v, want ErrSegmentSlugTaken", err)
+	}
+}
+
+func TestUpdateSegment(t *testing.T) {
+	description, owner, tags := "Voice messages", "messenger", []string{"mobile", "beta"}
+	autoAdd, autoPct, defaultTTL := true, 30, 24*time.Hour
+	archived, active := models.SegmentStateArchived, models.SegmentStateActive
+
+	tests := []struct {
+		name          string
+		segment       models.Segment
+		update        SegmentUpdate
+		wantErr       error
+		wantChanges   []string
+		wantJob       bool
+		wantRebalance bool
+		wantState     string
+	}{
+		{
+			name:        "metadata",
+			update:      SegmentUpdate{Description: &description, Owner: &owner, Tags: &tags},
+			wantChanges: []string{`description: "" -> "Voice messages"`, `owner: "" -> "messenger"`, `tags: "" -> "beta,mobile"`},
+		},
+		{
+			name:        "unchanged values aren't logged",
+			segment:     models.Segment{Slug: "AVITO_VOICE", Owner: "messenger"},
+			update:      SegmentUpdate{Owner: &owner},
+			wantChanges: []string{},
+		},
+		{
+			name:        "enable auto_add",
+			segment:     models.Segment{Slug: "AVITO_VOICE", AutoPct: 30},
+			update:      SegmentUpdate{AutoAdd: &autoAdd},
+			wantChanges: []string{`auto_add: "false" -> "true"`},
+			wantJob:     true,
+		},
+		{
+			name:          "auto_pct re-balances",
+			segment:       models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 10},
+			update:        SegmentUpdate{AutoPct: &autoPct},
+			wantChanges:   []string{`auto_pct: "10" -> "30"`},
+			wantRebalance: true,
+		},
+		{
+			name:          "enable auto_add and change auto_pct",
+			segment:       models.Segment{Slug: "AVITO_VOICE", AutoPct: 10},
+			update:        SegmentUpdate{AutoAdd: &autoAdd, AutoPct: &autoPct},
+			wantChanges:   []string{`auto_pct: "10" -> "30"`, `auto_add: "false" -> "true"`},
+			wantRebalance: true,
+		},
+		{
+			name:        "auto_pct while auto_add stays off",
+			segment:     models.Segment{Slug: "AVITO_VOICE", AutoPct: 10},
+			update:      SegmentUpdate{AutoPct: &autoPct},
+			wantChanges: []string{`auto_pct: "10" -> "30"`},
+		},
+		{
+			name:        "archive and change auto_pct",
+			segment:     models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 10},
+			update:      SegmentUpdate{AutoPct: &autoPct, State: &archived},
+			wantChanges: []string{`auto_pct: "10" -> "30"`, `state: "active" -> "archived"`},
+			wantState:   models.SegmentStateArchived,
+		},
+		{
+			name:        "default ttl",
+			update:      SegmentUpdate{DefaultTTL: &defaultTTL},
+			wantChanges: []string{`default_ttl: "0s" -> "24h0m0s"`},
+		},
+		{
+			name:        "archive",
+			update:      SegmentUpdate{State: &archived},
+			wantChanges: []string{`state: "active" -> "archived"`},
+			wantState:   models.SegmentStateArchived,
+		},
+		{
+			name:        "activate an active segment",
+			update:      SegmentUpdate{State: &active},
+			wantChanges: []string{},
+		},
+		{name: "auto_pct unchanged at 0", update: SegmentUpdate{AutoPct: new(int)}, wantChanges: []string{}},
+		{name: "invalid auto_pct", update: SegmentUpdate{AutoPct: func() *int { pct := 101; return &pct }()}, wantErr: ErrInvalidAutoPct},
+		{name: "invalid tags", update: SegmentUpdate{Tags: &[]string{"Beta"}}, wantErr: ErrInvalidTags},
+		{name: "remove a missing default ttl", update: SegmentUpdate{DefaultTTL: new(time.Duration)}, wantChanges: []string{}},
+		{name: "too short default ttl", update: SegmentUpdate{DefaultTTL: func() *time.Duration { d := time.Millisecond; return &d }()}, wantErr: ErrInvalidDefaultTTL},
+		{name: "invalid state", update: SegmentUpdate{State: func() *string { s := "deleted"; return &s }()}, wantErr: ErrInvalidSegmentState},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.segment.Slug == "" {
+				tt.segment.Slug = "AVITO_VOICE"
+			}
+			env := newTestEnv(t, 0, tt.segment)
+
+			result, err := env.segments.UpdateSegment("AVITO_VOICE", tt.update)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateSegment() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			changes := []string{}
+			for _, change := range result.Changes {
+				changes = append(changes, fmt.Sprintf("%s: %q -> %q", change.Field, change.OldValue, change.NewValue))
+			}
+			if !reflect.DeepEqual(changes, tt.wantChanges) {
+				t.Errorf("changes = %q, want %q", changes, tt.wantChanges)
+			}
+			if _, audit, _ := env.segments.GetSegmentChanges("AVITO_VOICE"); len(audit) != len(tt.wantChanges) {
+				t.Errorf("segment_audit has %d entries, want %d", len(audit), len(tt.wantChanges))
+			}
+			if (result.JobID != 0) != tt.wantJob {
+				t.Errorf("job = %d, want a job: %v", result.JobID, tt.wantJob)
+			}
+			if (result.Rebalance != nil && result.Rebalance.JobID != 0) != tt.wantRebalance {
+				t.Errorf("rebalance = %+v, want a rebalance job: %v", result.Rebalance, tt.wantRebalance)
+			}
+			wantState := tt.wantState
+			if wantState == "" {
+				wantState = models.SegmentStateActive
+			}
+			if result.Segment.State() != wantState {
+				t.Errorf("state = %s, want %s", result.Segment.State(), wantState)
+			}
+		})
+	}
+}
+
+func TestUpdateSegmentRestores(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE", AutoAdd: true, AutoPct: 100})
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+
+	active := models.SegmentStateActive
+	result, err := env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{State: &active})
+	if err != nil {
+		t.Fatalf("UpdateSegment() error = %v", err)
+	}
+	if result.Restore == nil || result.Segment.State() != models.SegmentStateActive {
+		t.Errorf("UpdateSegment() = %+v, want the segment restored", result)
+	}
+	// Users created while the segment was deleted are enrolled by a job
+	job, err := env.store.GetJob(result.JobID)
+	if err != nil || job.Kind != models.JobKindRebalance {
+		t.Errorf("job after restoring an auto_add segment = %+v, %v, want a rebalance job", job, err)
+	}
+}
+
+func TestUpdateArchivedSegment(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.segments.DeleteSegment("AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+
+	pct := 30
+	if _, err := env.segments.UpdateSegment("AVITO_VOICE", SegmentUpdate{AutoPct: &pct}); !errors.Is(err, ErrSegmentArchived) {
+		t.Errorf("UpdateSegment() of a deleted segment error = %v, want %v", err, ErrSegmentArchived)
+	}
+}
+
+func TestCreateSegmentNormalizesTags(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE", Tags: []string{"mobile", "beta", "mobile"}})
+	segment, _, err := env.segments.GetSegment("AVITO_VOICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"beta", "mobile"}; !reflect.DeepEqual(segment.Tags, want) {
+		t.Errorf("tags = %v, want %v", segment.Tags, want)
+	}
+}
+
+func TestListSegments(t *testing.T) {
+	env := newTestEnv(t, 0,
+		models.Segment{Slug: "AVITO_E"},
+		models.Segment{Slug: "AVITO_C"},
+		models.Segment{Slug: "AVITO_A"},
+		models.Segment{Slug: "AVITO_D"},
+		models.Segment{Slug: "AVITO_B"},
+	)
+
+	tests := []struct {
+		name   string
+		filter repository.SegmentFilter
+		want   [][]string
+	}{
+		{
+			name:   "by slug",
+			filter: repository.SegmentFilter{Limit: 2},
+			want:   [][]string{{"AVITO_A", "AVITO_B"}, {"AVITO_C", "AVITO_D"}, {"AVITO_E"}},
+		},
+		{
+			name:   "by slug descending",
+			filter: repository.SegmentFilter{Descending: true, Limit: 3},
+			want:   [][]string{{"AVITO_E", "AVITO_D", "AVITO_C"}, {"AVITO_B", "AVITO_A"}},
+		},
+		{
+			// Segments created in the same instant are ordered by ID
+			name:   "by created_at",
+			filter: repository.SegmentFilter{SortBy: repository.SegmentSortCreatedAt, Limit: 2},
+			want:   [][]string{{"AVITO_E", "AVITO_C"}, {"AVITO_A", "AVITO_D"}, {"AVITO_B"}},
+		},
+		{
+			name:   "exact page",
+			filter: repository.SegmentFilter{Limit: 5},
+			want:   [][]string{{"AVITO_A", "AVITO_B", "AVITO_C", "AVITO_D", "AVITO_E"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pages [][]string
+			cursor := ""
+			for {
+				page, err := env.segments.ListSegments(tt.filter, cursor)
+				if err != nil {
+					t.Fatalf("ListSegments() error = %v", err)
+				}
+				var slugs []string
+				for _, segment := range page.Segments {
+					slugs = append(slugs, segment.Slug)
+				}
+				pages = append(pages, slugs)
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			if !reflect.DeepEqual(pages, tt.want) {
+				t.Errorf("pages = %v, want %v", pages, tt.want)
+			}
+		})
+	}
+
+	page, err := env.segments.ListSegments(repository.SegmentFilter{Limit: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cursor := range map[string]string{"malformed": "not a cursor!", "another order": page.NextCursor} {
+		filter := repository.SegmentFilter{SortBy: repository.SegmentSortCreatedAt, Limit: 1}
+		if _, err := env.segments.ListSegments(filter, cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ListSegments() with a %s cursor error = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
+
+func TestListSegmentMembers(t *testing.T) {
+	env := newTestEnv(t, 5, models.Segment{Slug: "AVITO_VOICE"})
+	for userID := 1; userID <= 5; userID++ {
+		update := SegmentsUpdate{UserID: userID, SegmentsToAdd: []string{"AVITO_VOICE"}}
+		if userID == 5 {
+			update.StartsAt = testNow.Add(time.Hour)
+		}
+		if _, err := env.users.UpdateUserSegments(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filter    repository.MemberFilter
+		want      [][]int
+		wantCount int
+	}{
+		{name: "all", filter: repository.MemberFilter{Limit: 2}, want: [][]int{{1, 2}, {3, 4}, {5}}, wantCount: 5},
+		{name: "active", filter: repository.MemberFilter{Status: models.MembershipStatusActive, Limit: 2}, want: [][]int{{1, 2}, {3, 4}}, wantCount: 4},
+		{name: "scheduled", filter: repository.MemberFilter{Status: models.MembershipStatusScheduled, Limit: 2}, want: [][]int{{5}}, wantCount: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pages [][]int
+			cursor := ""
+			for {
+				page, err := env.segments.ListSegmentMembers("AVITO_VOICE", tt.filter, cursor)
+				if err != nil {
+					t.Fatalf("ListSegmentMembers() error = %v", err)
+				}
+				if page.Slug != "AVITO_VOICE" {
+					t.Errorf("slug = %s, want AVITO_VOICE", page.Slug)
+				}
+				pages = append(pages, membershipUserIDs(page.Members))
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			if !reflect.DeepEqual(pages, tt.want) {
+				t.Errorf("pages = %v, want %v", pages, tt.want)
+			}
+
+			_, count, err := env.segments.CountSegmentMembers("AVITO_VOICE", tt.filter)
+			if err != nil || count != tt.wantCount {
+				t.Errorf("CountSegmentMembers() = %d, %v, want %d", count, err, tt.wantCount)
+			}
+		})
+	}
+
+	if _, err := env.segments.ListSegmentMembers("AVITO_VOICE", repository.MemberFilter{Limit: 2}, "%%%"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("ListSegmentMembers() with a malformed cursor error = %v, want ErrInvalidCursor", err)
+	}
+	if _, err := env.segments.ListSegmentMembers("AVITO_MISSING", repository.MemberFilter{Limit: 2}, ""); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ListSegmentMembers() of an unknown segment error = %v, want ErrNotFound", err)
+	}
+	_, counts, err := env.segments.GetSegment("AVITO_VOICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (models.SegmentMemberCounts{Active: 4, Manual: 4, Scheduled: 1}); counts != want {
+		t.Errorf("GetSegment() counts = %+v, want %+v", counts, want)
+	}
+}
+
+func membershipUserIDs(memberships []models.Membership) []int {
+	userIDs := []int{}
+	for _, membership := range memberships {
+		userIDs = append(userIDs, membership.UserID)
+	}
+	return userIDs
+}
+
+func TestCreateSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment models.Segment
+		wantErr error
+		wantJob bool
+	}{
+		{name: "valid", segment: models.Segment{Slug: "AVITO_VOICE_MESSAGES"}},
+		{name: "digits", segment: models.Segment{Slug: "AVITO_DISCOUNT_30"}},
+		{name: "auto_add creates a job", segment: models.Segment{Slug: "AVITO_AUTO", AutoAdd: true, AutoPct: 10}, wantJob: true},
+		{name: "auto_add at 0%", segment: models.Segment{Slug: "AVITO_AUTO", AutoAdd: true}},
+		{name: "lower case", segment: models.Segment{Slug: "avito_voice"}, wantErr: ErrInvalidSlug},
+		{name: "leading digit", segment: models.Segment{Slug: "30_DISCOUNT"}, wantErr: ErrInvalidSlug},
+		{name: "double underscore", segment: models.Segment{Slug: "AVITO__VOICE"}, wantErr: ErrInvalidSlug},
+		{name: "trailing underscore", segment: models.Segment{Slug: "AVITO_"}, wantErr: ErrInvalidSlug},
+		{name: "empty", segment: models.Segment{Slug: ""}, wantErr: ErrInvalidSlug},
+		{name: "too long", segment: models.Segment{Slug: "A" + strings.Repeat("_B", MaxSegmentSlugLength/2)}, wantErr: ErrInvalidSlug},
+		{name: "auto_pct above 100", segment: models.Segment{Slug: "AVITO_VOICE", AutoPct: 101}, wantErr: ErrInvalidAutoPct},
+		{name: "negative auto_pct", segment: models.Segment{Slug: "AVITO_VOICE", AutoPct: -1}, wantErr: ErrInvalidAutoPct},
+		{name: "long description", segment: models.Segment{Slug: "AVITO_VOICE", Description: strings.Repeat("я", MaxSegmentDescriptionLength+1)}, wantErr: ErrInvalidDescription},
+		{name: "long owner", segment: models.Segment{Slug: "AVITO_VOICE", Owner: strings.Repeat("a", MaxSegmentOwnerLength+1)}, wantErr: ErrInvalidOwner},
+		{name: "upper case tag", segment: models.Segment{Slug: "AVITO_VOICE", Tags: []string{"Mobile"}}, wantErr: ErrInvalidTags},
+		{name: "taken slug", segment: models.Segment{Slug: "AVITO_TAKEN"}, wantErr: ErrSegmentSlugTaken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_TAKEN"})
+
+			segmentID, jobID, err := env.segments.CreateSegment(tt.segment)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateSegment() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if (jobID != 0) != tt.wantJob {
+				t.Errorf("CreateSegment() job = %d, want a job: %v", jobID, tt.wantJob)
+			}
+			segment, err := env.store.GetSegmentByID(segmentID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if segment.Salt != tt.segment.Slug {
+				t.Errorf("salt = %q, want the slug", segment.Salt)
+			}
+		})
+	}
+}
+
+func TestRenameSegment(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE"}, models.Segment{Slug: "AVITO_DISCOUNT"})
+
+	segment, err := env.segments.RenameSegment("AVITO_VOICE", "AVITO_VOICE_MESSAGES")
+	if err != nil {
+		t.Fatalf("RenameSegment() error = %v", err)
+	}
+	if segment.Slug != "AVITO_VOICE_MESSAGES" || segment.Salt != "AVITO_VOICE" {
+		t.Errorf("renamed segment = %+v, want the new slug and the old salt", segment)
+	}
+
+	tests := []struct {
+		name    string
+		slug    string
+		newSlug string
+		wantErr error
+	}{
+		{name: "invalid slug", slug: "AVITO_VOICE_MESSAGES", newSlug: "voice", wantErr: ErrInvalidSlug},
+		{name: "slug of another segment", slug: "AVITO_VOICE_MESSAGES", newSlug: "AVITO_DISCOUNT", wantErr: ErrSegmentSlugTaken},
+		{name: "alias of another segment", slug: "AVITO_DISCOUNT", newSlug: "AVITO_VOICE", wantErr: ErrSegmentSlugTaken},
+		{name: "unknown segment", slug: "AVITO_MISSING", newSlug: "AVITO_FOUND", wantErr: repository.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := env.segments.RenameSegment(tt.slug, tt.newSlug); !errors.Is(err, tt.wantErr) {
+				t.Errorf("RenameSegment(%s, %s) error = %v, want %v", tt.slug, tt.newSlug, err, tt.wantErr)
+			}
+		})
+	}
+	if _, _, err := env.segments.CreateSegment(models.Segment{Slug: "AVITO_VOICE"}); !errors.Is(err, ErrSegmentSlugTaken) {
+		t.Errorf("CreateSegment() with an alias error = %v, want ErrSegmentSlugTaken", err)
+	}
+
+	// The old slug resolves to the segment until the alias is removed
+	if _, aliases, err := env.segments.ListSegmentAliases("AVITO_VOICE"); err != nil || len(aliases) != 1 || aliases[0].Alias != "AVITO_VOICE" {
+		t.Errorf("ListSegmentAliases() = %+v, %v, want [AVITO_VOICE]", aliases, err)
+	}
+	if err := env.segments.DeleteSegmentAlias("AVITO_VOICE_MESSAGES", "AVITO_VOICE"); err != nil {
+		t.Fatalf("DeleteSegmentAlias() error = %v", err)
+	}
+	if _, err := env.segments.GetSegmentIDBySlug("AVITO_VOICE"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetSegmentIDBySlug() of a removed alias error = %v, want ErrNotFound", err)
+	}
+
+	// Renaming back to an alias removes that alias
+	if _, err := env.segments.RenameSegment("AVITO_VOICE_MESSAGES", "AVITO_VOICE_2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.segments.RenameSegment("AVITO_VOICE_2", "AVITO_VOICE_MESSAGES"); err != nil {
+		t.Fatalf("RenameSegment() back to an alias error = %v", err)
+	}
+	_, aliases, _ := env.segments.ListSegmentAliases("AVITO_VOICE_MESSAGES")
+	if len(aliases) != 1 || aliases[0].Alias != "AVITO_VOICE_2" {
+		t.Errorf("aliases = %+v, want [AVITO_VOICE_2]", aliases)
+	}
+
+	_, changes, _ := env.segments.GetSegmentChanges("AVITO_VOICE_MESSAGES")
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s: %q -> %q", change.Field, change.OldValue, change.NewValue))
+	}
+	want := []string{
+		`slug: "AVITO_VOICE" -> "AVITO_VOICE_MESSAGES"`,
+		`alias: "AVITO_VOICE" -> ""`,
+		`slug: "AVITO_VOICE_MESSAGES" -> "AVITO_VOICE_2"`,
+		`slug: "AVITO_VOICE_2" -> "AVITO_VOICE_MESSAGES"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("segment_audit = %q, want %q", got, want)
+	}
+}
+
+func TestDeleteSegmentByAlias(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.segments.RenameSegment("AVITO_VOICE", "AVITO_VOICE_MESSAGES"); err != nil {
+		t.Fatal(err)
+	}
+
+	slug, err := env.segments.DeleteSegment("AVITO_VOICE")
+	if err != nil || slug != "AVITO_VOICE_MESSAGES" {
+		t.Fatalf("DeleteSegment() by alias = %q, %v, want the current slug", slug, err)
+	}
+	for _, slug := range []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES", "AVITO_MISSING"} {
+		if _, err := env.segments.DeleteSegment(slug); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("DeleteSegment(%s) error = %v, want ErrNotFound", slug, err)
+		}
+	}
+}
+
+func TestListSegmentMembersByAlias(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.segments.RenameSegment("AVITO_VOICE", "AVITO_VOICE_MESSAGES"); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := env.segments.ListSegmentMembers("AVITO_VOICE", repository.MemberFilter{Limit: 10}, "")
+	if err != nil || page.Slug != "AVITO_VOICE_MESSAGES" || !reflect.DeepEqual(membershipUserIDs(page.Members), []int{1}) {
+		t.Errorf("ListSegmentMembers() by alias = %+v, %v, want user 1 under the current slug", page, err)
+	}
+	slug, count, err := env.segments.CountSegmentMembers("AVITO_VOICE", repository.MemberFilter{})
+	if err != nil || slug != "AVITO_VOICE_MESSAGES" || count != 1 {
+		t.Errorf("CountSegmentMembers() by alias = %s, %d, %v, want 1 under the current slug", slug, count, err)
+	}
+}
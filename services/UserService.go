@@ -1,161 +1,433 @@
 package services
 
 import (
-	"database/sql"
-	_ "github.com/go-sql-driver/mysql"
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+// ErrInvalidUpdate is returned when a segments update contradicts itself.
+var ErrInvalidUpdate = errors.New("invalid segments update")
+
+// UnknownSegmentsError is returned by an all-or-nothing update that names segments that don't exist.
+type UnknownSegmentsError struct {
+	Slugs []string
+}
+
+func (e *UnknownSegmentsError) Error() string {
+	return fmt.Sprintf("segments don't exist: %s", strings.Join(e.Slugs, ", "))
+}
+
+// SegmentsUpdate is a set of membership changes for one user.
+type SegmentsUpdate struct {
+	UserID           int
+	SegmentsToAdd    []string
+	SegmentsToRemove []string
+	// StartsAt schedules added segments to become active later. Zero means immediately.
+	StartsAt time.Time
+	// Expiry of added segments: an absolute ExpiresAt, a TTL relative to the start, or Permanent.
+	// At most one may be set; when none is, each segment's DefaultTTL applies.
+	ExpiresAt time.Time
+	TTL       time.Duration
+	Permanent bool
+	// ExpiryPolicy decides the new expires_at when the user is already in a segment
+	// (models.ExpiryPolicyKeep, ExpiryPolicyExtend or ExpiryPolicyReplace). Defaults to replace.
+	ExpiryPolicy string
+	// Partial applies every slug on its own instead of all-or-nothing.
+	Partial bool
+}
+
 type UserService struct {
-	db *sql.DB // Database connection
+	store repository.Store // Storage backend
+	now   Clock            // Source of the current time
 }
 
-type SegmentHistoryEntry struct {
-	UserID      int
-	SegmentName string
-	Operation   string
-	SegmentTime time.Time
+func NewUserService(store repository.Store) *UserService {
+	return &UserService{store: store, now: time.Now}
 }
 
-func NewUserService(db *sql.DB) *UserService {
-	return &UserService{db: db}
+// SetClock replaces the clock used to timestamp history entries.
+func (u *UserService) SetClock(now Clock) {
+	u.now = now
 }
 
 // CreateUser @Summary Create User
 // @Tags users
-// @Description Create a new user
+// @Description Create a new user and enroll them into every auto_add segment at the segment's auto_pct.
 // @Produce json
 // @Success 200 {integer} int "User ID"
 func (u *UserService) CreateUser() (int, error) {
-	result, err := u.db.Exec("INSERT INTO users (created_at) VALUES (CURRENT_TIMESTAMP)")
-	if err != nil {
-		return 0, err
-	}
+	var userID int
+	err := u.store.WithinTx(func(tx repository.Store) error {
+		var err error
+		userID, err = tx.CreateUser()
+		if err != nil {
+			return err
+		}
+
+		segments, err := tx.ListAutoAddSegments()
+		if err != nil {
+			return err
+		}
 
-	userID, err := result.LastInsertId()
+		now := u.now()
+		for _, segment := range segments {
+			if !InRollout(segment.Salt, userID, segment.AutoPct) {
+				continue
+			}
+			expiresAt := defaultExpiry(segment, now)
+			if err := tx.AddMembership(userID, segment.ID, time.Time{}, expiresAt, models.SourceAuto); err != nil {
+				return err
+			}
+			err := tx.LogSegmentHistory(models.SegmentHistoryEntry{
+				UserID:      userID,
+				SegmentID:   segment.ID,
+				Operation:   models.OperationAdd,
+				Reason:      models.ReasonAutoAdd,
+				SegmentTime: now,
+				ExpiresAt:   expiresAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return int(userID), nil
+	return userID, nil
 }
 
-// AddUserToSegment @Summary Add User to Segment
+// UpdateUserSegments @Summary Update user segments
 // @Tags users
-// @Description Add user to a segment
-// @Accept json
-// @Produce json
-// @Param user_id body int true "User ID"
-// @Param segments_to_add body []string true "Segments to add"
-// @Param segments_to_remove body []string false "Segments to remove"
-// @Param expires_at body string true "Expiry timestamp (RFC3339 format)"
-// @Success 200 {string} string "Success message"
-func (u *UserService) AddUserToSegment(userID int, segmentID int, expiresAt time.Time) error {
-	_, err := u.db.Exec("INSERT INTO user_segments (user_id, segment_id, expires_at) VALUES (?, ?, ?)", userID, segmentID, expiresAt)
-	if err != nil {
-		return err
+// @Description Add and remove segments of a user. By default every slug is resolved first and all changes,
+// @Description together with their history rows, are applied in a single transaction: either all of them
+// @Description succeed or none does. With Partial set, each slug is applied in its own transaction and
+// @Description problems with one slug are reported in the messages without affecting the others.
+// @Description Adding a segment the user is already in renews the membership: its expires_at is updated
+// @Description according to ExpiryPolicy and a "renew" operation is logged. A membership that hasn't started
+// @Description yet moves to the requested start. An expired membership the sweeper hasn't removed yet is
+// @Description logged as "expire" and added again.
+// @Success 200 {array} string "One message per requested slug"
+func (u *UserService) UpdateUserSegments(update SegmentsUpdate) ([]string, error) {
+	switch update.ExpiryPolicy {
+	case "":
+		update.ExpiryPolicy = models.ExpiryPolicyReplace
+	case models.ExpiryPolicyKeep, models.ExpiryPolicyExtend, models.ExpiryPolicyReplace:
+	default:
+		return nil, fmt.Errorf(`%w: unknown expiry policy "%s", expected keep, extend or replace`, ErrInvalidUpdate, update.ExpiryPolicy)
 	}
-	return nil
-}
 
-func (u *UserService) RemoveUserFromSegment(userID int, segmentID int) error {
-	_, err := u.db.Exec("DELETE FROM user_segments WHERE user_id = ? AND segment_id = ?", userID, segmentID)
-	if err != nil {
-		return err
+	expirySettings := 0
+	for _, set := range []bool{!update.ExpiresAt.IsZero(), update.TTL != 0, update.Permanent} {
+		if set {
+			expirySettings++
+		}
 	}
-	return nil
-}
-
-func (u *UserService) GetAllUserIDs() ([]int, error) {
-	query := "SELECT id FROM users"
-	rows, err := u.db.Query(query)
-	if err != nil {
-		return nil, err
+	if expirySettings > 1 {
+		return nil, fmt.Errorf("%w: expires_at, ttl and permanent are mutually exclusive", ErrInvalidUpdate)
+	}
+	if update.TTL < 0 {
+		return nil, fmt.Errorf("%w: ttl must be positive", ErrInvalidUpdate)
+	}
+	if !update.ExpiresAt.IsZero() && !update.ExpiresAt.After(u.now()) {
+		return nil, fmt.Errorf("%w: expires_at must be in the future", ErrInvalidUpdate)
+	}
+	if !update.StartsAt.IsZero() && !update.ExpiresAt.IsZero() && !update.ExpiresAt.After(update.StartsAt) {
+		return nil, fmt.Errorf("%w: expires_at must be after starts_at", ErrInvalidUpdate)
 	}
-	defer rows.Close()
 
-	var userIDs []int
-	for rows.Next() {
-		var userID int
-		if err := rows.Scan(&userID); err != nil {
-			return nil, err
+	for _, slugToAdd := range update.SegmentsToAdd {
+		for _, slugToRemove := range update.SegmentsToRemove {
+			if slugToAdd == slugToRemove {
+				return nil, fmt.Errorf(`%w: "%s" is both added and removed`, ErrInvalidUpdate, slugToAdd)
+			}
 		}
-		userIDs = append(userIDs, userID)
 	}
 
-	return userIDs, nil
-}
+	if update.Partial {
+		return u.updateUserSegmentsPartially(update)
+	}
 
-func (u *UserService) LogSegmentHistory(userID int, segmentID int, operation string, timestamp time.Time) error {
-	_, err := u.db.Exec("INSERT INTO segment_history (user_id, segment_id, operation, timestamp) VALUES (?, ?, ?, ?)", userID, segmentID, operation, timestamp)
+	var messages []string
+	err := u.store.WithinTx(func(tx repository.Store) error {
+		segmentsToAdd, unknownToAdd, err := resolveSegmentSlugs(tx, update.SegmentsToAdd)
+		if err != nil {
+			return err
+		}
+		segmentsToRemove, unknownToRemove, err := resolveSegmentSlugs(tx, update.SegmentsToRemove)
+		if err != nil {
+			return err
+		}
+		if unknown := append(unknownToAdd, unknownToRemove...); len(unknown) > 0 {
+			return &UnknownSegmentsError{Slugs: unknown}
+		}
+		// A segment can also be named by its slug in one list and by an alias in the other
+		for _, segmentToAdd := range segmentsToAdd {
+			for _, segmentToRemove := range segmentsToRemove {
+				if segmentToAdd.ID == segmentToRemove.ID {
+					return fmt.Errorf(`%w: "%s" is both added and removed`, ErrInvalidUpdate, segmentToAdd.Slug)
+				}
+			}
+		}
+
+		now := u.now()
+		for _, segment := range segmentsToAdd {
+			message, err := addUserToSegment(tx, update, segment, now)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+		}
+
+		for _, segment := range segmentsToRemove {
+			removed, err := removeUserFromSegment(tx, update.UserID, segment.ID, now)
+			if err != nil {
+				return err
+			}
+			if !removed {
+				messages = append(messages, fmt.Sprintf(`"%s" is not linked to the user`, segment.Slug))
+				continue
+			}
+			messages = append(messages, fmt.Sprintf(`"%s" removed successfully`, segment.Slug))
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	return messages, nil
 }
 
-func (u *UserService) GetSegmentHistoryByPeriod(year, month int) ([]SegmentHistoryEntry, error) {
-	// Define a struct to hold segment history entries
+// updateUserSegmentsPartially applies every slug in its own transaction.
+func (u *UserService) updateUserSegmentsPartially(update SegmentsUpdate) ([]string, error) {
+	var messages []string
 
-	var segmentHistory []SegmentHistoryEntry
+	for _, slug := range update.SegmentsToAdd {
+		var message string
+		err := u.store.WithinTx(func(tx repository.Store) error {
+			segment, err := tx.GetSegmentBySlug(slug)
+			if errors.Is(err, repository.ErrNotFound) {
+				message = fmt.Sprintf(`"%s" doesn't exist`, slug)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 
-	query := `
-		SELECT user_id, segments.slug, operation, timestamp
-		FROM segment_history
-		JOIN segments ON segment_history.segment_id = segments.id
-		WHERE YEAR(timestamp) = ? AND MONTH(timestamp) = ?
-	`
-	rows, err := u.db.Query(query, year, month)
-	if err != nil {
-		return nil, err
+			message, err = addUserToSegment(tx, update, segment, u.now())
+			return err
+		})
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var entry SegmentHistoryEntry
-		var timestampStr string // Declare a string to hold the timestamp as string
+	for _, slug := range update.SegmentsToRemove {
+		var message string
+		err := u.store.WithinTx(func(tx repository.Store) error {
+			segment, err := tx.GetSegmentBySlug(slug)
+			if errors.Is(err, repository.ErrNotFound) {
+				message = fmt.Sprintf(`"%s" doesn't exist`, slug)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 
-		if err := rows.Scan(&entry.UserID, &entry.SegmentName, &entry.Operation, &timestampStr); err != nil {
-			return nil, err
+			removed, err := removeUserFromSegment(tx, update.UserID, segment.ID, u.now())
+			if err != nil {
+				return err
+			}
+			if !removed {
+				message = fmt.Sprintf(`"%s" is not linked to the user`, segment.Slug)
+				return nil
+			}
+			message = fmt.Sprintf(`"%s" removed successfully`, segment.Slug)
+			return nil
+		})
+		if err != nil {
+			return messages, err
 		}
+		messages = append(messages, message)
+	}
 
-		entry.SegmentTime, err = time.Parse("2006-01-02 15:04:05", timestampStr) // Parse the timestamp string
+	return messages, nil
+}
+
+// resolveSegmentSlugs looks up the given slugs and returns the slugs that don't exist separately.
+func resolveSegmentSlugs(tx repository.Store, slugs []string) ([]models.Segment, []string, error) {
+	segments := make([]models.Segment, 0, len(slugs))
+	var unknown []string
+	for _, slug := range slugs {
+		segment, err := tx.GetSegmentBySlug(slug)
+		if errors.Is(err, repository.ErrNotFound) {
+			unknown = append(unknown, slug)
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		segments = append(segments, segment)
+	}
+	return segments, unknown, nil
+}
 
-		segmentHistory = append(segmentHistory, entry)
+// startsAt returns when an added membership becomes active. A zero time means immediately.
+func (update SegmentsUpdate) startsAt(now time.Time) time.Time {
+	if update.StartsAt.After(now) {
+		return update.StartsAt
 	}
+	return time.Time{}
+}
 
-	return segmentHistory, nil
+// expiresAt returns the requested expiry of a membership in segment. A zero time means it never expires.
+// TTLs count from the membership's start.
+func (update SegmentsUpdate) expiresAt(segment models.Segment, now time.Time) time.Time {
+	if startsAt := update.startsAt(now); !startsAt.IsZero() {
+		now = startsAt
+	}
+	switch {
+	case update.Permanent:
+		return time.Time{}
+	case !update.ExpiresAt.IsZero():
+		return update.ExpiresAt
+	case update.TTL != 0:
+		return now.Add(update.TTL)
+	default:
+		return defaultExpiry(segment, now)
+	}
 }
 
-func (u *UserService) AddUserToSegments(userID int, segmentIDsToAdd []int, segmentIDsToRemove []int, expiresAt time.Time) error {
-	tx, err := u.db.Begin()
-	if err != nil {
-		return err
+// defaultExpiry applies a segment's default TTL. A zero time means the membership never expires.
+func defaultExpiry(segment models.Segment, now time.Time) time.Time {
+	if segment.DefaultTTL == 0 {
+		return time.Time{}
 	}
+	return now.Add(segment.DefaultTTL)
+}
 
-	for _, segmentToAdd := range segmentIDsToAdd {
-		_, err = tx.Exec("INSERT INTO user_segments (user_id, segment_id, expires_at) VALUES (?, ?, ?)", userID, segmentToAdd, expiresAt)
+// addUserToSegment adds a manual membership, or renews it if the user is already
+// in the segment, logs the operation and returns the message for the response.
+func addUserToSegment(tx repository.Store, update SegmentsUpdate, segment models.Segment, now time.Time) (string, error) {
+	segmentID := segment.ID
+	slug := segment.Slug // reported even if the segment was requested by an alias
+	requestedExpiresAt := update.expiresAt(segment, now)
+
+	membership, err := tx.GetMembership(update.UserID, segmentID)
+	if err == nil && !membership.ExpiresAt.IsZero() && !membership.ExpiresAt.After(now) {
+		// An expired membership that the sweeper hasn't removed yet is expired here and added anew
+		removed, removeErr := tx.RemoveExpiredMembership(update.UserID, segmentID, now)
+		if removeErr != nil {
+			return "", removeErr
+		}
+		if removed {
+			err := tx.LogSegmentHistory(models.SegmentHistoryEntry{
+				UserID:      update.UserID,
+				SegmentID:   segmentID,
+				Operation:   models.OperationExpire,
+				Reason:      models.ReasonExpiry,
+				SegmentTime: now,
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		membership, err = tx.GetMembership(update.UserID, segmentID)
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		startsAt := update.startsAt(now)
+		if err := tx.AddMembership(update.UserID, segmentID, startsAt, requestedExpiresAt, models.SourceManual); err != nil {
+			return "", err
+		}
+		err := tx.LogSegmentHistory(models.SegmentHistoryEntry{
+			UserID:      update.UserID,
+			SegmentID:   segmentID,
+			Operation:   models.OperationAdd,
+			Reason:      models.ReasonManual,
+			SegmentTime: now,
+			StartsAt:    startsAt,
+			ExpiresAt:   requestedExpiresAt,
+		})
 		if err != nil {
-			tx.Rollback()
-			return err
+			return "", err
+		}
+		if !startsAt.IsZero() {
+			return fmt.Sprintf(`"%s" scheduled to start at %s`, slug, startsAt.Format(time.RFC3339)), nil
 		}
+		return fmt.Sprintf(`"%s" added successfully`, slug), nil
+	}
+	if err != nil {
+		return "", err
 	}
 
-	for _, segmentToRemove := range segmentIDsToRemove {
-		_, err = tx.Exec("DELETE FROM user_segments WHERE user_id = ? AND segment_id = ?", userID, segmentToRemove)
-		if err != nil {
-			tx.Rollback()
-			return err
+	startsAt := membership.StartsAt
+	if startsAt.After(now) {
+		// A membership that hasn't started yet is rescheduled to the requested start
+		startsAt = update.startsAt(now)
+		if err := tx.UpdateMembershipStart(update.UserID, segmentID, startsAt); err != nil {
+			return "", err
 		}
 	}
+	expiresAt := renewedExpiry(membership.ExpiresAt, requestedExpiresAt, update.ExpiryPolicy)
 
-	err = tx.Commit()
+	if err := tx.UpdateMembershipExpiry(update.UserID, segmentID, expiresAt); err != nil {
+		return "", err
+	}
+	err = tx.LogSegmentHistory(models.SegmentHistoryEntry{
+		UserID:      update.UserID,
+		SegmentID:   segmentID,
+		Operation:   models.OperationRenew,
+		Reason:      models.ReasonManual,
+		SegmentTime: now,
+		StartsAt:    startsAt,
+		ExpiresAt:   expiresAt,
+	})
 	if err != nil {
-		return err
+		return "", err
+	}
+	return fmt.Sprintf(`"%s" renewed with expiry policy "%s"`, slug, update.ExpiryPolicy), nil
+}
+
+// renewedExpiry applies an expiry policy. A zero time means the membership never expires.
+func renewedExpiry(stored time.Time, requested time.Time, policy string) time.Time {
+	switch policy {
+	case models.ExpiryPolicyKeep:
+		return stored
+	case models.ExpiryPolicyExtend:
+		if stored.IsZero() || requested.IsZero() {
+			return time.Time{}
+		}
+		if requested.After(stored) {
+			return requested
+		}
+		return stored
+	default:
+		return requested
 	}
+}
 
-	return nil
+// removeUserFromSegment removes a membership and logs it. It reports false if the user wasn't linked.
+func removeUserFromSegment(tx repository.Store, userID int, segmentID int, now time.Time) (bool, error) {
+	isLinked, err := tx.IsUserLinkedToSegment(userID, segmentID)
+	if err != nil || !isLinked {
+		return false, err
+	}
+	if err := tx.RemoveMembership(userID, segmentID); err != nil {
+		return false, err
+	}
+	return true, tx.LogSegmentHistory(models.SegmentHistoryEntry{
+		UserID:      userID,
+		SegmentID:   segmentID,
+		Operation:   models.OperationRemove,
+		Reason:      models.ReasonManual,
+		SegmentTime: now,
+	})
 }
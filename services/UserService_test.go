@@ -0,0 +1,572 @@
+package services
+
+import (
+	"avitoGoProject/models"
+	"avitoGoProject/repository"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// testClock is a clock the tests move by hand.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// testEnv wires the services to one in-memory store and one clock.
+type testEnv struct {
+	store    *repository.MemoryStore
+	clock    *testClock
+	users    *UserService
+	segments *SegmentService
+}
+
+// newTestEnv creates the given number of users and segments, in that order.
+func newTestEnv(t *testing.T, users int, segments ...models.Segment) *testEnv {
+	t.Helper()
+	env := &testEnv{store: repository.NewMemoryStore(), clock: &testClock{now: testNow}}
+	env.users = NewUserService(env.store)
+	env.users.SetClock(env.clock.Now)
+	env.segments = NewSegmentService(env.store)
+	env.segments.SetClock(env.clock.Now)
+
+	for i := 0; i < users; i++ {
+		if _, err := env.store.CreateUser(); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	for _, segment := range segments {
+		if _, _, err := env.segments.CreateSegment(segment); err != nil {
+			t.Fatalf("CreateSegment(%s) error = %v", segment.Slug, err)
+		}
+	}
+	return env
+}
+
+// history returns the history entries of the first day after testNow as "user slug operation reason".
+func (e *testEnv) history(t *testing.T) []string {
+	t.Helper()
+	var entries []string
+	filter := repository.HistoryFilter{From: testNow.Add(-time.Hour), To: testNow.Add(24 * time.Hour)}
+	err := e.store.StreamSegmentHistory(filter, func(entry models.SegmentHistoryEntry) error {
+		entries = append(entries, strings.Join([]string{strconv.Itoa(entry.UserID), entry.SegmentName, entry.Operation, entry.Reason}, " "))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamSegmentHistory() error = %v", err)
+	}
+	return entries
+}
+
+// userSegments returns the slugs of the segments a user is in at the clock's time.
+func (e *testEnv) userSegments(t *testing.T, userID int) []string {
+	t.Helper()
+	memberships, err := e.segments.GetUserSegments(userID)
+	if err != nil {
+		t.Fatalf("GetUserSegments() error = %v", err)
+	}
+	slugs := []string{}
+	for _, membership := range memberships {
+		slugs = append(slugs, membership.SegmentSlug)
+	}
+	return slugs
+}
+
+// membership returns a user's membership in the segment with the slug.
+func (e *testEnv) membership(t *testing.T, userID int, slug string) models.Membership {
+	t.Helper()
+	segmentID, err := e.store.GetSegmentIDBySlug(slug)
+	if err != nil {
+		t.Fatalf("GetSegmentIDBySlug(%s) error = %v", slug, err)
+	}
+	membership, err := e.store.GetMembership(userID, segmentID)
+	if err != nil {
+		t.Fatalf("GetMembership(%d, %s) error = %v", userID, slug, err)
+	}
+	return membership
+}
+
+func TestCreateUser(t *testing.T) {
+	env := newTestEnv(t, 0, models.Segment{Slug: "AVITO_VOICE_MESSAGES"})
+
+	for want := 1; want <= 3; want++ {
+		userID, err := env.users.CreateUser()
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		if userID != want {
+			t.Errorf("CreateUser() = %d, want %d", userID, want)
+		}
+		if got := env.userSegments(t, userID); len(got) != 0 {
+			t.Errorf("new user %d is in %v", userID, got)
+		}
+	}
+	if history := env.history(t); len(history) != 0 {
+		t.Errorf("creating users logged %q", history)
+	}
+}
+
+func TestCreateUserEnrollsIntoAutoAddSegments(t *testing.T) {
+	env := newTestEnv(t, 0,
+		models.Segment{Slug: "AVITO_EVERYONE", AutoAdd: true, AutoPct: 100},
+		models.Segment{Slug: "AVITO_HALF", AutoAdd: true, AutoPct: 50, DefaultTTL: time.Hour},
+		models.Segment{Slug: "AVITO_MANUAL", AutoPct: 100},
+		models.Segment{Slug: "AVITO_NOBODY", AutoAdd: true, AutoPct: 0},
+	)
+
+	inHalf := 0
+	for i := 0; i < 200; i++ {
+		userID, err := env.users.CreateUser()
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		want := []string{"AVITO_EVERYONE"}
+		if InRollout("AVITO_HALF", userID, 50) {
+			want = append(want, "AVITO_HALF")
+			inHalf++
+			if membership := env.membership(t, userID, "AVITO_HALF"); !membership.ExpiresAt.Equal(testNow.Add(time.Hour)) {
+				t.Errorf("user %d expires_at = %v, want the segment's default TTL", userID, membership.ExpiresAt)
+			}
+		}
+		if got := env.userSegments(t, userID); !reflect.DeepEqual(got, want) {
+			t.Errorf("user %d segments = %v, want %v", userID, got, want)
+		}
+		if membership := env.membership(t, userID, "AVITO_EVERYONE"); membership.Source != models.SourceAuto {
+			t.Errorf("user %d source = %s, want auto", userID, membership.Source)
+		}
+	}
+
+	// Every enrollment is logged in the same transaction as the user
+	history := env.history(t)
+	if len(history) != 200+inHalf {
+		t.Errorf("history has %d entries, want %d", len(history), 200+inHalf)
+	}
+	for _, entry := range history {
+		if !strings.HasSuffix(entry, " add auto_add") {
+			t.Errorf("history entry %q, want add auto_add", entry)
+		}
+	}
+}
+
+func TestUpdateUserSegments(t *testing.T) {
+	tests := []struct {
+		name         string
+		update       SegmentsUpdate
+		wantMessages []string
+		wantErr      error
+		wantSegments []string
+		wantHistory  []string
+	}{
+		{
+			name:         "add and remove",
+			update:       SegmentsUpdate{SegmentsToAdd: []string{"AVITO_VOICE"}, SegmentsToRemove: []string{"AVITO_DISCOUNT"}},
+			wantMessages: []string{`"AVITO_VOICE" added successfully`, `"AVITO_DISCOUNT" removed successfully`},
+			wantSegments: []string{"AVITO_VOICE"},
+			wantHistory:  []string{"1 AVITO_DISCOUNT add manual", "1 AVITO_VOICE add manual", "1 AVITO_DISCOUNT remove manual"},
+		},
+		{
+			name:         "remove a segment the user isn't in",
+			update:       SegmentsUpdate{SegmentsToRemove: []string{"AVITO_VOICE"}},
+			wantMessages: []string{`"AVITO_VOICE" is not linked to the user`},
+			wantSegments: []string{"AVITO_DISCOUNT"},
+			wantHistory:  []string{"1 AVITO_DISCOUNT add manual"},
+		},
+		{
+			name:         "unknown segment rolls back everything",
+			update:       SegmentsUpdate{SegmentsToAdd: []string{"AVITO_VOICE", "AVITO_MISSING"}, SegmentsToRemove: []string{"AVITO_DISCOUNT"}},
+			wantErr:      &UnknownSegmentsError{},
+			wantSegments: []string{"AVITO_DISCOUNT"},
+			wantHistory:  []string{"1 AVITO_DISCOUNT add manual"},
+		},
+		{
+			name:   "partial applies what it can",
+			update: SegmentsUpdate{SegmentsToAdd: []string{"AVITO_VOICE", "AVITO_MISSING"}, SegmentsToRemove: []string{"AVITO_DISCOUNT"}, Partial: true},
+			wantMessages: []string{
+				`"AVITO_VOICE" added successfully`,
+				`"AVITO_MISSING" doesn't exist`,
+				`"AVITO_DISCOUNT" removed successfully`,
+			},
+			wantSegments: []string{"AVITO_VOICE"},
+			wantHistory:  []string{"1 AVITO_DISCOUNT add manual", "1 AVITO_VOICE add manual", "1 AVITO_DISCOUNT remove manual"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"}, models.Segment{Slug: "AVITO_DISCOUNT"})
+			if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_DISCOUNT"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.update.UserID = 1
+			messages, err := env.users.UpdateUserSegments(tt.update)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("UpdateUserSegments() error = %v", err)
+				}
+			case *UnknownSegmentsError:
+				if !errors.As(err, &want) || !reflect.DeepEqual(want.Slugs, []string{"AVITO_MISSING"}) {
+					t.Fatalf("UpdateUserSegments() error = %v, want unknown AVITO_MISSING", err)
+				}
+			default:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("UpdateUserSegments() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(messages, tt.wantMessages) {
+				t.Errorf("UpdateUserSegments() = %q, want %q", messages, tt.wantMessages)
+			}
+			if got := env.userSegments(t, 1); !reflect.DeepEqual(got, tt.wantSegments) {
+				t.Errorf("user segments = %v, want %v", got, tt.wantSegments)
+			}
+			if got := env.history(t); !reflect.DeepEqual(got, tt.wantHistory) {
+				t.Errorf("history = %q, want %q", got, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSegmentsByAlias(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_SOUND"})
+	if _, err := env.segments.RenameSegment("AVITO_SOUND", "AVITO_VOICE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages and history name the segment by its current slug
+	messages, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_SOUND"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`"AVITO_VOICE" added successfully`}; !reflect.DeepEqual(messages, want) {
+		t.Errorf("UpdateUserSegments() = %q, want %q", messages, want)
+	}
+	if got := env.userSegments(t, 1); !reflect.DeepEqual(got, []string{"AVITO_VOICE"}) {
+		t.Errorf("user segments = %v, want [AVITO_VOICE]", got)
+	}
+
+	// A slug and its alias are the same segment, so adding one and removing the other is a conflict
+	_, err = env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, SegmentsToRemove: []string{"AVITO_SOUND"}})
+	if !errors.Is(err, ErrInvalidUpdate) {
+		t.Errorf("UpdateUserSegments() of a slug and its alias error = %v, want %v", err, ErrInvalidUpdate)
+	}
+	if want := []string{"1 AVITO_VOICE add manual"}; !reflect.DeepEqual(env.history(t), want) {
+		t.Errorf("history = %q, want %q", env.history(t), want)
+	}
+}
+
+// failingHistoryStore fails every history write, like a database that drops the connection mid-update.
+type failingHistoryStore struct {
+	repository.Store
+}
+
+var errHistoryFailed = errors.New("history write failed")
+
+func (s *failingHistoryStore) WithinTx(fn func(tx repository.Store) error) error {
+	return s.Store.WithinTx(func(tx repository.Store) error {
+		return fn(&failingHistoryStore{Store: tx})
+	})
+}
+
+func (s *failingHistoryStore) LogSegmentHistory(models.SegmentHistoryEntry) error {
+	return errHistoryFailed
+}
+
+func TestUpdateUserSegmentsRollsBackWithHistory(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	users := NewUserService(&failingHistoryStore{Store: env.store})
+	users.SetClock(env.clock.Now)
+
+	_, err := users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}})
+	if !errors.Is(err, errHistoryFailed) {
+		t.Fatalf("UpdateUserSegments() error = %v, want the history error", err)
+	}
+	// The membership is only kept together with its history row
+	if got := env.userSegments(t, 1); len(got) != 0 {
+		t.Errorf("user segments = %v, want the add rolled back", got)
+	}
+}
+
+func TestUpdateUserSegmentsUnknownUser(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	_, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 2, SegmentsToAdd: []string{"AVITO_VOICE"}})
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUserSegments() for an unknown user error = %v, want ErrNotFound", err)
+	}
+	if got := env.history(t); len(got) != 0 {
+		t.Errorf("history = %q, want nothing logged", got)
+	}
+}
+
+func TestUpdateUserSegmentsRenew(t *testing.T) {
+	tests := []struct {
+		name          string
+		storedExpiry  time.Time
+		update        SegmentsUpdate
+		wantExpiresAt time.Time
+		wantPolicy    string
+	}{
+		{name: "replace by default", storedExpiry: testNow.Add(2 * time.Hour), update: SegmentsUpdate{TTL: time.Hour}, wantExpiresAt: testNow.Add(time.Hour), wantPolicy: "replace"},
+		{name: "keep", storedExpiry: testNow.Add(time.Hour), update: SegmentsUpdate{TTL: 2 * time.Hour, ExpiryPolicy: "keep"}, wantExpiresAt: testNow.Add(time.Hour), wantPolicy: "keep"},
+		{name: "extend to a later expiry", storedExpiry: testNow.Add(time.Hour), update: SegmentsUpdate{TTL: 2 * time.Hour, ExpiryPolicy: "extend"}, wantExpiresAt: testNow.Add(2 * time.Hour), wantPolicy: "extend"},
+		{name: "extend never shortens", storedExpiry: testNow.Add(2 * time.Hour), update: SegmentsUpdate{TTL: time.Hour, ExpiryPolicy: "extend"}, wantExpiresAt: testNow.Add(2 * time.Hour), wantPolicy: "extend"},
+		{name: "extend to permanent", storedExpiry: testNow.Add(time.Hour), update: SegmentsUpdate{Permanent: true, ExpiryPolicy: "extend"}, wantPolicy: "extend"},
+		{name: "extend keeps permanent", update: SegmentsUpdate{TTL: time.Hour, ExpiryPolicy: "extend"}, wantPolicy: "extend"},
+		{name: "replace permanent", update: SegmentsUpdate{TTL: time.Hour}, wantExpiresAt: testNow.Add(time.Hour), wantPolicy: "replace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+			if err := env.store.AddMembership(1, 1, time.Time{}, tt.storedExpiry, models.SourceManual); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.update.UserID = 1
+			tt.update.SegmentsToAdd = []string{"AVITO_VOICE"}
+			messages, err := env.users.UpdateUserSegments(tt.update)
+			if err != nil {
+				t.Fatalf("UpdateUserSegments() error = %v", err)
+			}
+			wantMessage := `"AVITO_VOICE" renewed with expiry policy "` + tt.wantPolicy + `"`
+			if !reflect.DeepEqual(messages, []string{wantMessage}) {
+				t.Errorf("UpdateUserSegments() = %q, want %q", messages, wantMessage)
+			}
+			if membership := env.membership(t, 1, "AVITO_VOICE"); !membership.ExpiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("expires_at = %v, want %v", membership.ExpiresAt, tt.wantExpiresAt)
+			}
+			if got := env.history(t); !reflect.DeepEqual(got, []string{"1 AVITO_VOICE renew manual"}) {
+				t.Errorf("history = %q, want one renew", got)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSegmentsReAddsExpiredMembership(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	if err := env.store.AddMembership(1, 1, testNow.Add(-2*time.Hour), testNow.Add(-time.Minute), models.SourceManual); err != nil {
+		t.Fatal(err)
+	}
+
+	update := SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, TTL: time.Hour, ExpiryPolicy: "keep"}
+	messages, err := env.users.UpdateUserSegments(update)
+	if err != nil {
+		t.Fatalf("UpdateUserSegments() error = %v", err)
+	}
+	if want := []string{`"AVITO_VOICE" added successfully`}; !reflect.DeepEqual(messages, want) {
+		t.Errorf("UpdateUserSegments() = %q, want %q", messages, want)
+	}
+
+	membership := env.membership(t, 1, "AVITO_VOICE")
+	if !membership.StartsAt.IsZero() || !membership.ExpiresAt.Equal(testNow.Add(time.Hour)) {
+		t.Errorf("membership = %+v, want it to start now and expire in an hour", membership)
+	}
+	want := []string{"1 AVITO_VOICE expire expiry", "1 AVITO_VOICE add manual"}
+	if got := env.history(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
+
+func TestUpdateUserSegmentsReschedules(t *testing.T) {
+	tests := []struct {
+		name         string
+		storedStart  time.Time
+		startsAt     time.Time
+		wantStartsAt time.Time
+	}{
+		{name: "scheduled moves to the new start", storedStart: testNow.Add(2 * time.Hour), startsAt: testNow.Add(4 * time.Hour), wantStartsAt: testNow.Add(4 * time.Hour)},
+		{name: "scheduled starts now without a start", storedStart: testNow.Add(2 * time.Hour)},
+		{name: "active keeps its start", storedStart: testNow.Add(-time.Hour), startsAt: testNow.Add(4 * time.Hour), wantStartsAt: testNow.Add(-time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+			if err := env.store.AddMembership(1, 1, tt.storedStart, time.Time{}, models.SourceManual); err != nil {
+				t.Fatal(err)
+			}
+
+			update := SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, StartsAt: tt.startsAt, TTL: time.Hour}
+			if _, err := env.users.UpdateUserSegments(update); err != nil {
+				t.Fatalf("UpdateUserSegments() error = %v", err)
+			}
+			if membership := env.membership(t, 1, "AVITO_VOICE"); !membership.StartsAt.Equal(tt.wantStartsAt) {
+				t.Errorf("starts_at = %v, want %v", membership.StartsAt, tt.wantStartsAt)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSegmentsRejectsPastExpiry(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	for _, expiresAt := range []time.Time{testNow, testNow.Add(-time.Hour)} {
+		update := SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, ExpiresAt: expiresAt}
+		if _, err := env.users.UpdateUserSegments(update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("UpdateUserSegments(expires_at %v) error = %v, want ErrInvalidUpdate", expiresAt, err)
+		}
+	}
+	if got := env.userSegments(t, 1); len(got) != 0 {
+		t.Errorf("user segments = %q, want none", got)
+	}
+}
+
+func TestUpdateUserSegmentsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		update SegmentsUpdate
+	}{
+		{name: "unknown expiry policy", update: SegmentsUpdate{ExpiryPolicy: "forever"}},
+		{name: "expires_at and ttl", update: SegmentsUpdate{ExpiresAt: testNow.Add(time.Hour), TTL: time.Hour}},
+		{name: "ttl and permanent", update: SegmentsUpdate{TTL: time.Hour, Permanent: true}},
+		{name: "negative ttl", update: SegmentsUpdate{TTL: -time.Hour}},
+		{name: "added and removed", update: SegmentsUpdate{SegmentsToRemove: []string{"AVITO_VOICE"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+			tt.update.UserID = 1
+			tt.update.SegmentsToAdd = []string{"AVITO_VOICE"}
+			if _, err := env.users.UpdateUserSegments(tt.update); !errors.Is(err, ErrInvalidUpdate) {
+				t.Fatalf("UpdateUserSegments() error = %v, want ErrInvalidUpdate", err)
+			}
+			if got := env.history(t); len(got) != 0 {
+				t.Errorf("history = %q, want nothing applied", got)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSegmentsExpiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		update        SegmentsUpdate
+		segmentTTL    time.Duration
+		wantExpiresAt time.Time
+	}{
+		{name: "never expires by default", update: SegmentsUpdate{}},
+		{name: "segment default ttl", segmentTTL: 24 * time.Hour, wantExpiresAt: testNow.Add(24 * time.Hour)},
+		{name: "ttl", update: SegmentsUpdate{TTL: time.Hour}, segmentTTL: 24 * time.Hour, wantExpiresAt: testNow.Add(time.Hour)},
+		{name: "expires_at", update: SegmentsUpdate{ExpiresAt: testNow.Add(48 * time.Hour)}, wantExpiresAt: testNow.Add(48 * time.Hour)},
+		{name: "permanent overrides the default ttl", update: SegmentsUpdate{Permanent: true}, segmentTTL: 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE", DefaultTTL: tt.segmentTTL})
+			tt.update.UserID = 1
+			tt.update.SegmentsToAdd = []string{"AVITO_VOICE"}
+			if _, err := env.users.UpdateUserSegments(tt.update); err != nil {
+				t.Fatalf("UpdateUserSegments() error = %v", err)
+			}
+			if membership := env.membership(t, 1, "AVITO_VOICE"); !membership.ExpiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("expires_at = %v, want %v", membership.ExpiresAt, tt.wantExpiresAt)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSegmentsRemovalNeedsNoExpiry(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE", DefaultTTL: time.Hour})
+	if _, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToRemove: []string{"AVITO_VOICE"}})
+	if err != nil {
+		t.Fatalf("UpdateUserSegments() error = %v", err)
+	}
+	if want := []string{`"AVITO_VOICE" removed successfully`}; !reflect.DeepEqual(messages, want) {
+		t.Errorf("UpdateUserSegments() = %q, want %q", messages, want)
+	}
+}
+
+func TestUpdateUserSegmentsScheduled(t *testing.T) {
+	env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE"})
+	startsAt := testNow.Add(time.Hour)
+	_, err := env.users.UpdateUserSegments(SegmentsUpdate{UserID: 1, SegmentsToAdd: []string{"AVITO_VOICE"}, StartsAt: startsAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := env.userSegments(t, 1); len(got) != 0 {
+		t.Errorf("segments before starts_at = %v, want none", got)
+	}
+	env.clock.now = startsAt
+	if got := env.userSegments(t, 1); !reflect.DeepEqual(got, []string{"AVITO_VOICE"}) {
+		t.Errorf("segments at starts_at = %v, want [AVITO_VOICE]", got)
+	}
+}
+
+func TestUpdateUserSegmentsStartsAt(t *testing.T) {
+	tests := []struct {
+		name          string
+		update        SegmentsUpdate
+		segmentTTL    time.Duration
+		wantStartsAt  time.Time
+		wantExpiresAt time.Time
+		wantMessage   string
+		wantErr       error
+	}{
+		{
+			name:          "ttl counts from starts_at",
+			update:        SegmentsUpdate{StartsAt: testNow.Add(2 * time.Hour), TTL: time.Hour},
+			wantStartsAt:  testNow.Add(2 * time.Hour),
+			wantExpiresAt: testNow.Add(3 * time.Hour),
+			wantMessage:   `"AVITO_VOICE" scheduled to start at 2023-09-01T14:00:00Z`,
+		},
+		{
+			name:          "default ttl counts from starts_at",
+			update:        SegmentsUpdate{StartsAt: testNow.Add(2 * time.Hour)},
+			segmentTTL:    time.Hour,
+			wantStartsAt:  testNow.Add(2 * time.Hour),
+			wantExpiresAt: testNow.Add(3 * time.Hour),
+			wantMessage:   `"AVITO_VOICE" scheduled to start at 2023-09-01T14:00:00Z`,
+		},
+		{
+			name:        "starts_at in the past starts now",
+			update:      SegmentsUpdate{StartsAt: testNow.Add(-time.Hour)},
+			wantMessage: `"AVITO_VOICE" added successfully`,
+		},
+		{
+			name:    "expires before it starts",
+			update:  SegmentsUpdate{StartsAt: testNow.Add(2 * time.Hour), ExpiresAt: testNow.Add(time.Hour)},
+			wantErr: ErrInvalidUpdate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, 1, models.Segment{Slug: "AVITO_VOICE", DefaultTTL: tt.segmentTTL})
+			tt.update.UserID = 1
+			tt.update.SegmentsToAdd = []string{"AVITO_VOICE"}
+			messages, err := env.users.UpdateUserSegments(tt.update)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("UpdateUserSegments() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UpdateUserSegments() error = %v", err)
+			}
+			if !reflect.DeepEqual(messages, []string{tt.wantMessage}) {
+				t.Errorf("UpdateUserSegments() = %q, want %q", messages, tt.wantMessage)
+			}
+
+			membership := env.membership(t, 1, "AVITO_VOICE")
+			if !membership.StartsAt.Equal(tt.wantStartsAt) || !membership.ExpiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("membership starts_at, expires_at = %v, %v, want %v, %v",
+					membership.StartsAt, membership.ExpiresAt, tt.wantStartsAt, tt.wantExpiresAt)
+			}
+		})
+	}
+}